@@ -1,11 +1,25 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/cloudflare/ebpf_exporter/decoder"
 	"github.com/cloudflare/ebpf_exporter/exporter"
+	"github.com/cloudflare/ebpf_exporter/push"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
@@ -14,41 +28,482 @@ import (
 )
 
 func main() {
-	listenAddress := kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests").Default(":9435").String()
+	listenAddresses := kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests, can be repeated, use unix:<path> for unix sockets").Default(":9435").Strings()
+	socketMode := kingpin.Flag("web.unix-socket-mode", "Permissions for unix sockets to listen on").Default("0660").String()
+	metricsPath := kingpin.Flag("web.telemetry-path", "Path under which to expose metrics").Default("/metrics").String()
+	tlsCertFile := kingpin.Flag("tls.cert-file", "Certificate to serve https with, needs --tls.key-file").String()
+	tlsKeyFile := kingpin.Flag("tls.key-file", "Private key of the certificate to serve https with").String()
+	tlsClientCA := kingpin.Flag("tls.client-ca", "CA to require and verify client certificates against").String()
+	tlsClientNames := kingpin.Flag("tls.client-allowed-name", "Common or alternative name of client certificates to allow, can be repeated, all names are allowed if not set").Strings()
+	disableExporterMetrics := kingpin.Flag("web.disable-exporter-metrics", "Exclude go_* and process_* metrics of the exporter itself").Bool()
 	configFile := kingpin.Flag("config.file", "Config file path").Default("config.yaml").File()
 	debug := kingpin.Flag("debug", "Enable debug").Bool()
+	debugSchema := kingpin.Flag("debug.schema-mismatch", "Export table rows with keys not matching labels as <metric>_schema_mismatch instead of failing").Bool()
+	logLevel := kingpin.Flag("log.level", "Log level, debug also logs every http request and errors demoted by quiet options").Default("info").Enum("info", "debug")
+	quietPeriod := kingpin.Flag("log.quiet-period", "Duration after attaching to log errors reading tables only with --log.level=debug while maps warm up").Default("0s").Duration()
+	quietEmpty := kingpin.Flag("log.quiet-empty-tables", "Log errors about tables that are empty only with --log.level=debug").Bool()
+	traceMetric := kingpin.Flag("trace-metric", "Log every decoding step for <program>:<metric> on the next scrape").String()
+	listDecoders := kingpin.Flag("list-decoders", "List available decoders with their options and exit").Bool()
+	disabledPrograms := kingpin.Flag("disable-program", "Program from config to skip, can be repeated").Strings()
+	kernelHeaders := kingpin.Flag("kernel.headers", "Path to kernel headers for compiling eBPF programs, overrides bcc defaults").Envar("BCC_KERNEL_SOURCE").String()
+	decoderCache := kingpin.Flag("decoder.cache-size", "Number of decoded label values of cacheable decoders to cache for every program, 0 disables caching").Default("0").Int()
+	decoderSample := kingpin.Flag("decoder.duration-sample-every", "Time every nth call of each decoder for ebpf_exporter_decode_duration_seconds, 0 disables timing").Default("100").Int()
+	batchSize := kingpin.Flag("table.batch-size", "Number of entries to read from tables in one syscall on kernels with batch lookups, 0 disables batching").Default("0").Int()
+	bpfStats := kingpin.Flag("bpf.stats", "Enable kernel bpf_stats to report run count and run time of programs, which adds overhead to every run").Bool()
+	nodeLabel := kingpin.Flag("node.label", "Label to add to every metric with node name, empty disables it").String()
+	nodeName := kingpin.Flag("node.name", "Node name for --node.label, defaults to hostname").String()
+	settleDuration := kingpin.Flag("settle-duration", "Duration after attaching to respond with 503 to scrapes while maps fill with data").Default("0s").Duration()
+	pushAddress := kingpin.Flag("push.address", "Address of graphite or statsd to push metrics to in addition to serving them, empty disables pushing").String()
+	pushFormat := kingpin.Flag("push.format", "Format to push metrics in").Default("graphite").Enum(push.FormatGraphite, push.FormatStatsd)
+	pushInterval := kingpin.Flag("push.interval", "Interval to push metrics at").Default("60s").Duration()
+	pushPrefix := kingpin.Flag("push.prefix", "Prefix to add to names of pushed metrics with a dot").String()
+	gatewayURL := kingpin.Flag("pushgateway.url", "Pushgateway to push metrics to once after --oneshot.duration and exit instead of serving them").String()
+	gatewayJob := kingpin.Flag("pushgateway.job", "Job label to push metrics with").Default("ebpf_exporter").String()
+	gatewayInstance := kingpin.Flag("pushgateway.instance", "Instance label to push metrics with, defaults to hostname").String()
+	oneshotDuration := kingpin.Flag("oneshot.duration", "Duration to measure for before pushing to --pushgateway.url").Default("60s").Duration()
+	modulesInterval := kingpin.Flag("kernel.modules-check-interval", "Interval to check for reloaded kernel modules to reattach kprobes to, 0 disables checking").Default("0s").Duration()
+	skipPrivileges := kingpin.Flag("privileges.skip-check", "Start even if capabilities needed to load programs seem to be missing").Bool()
+	memlockLimit := kingpin.Flag("memlock.limit", "Memlock rlimit in bytes to set before attaching or \"unlimited\", empty keeps the current limit").Default("unlimited").String()
 	kingpin.Version(version.Print("ebpf_exporter"))
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 
+	if *listDecoders {
+		writeDecoders(os.Stdout)
+		return
+	}
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("Error parsing unix socket mode %q: %s", *socketMode, err)
+	}
+
+	tlsConfig, err := loadTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCA, *tlsClientNames)
+	if err != nil {
+		log.Fatalf("Error configuring tls: %s", err)
+	}
+
+	configData, err := ioutil.ReadAll(*configFile)
+	if err != nil {
+		log.Fatalf("Error reading config file: %s", err)
+	}
+
+	warnings, err := config.CheckVersion(configData)
+	if err != nil {
+		log.Fatalf("Error checking config version: %s", err)
+	}
+
+	for _, warning := range warnings {
+		log.Printf("Config warning: %s", warning)
+	}
+
 	config := config.Config{}
 
-	err := yaml.NewDecoder(*configFile).Decode(&config)
+	err = yaml.Unmarshal(configData, &config)
 	if err != nil {
 		log.Fatalf("Error reading config file: %s", err)
 	}
 
+	err = loadProgramCode(&config, filepath.Dir((*configFile).Name()))
+	if err != nil {
+		log.Fatalf("Error loading program code: %s", err)
+	}
+
+	config.DisabledPrograms = append(config.DisabledPrograms, *disabledPrograms...)
+
+	status := []string{}
+
+	granted, err := checkPrivileges()
+	if err != nil {
+		log.Printf("Error checking privileges: %s", err)
+	} else {
+		status = append(status, fmt.Sprintf("privileges: %s", granted.summary()))
+		log.Printf("Privileges: %s", granted.summary())
+
+		for _, warning := range granted.warnings() {
+			status = append(status, fmt.Sprintf("warning: %s", warning))
+			log.Printf("Privileges warning: %s", warning)
+		}
+
+		if problem := granted.problem(); problem != "" {
+			if !*skipPrivileges {
+				log.Fatalf("Error checking privileges: %s, pass --privileges.skip-check to start anyway", problem)
+			}
+
+			status = append(status, fmt.Sprintf("warning: %s", problem))
+			log.Printf("Privileges warning: %s", problem)
+		}
+	}
+
+	if *memlockLimit != "" {
+		err = setMemlockLimit(*memlockLimit)
+		if err != nil {
+			// Newer kernels account BPF memory with memory cgroups instead
+			log.Printf("Error setting memlock rlimit: %s", err)
+		}
+	}
+
+	if *kernelHeaders != "" {
+		err = setKernelHeaders(*kernelHeaders)
+		if err != nil {
+			log.Fatalf("Error setting kernel headers: %s", err)
+		}
+	}
+
+	if *bpfStats {
+		err = enableBPFStats()
+		if err != nil {
+			log.Fatalf("Error enabling bpf_stats: %s", err)
+		}
+	}
+
 	e := exporter.New(config)
+	e.LookupBatchSize(*batchSize)
+	e.DecoderCacheSize(*decoderCache)
+	e.DecoderDurationSampling(*decoderSample)
+	e.QuietPeriod(*quietPeriod)
+
+	if *quietEmpty {
+		e.QuietEmptyTables()
+	}
+
+	if *logLevel == "debug" {
+		e.DebugLogs()
+	}
+
+	if *debugSchema {
+		e.ExportSchemaMismatches()
+	}
+
+	if *nodeLabel != "" {
+		if *nodeName == "" {
+			*nodeName, err = os.Hostname()
+			if err != nil {
+				log.Fatalf("Error getting hostname: %s", err)
+			}
+		}
+
+		e.AddConstLabel(*nodeLabel, *nodeName)
+	}
+
 	err = e.Attach()
 	if err != nil {
 		log.Fatalf("Error attaching exporter: %s", err)
 	}
 
+	if *traceMetric != "" {
+		parts := strings.SplitN(*traceMetric, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Error parsing metric to trace %q, expected <program>:<metric>", *traceMetric)
+		}
+
+		e.TraceMetric(parts[0], parts[1])
+	}
+
+	if *modulesInterval > 0 {
+		go e.WatchKernelModules(*modulesInterval)
+	}
+
+	// Go and process collectors are registered by the client library
+	if *disableExporterMetrics {
+		prometheus.Unregister(prometheus.NewGoCollector())
+		prometheus.Unregister(prometheus.NewProcessCollector(os.Getpid(), ""))
+	}
+
 	err = prometheus.Register(e)
 	if err != nil {
 		log.Fatalf("Error registering exporter: %s", err)
 	}
 
-	http.Handle("/metrics", promhttp.Handler())
+	if *gatewayURL != "" {
+		oneshot(*gatewayURL, *gatewayJob, *gatewayInstance, *oneshotDuration)
+		return
+	}
+
+	ready := time.Now().Add(*settleDuration)
+
+	if *pushAddress != "" {
+		pusher, err := push.New(prometheus.DefaultGatherer, *pushFormat, *pushAddress, *pushPrefix)
+		if err != nil {
+			log.Fatalf("Error creating pusher: %s", err)
+		}
+
+		log.Printf("Pushing metrics to %s in %s format every %s", *pushAddress, *pushFormat, *pushInterval)
+		go pusher.Run(ready, *pushInterval)
+	}
+
+	http.Handle(*metricsPath, settle(promhttp.Handler(), ready))
+	http.Handle("/healthz", settle(healthz(status), ready))
+	http.HandleFunc("/-/decoders", decoders)
+
+	for _, group := range e.Groups() {
+		registry := prometheus.NewRegistry()
+
+		err = registry.Register(e.GroupCollector(group))
+		if err != nil {
+			log.Fatalf("Error registering exporter for group %q: %s", group, err)
+		}
+
+		groupPath := path.Join(*metricsPath, group)
+
+		log.Printf("Serving metrics of group %q on %s", group, groupPath)
+		http.Handle(groupPath, settle(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), ready))
+	}
 
 	if *debug {
 		log.Printf("Debug enabled, exporting raw tables on /tables")
 		http.HandleFunc("/tables", e.TablesHandler)
 	}
 
-	log.Printf("Listening on %s", *listenAddress)
-	err = http.ListenAndServe(*listenAddress, nil)
+	var handler http.Handler = http.DefaultServeMux
+	if *logLevel == "debug" {
+		handler = logRequests(handler)
+	}
+
+	for _, listenAddress := range *listenAddresses {
+		go listen(listenAddress, os.FileMode(mode), tlsConfig, handler)
+	}
+
+	select {}
+}
+
+// oneshot lets programs run for the duration, pushes metrics to pushgateway
+// and exits, which is useful for measurements in short-lived jobs
+func oneshot(gatewayURL, job, instance string, duration time.Duration) {
+	if instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Error getting hostname: %s", err)
+		}
+
+		instance = hostname
+	}
+
+	log.Printf("Measuring for %s before pushing to %s", duration, gatewayURL)
+
+	time.Sleep(duration)
+
+	err := push.Gateway(prometheus.DefaultGatherer, gatewayURL, job, instance)
 	if err != nil {
-		log.Fatalf("Error listening on %s: %s", *listenAddress, err)
+		log.Fatalf("Error pushing metrics to %s: %s", gatewayURL, err)
 	}
+
+	log.Printf("Pushed metrics to %s as job %q and instance %q", gatewayURL, job, instance)
+}
+
+// listen serves http requests on the address, exiting on failure,
+// requests are served over https if tls config is set
+func listen(listenAddress string, socketMode os.FileMode, tlsConfig *tls.Config, handler http.Handler) {
+	log.Printf("Listening on %s", listenAddress)
+
+	listener, err := listenSocket(listenAddress, socketMode)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %s", listenAddress, err)
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	err = http.Serve(listener, handler)
+	if err != nil {
+		log.Fatalf("Error serving on %s: %s", listenAddress, err)
+	}
+}
+
+// listenSocket listens on the tcp address or on the unix socket
+// if the address starts with unix:
+func listenSocket(listenAddress string, socketMode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(listenAddress, "unix:") {
+		return net.Listen("tcp", listenAddress)
+	}
+
+	path := strings.TrimPrefix(listenAddress, "unix:")
+
+	// Socket left over from the previous run prevents listening
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("error removing stale unix socket: %s", err)
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, socketMode)
+	if err != nil {
+		return nil, fmt.Errorf("error setting permissions on unix socket: %s", err)
+	}
+
+	return listener, nil
+}
+
+// settle responds with 503 until the exporter is ready, which keeps prometheus
+// from recording samples from maps that are not filled with data yet
+func settle(handler http.Handler, ready time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().Before(ready) {
+			http.Error(w, "Settling after attach, not ready yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// healthz reports that the exporter is ready along with the status
+// of startup checks, like what it is allowed to do on the host
+func healthz(status []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+
+		for _, line := range status {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// decoders lists available decoders, which only depends on the build,
+// so it is safe to expose along with metrics
+func decoders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-type", "text/plain")
+	writeDecoders(w)
+}
+
+// writeDecoders writes names of available decoders with their
+// descriptions and options from decoder config they use
+func writeDecoders(w io.Writer) {
+	for _, description := range decoder.List() {
+		fmt.Fprintf(w, "%s: %s\n", description.Name, description.Help)
+
+		if len(description.Options) > 0 {
+			fmt.Fprintf(w, "  options: %s\n", strings.Join(description.Options, ", "))
+		}
+	}
+}
+
+// statusRecorder remembers the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader remembers the status code and passes it on
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// logRequests logs method, path, status, duration and remote address
+// of every request after it is served
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		start := time.Now()
+		handler.ServeHTTP(recorder, r)
+		duration := time.Since(start)
+
+		log.Printf("Request: method=%s path=%s status=%d duration=%s remote=%s", r.Method, r.URL.Path, recorder.status, duration, r.RemoteAddr)
+	})
+}
+
+// setKernelHeaders points bcc to kernel headers in a non-standard location
+func setKernelHeaders(path string) error {
+	for _, dir := range []string{path, filepath.Join(path, "include", "linux")} {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("error checking kernel headers directory: %s", err)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("kernel headers path %s is not a directory", dir)
+		}
+	}
+
+	log.Printf("Using kernel headers from %s", path)
+
+	// This is what bcc checks to find kernel headers
+	return os.Setenv("BCC_KERNEL_SOURCE", path)
+}
+
+// loadProgramCode reads code of programs with code_path set,
+// relative paths are resolved against the config directory
+func loadProgramCode(config *config.Config, dir string) error {
+	for i, program := range config.Programs {
+		if program.CodePath == "" {
+			continue
+		}
+
+		if program.Code != "" {
+			return fmt.Errorf("program %q has both code and code_path", program.Name)
+		}
+
+		path := program.CodePath
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		code, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading code of program %q: %s", program.Name, err)
+		}
+
+		config.Programs[i].Code = string(code)
+	}
+
+	return nil
+}
+
+// enableBPFStats makes the kernel count runs and run time of bpf programs
+func enableBPFStats() error {
+	err := ioutil.WriteFile("/proc/sys/kernel/bpf_stats_enabled", []byte("1"), 0644)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Enabled bpf_stats")
+
+	return nil
+}
+
+// RLIMIT_MEMLOCK is missing from syscall package, this is its value on linux
+const rlimitMemlock = 0x8
+
+// setMemlockLimit raises memlock rlimit, which limits the size of BPF maps
+// that can be created on kernels without memory cgroup accounting for them
+func setMemlockLimit(limit string) error {
+	value := ^uint64(0)
+
+	if limit != "unlimited" {
+		parsed, err := strconv.ParseUint(limit, 10, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing memlock limit %q: %s", limit, err)
+		}
+
+		value = parsed
+	}
+
+	err := syscall.Setrlimit(rlimitMemlock, &syscall.Rlimit{Cur: value, Max: value})
+	if err != nil {
+		return err
+	}
+
+	effective := syscall.Rlimit{}
+
+	err = syscall.Getrlimit(rlimitMemlock, &effective)
+	if err != nil {
+		return err
+	}
+
+	if effective.Cur == ^uint64(0) {
+		log.Printf("Memlock rlimit is set to unlimited")
+	} else {
+		log.Printf("Memlock rlimit is set to %d bytes", effective.Cur)
+	}
+
+	return nil
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Capability bits from linux/capability.h
+const (
+	capSysAdmin = 21
+	capSyslog   = 34
+	capPerfmon  = 38
+	capBPF      = 39
+)
+
+// privileges is what the exporter is allowed to do with bpf on the host
+type privileges struct {
+	capabilities uint64
+	// unprivilegedBPF is kernel.unprivileged_bpf_disabled, -1 if unknown
+	unprivilegedBPF int
+	// kptrRestrict is kernel.kptr_restrict, -1 if unknown
+	kptrRestrict int
+}
+
+// checkPrivileges reads effective capabilities of the exporter
+// and sysctls that restrict what it can do
+func checkPrivileges() (privileges, error) {
+	capabilities, err := effectiveCapabilities()
+	if err != nil {
+		return privileges{}, fmt.Errorf("error reading capabilities: %s", err)
+	}
+
+	return privileges{
+		capabilities:    capabilities,
+		unprivilegedBPF: readSysctl("/proc/sys/kernel/unprivileged_bpf_disabled"),
+		kptrRestrict:    readSysctl("/proc/sys/kernel/kptr_restrict"),
+	}, nil
+}
+
+// has returns whether the capability is effective
+func (p privileges) has(capability uint) bool {
+	return p.capabilities&(1<<capability) != 0
+}
+
+// canLoad returns whether programs can be loaded and attached to probes,
+// which needs CAP_SYS_ADMIN or CAP_BPF with CAP_PERFMON on newer kernels
+func (p privileges) canLoad() bool {
+	return p.has(capSysAdmin) || (p.has(capBPF) && p.has(capPerfmon))
+}
+
+// problem returns an actionable message if programs cannot be loaded
+func (p privileges) problem() string {
+	if p.canLoad() {
+		return ""
+	}
+
+	message := "the exporter needs CAP_SYS_ADMIN or CAP_BPF with CAP_PERFMON to load programs, run it as root or grant these capabilities"
+
+	if p.unprivilegedBPF > 0 {
+		message += fmt.Sprintf(", unprivileged bpf is disabled with kernel.unprivileged_bpf_disabled=%d", p.unprivilegedBPF)
+	}
+
+	return message
+}
+
+// warnings returns what will not work with the privileges
+func (p privileges) warnings() []string {
+	warnings := []string{}
+
+	switch {
+	case p.kptrRestrict >= 2:
+		warnings = append(warnings, fmt.Sprintf("kernel addresses are hidden with kernel.kptr_restrict=%d, ksym and kstack decoders and reattaching kprobes will not work", p.kptrRestrict))
+	case p.kptrRestrict == 1 && !p.has(capSyslog):
+		warnings = append(warnings, "kernel addresses are hidden with kernel.kptr_restrict=1 without CAP_SYSLOG, ksym and kstack decoders and reattaching kprobes will not work")
+	}
+
+	if !p.has(capSysAdmin) && p.canLoad() {
+		warnings = append(warnings, "running with CAP_BPF and CAP_PERFMON without CAP_SYS_ADMIN, which needs linux 5.8 or newer")
+	}
+
+	return warnings
+}
+
+// summary describes the privileges in one line
+func (p privileges) summary() string {
+	names := []string{}
+
+	for _, capability := range []struct {
+		name string
+		bit  uint
+	}{{"CAP_SYS_ADMIN", capSysAdmin}, {"CAP_BPF", capBPF}, {"CAP_PERFMON", capPerfmon}, {"CAP_SYSLOG", capSyslog}} {
+		if p.has(capability.bit) {
+			names = append(names, capability.name)
+		}
+	}
+
+	if len(names) == 0 {
+		names = append(names, "none")
+	}
+
+	return fmt.Sprintf("capabilities=%s kernel.unprivileged_bpf_disabled=%d kernel.kptr_restrict=%d", strings.Join(names, ","), p.unprivilegedBPF, p.kptrRestrict)
+}
+
+// effectiveCapabilities reads the effective capability set of the exporter
+func effectiveCapabilities() (uint64, error) {
+	file, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "CapEff:") {
+			return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		}
+	}
+
+	return 0, fmt.Errorf("no effective capabilities in /proc/self/status")
+}
+
+// readSysctl reads an integer sysctl, returning -1 if it cannot be read,
+// like on kernels that do not have it
+func readSysctl(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+
+	return value
+}
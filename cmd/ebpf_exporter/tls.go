@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadTLSConfig makes config for serving https with the certificate and the key,
+// requiring client certificates signed by the client CA if it is set
+func loadTLSConfig(certFile, keyFile, clientCAFile string, clientNames []string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" || len(clientNames) > 0 {
+			return nil, fmt.Errorf("client certificate verification needs --tls.cert-file and --tls.key-file")
+		}
+
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate: %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile == "" {
+		if len(clientNames) > 0 {
+			return nil, fmt.Errorf("allowed client names need --tls.client-ca")
+		}
+
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA %s", clientCAFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	if len(clientNames) > 0 {
+		config.VerifyPeerCertificate = verifyClientNames(clientNames)
+	}
+
+	return config, nil
+}
+
+// verifyClientNames rejects verified client certificates that have none
+// of the names as common name or subject alternative name
+func verifyClientNames(names []string) func([][]byte, [][]*x509.Certificate) error {
+	allowed := map[string]bool{}
+	for _, name := range names {
+		allowed[name] = true
+	}
+
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			cert := chain[0]
+
+			if allowed[cert.Subject.CommonName] {
+				return nil
+			}
+
+			for _, name := range cert.DNSNames {
+				if allowed[name] {
+					return nil
+				}
+			}
+
+			for _, name := range cert.EmailAddresses {
+				if allowed[name] {
+					return nil
+				}
+			}
+		}
+
+		return fmt.Errorf("client certificate name is not allowed")
+	}
+}
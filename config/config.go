@@ -1,59 +1,370 @@
 package config
 
+import (
+	"fmt"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
 // Config defines exporter configuration
 type Config struct {
-	Programs []Program `yaml:"programs"`
+	Version          int       `yaml:"version"`
+	Programs         []Program `yaml:"programs"`
+	DisabledPrograms []string  `yaml:"disabled_programs"`
+	CommonCode       string    `yaml:"common_code"`
 }
 
 // Program is an eBPF program with optional metrics attached to it
 type Program struct {
-	Name       string            `yaml:"name"`
-	Metrics    Metrics           `yaml:"metrics"`
-	Kprobes    map[string]string `yaml:"kprobes"`
-	Kretprobes map[string]string `yaml:"kretprobes"`
-	Code       string            `yaml:"code"`
+	Name            string            `yaml:"name"`
+	Group           string            `yaml:"group"`
+	Metrics         Metrics           `yaml:"metrics"`
+	ConstLabels     map[string]string `yaml:"const_labels"`
+	MinKernel       string            `yaml:"min_kernel"`
+	MaxKernel       string            `yaml:"max_kernel"`
+	SettleDuration  time.Duration     `yaml:"settle_duration"`
+	CollectTimeout  time.Duration     `yaml:"collect_timeout"`
+	GenerationTable string            `yaml:"generation_table"`
+	ProgArrays      []ProgArray       `yaml:"prog_arrays"`
+	Kprobes         Probes            `yaml:"kprobes"`
+	Kretprobes      Probes            `yaml:"kretprobes"`
+	TracepointsGlob Probes            `yaml:"tracepoints_glob"`
+	CgroupPrograms  []CgroupProgram   `yaml:"cgroup_programs"`
+	PerfEvents      []PerfEvent       `yaml:"perf_events"`
+	Code            string            `yaml:"code"`
+	CodePath        string            `yaml:"code_path"`
+}
+
+// Probe attaches eBPF function (target) to a kernel function (probe)
+type Probe struct {
+	Probe  string `yaml:"probe"`
+	Target string `yaml:"target"`
+}
+
+// Probes is an ordered list of probes, which can be defined either
+// as a list of probes or as a mapping of kernel functions to targets
+type Probes []Probe
+
+// UnmarshalYAML satisfies yaml.Unmarshaler interface and keeps
+// the order of probes for both list and mapping definitions
+func (p *Probes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	list := []Probe{}
+
+	err := unmarshal(&list)
+	if err == nil {
+		*p = list
+		return nil
+	}
+
+	mapping := yaml.MapSlice{}
+
+	err = unmarshal(&mapping)
+	if err != nil {
+		return err
+	}
+
+	*p = make(Probes, 0, len(mapping))
+
+	for _, item := range mapping {
+		probe, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("probe %v is not a string", item.Key)
+		}
+
+		target, ok := item.Value.(string)
+		if !ok {
+			return fmt.Errorf("target %v of probe %q is not a string", item.Value, probe)
+		}
+
+		*p = append(*p, Probe{Probe: probe, Target: target})
+	}
+
+	return nil
+}
+
+// CgroupProgram attaches eBPF function (target) to a cgroup
+type CgroupProgram struct {
+	Cgroup     string `yaml:"cgroup"`
+	AttachType string `yaml:"attach_type"`
+	Target     string `yaml:"target"`
+}
+
+// PerfEvent attaches eBPF function (target) to a sampling perf event opened
+// on every CPU or only on the listed CPUs, for all processes or only for
+// the process with the pid, processes with the name or the pid from the file
+type PerfEvent struct {
+	Event           string `yaml:"event"`
+	SamplePeriod    uint64 `yaml:"sample_period"`
+	SampleFrequency uint64 `yaml:"sample_frequency"`
+	CPUs            []int  `yaml:"cpus"`
+	PID             int    `yaml:"pid"`
+	ProcessName     string `yaml:"process_name"`
+	PIDFile         string `yaml:"pid_file"`
+	Target          string `yaml:"target"`
+}
+
+// ProgArray is a BPF_PROG_ARRAY table populated with program functions
+// to allow tail calls between them
+type ProgArray struct {
+	Table   string           `yaml:"table"`
+	Entries []ProgArrayEntry `yaml:"entries"`
+}
+
+// ProgArrayEntry puts a function into prog array under the index,
+// the function is loaded as the program type of its callers
+type ProgArrayEntry struct {
+	Index    int    `yaml:"index"`
+	Function string `yaml:"function"`
+	Type     string `yaml:"type"`
 }
 
 // Metrics is a collection of metrics attached to a program
 type Metrics struct {
-	Counters   []Counter   `yaml:"counters"`
-	Histograms []Histogram `yaml:"histograms"`
+	Counters       []Counter       `yaml:"counters"`
+	Gauges         []Gauge         `yaml:"gauges"`
+	Histograms     []Histogram     `yaml:"histograms"`
+	Queues         []Queue         `yaml:"queues"`
+	PerfHistograms []PerfHistogram `yaml:"perf_histograms"`
+	Custom         []Custom        `yaml:"custom"`
 }
 
 // Counter is a metric defining prometheus counter
 type Counter struct {
-	Name   string  `yaml:"name"`
-	Help   string  `yaml:"help"`
-	Table  string  `yaml:"table"`
-	Labels []Label `yaml:"labels"`
+	Name            string         `yaml:"name"`
+	Help            string         `yaml:"help"`
+	Table           string         `yaml:"table"`
+	PinnedTable     string         `yaml:"pinned_table"`
+	Global          string         `yaml:"global"`
+	ValueDivisor    float64        `yaml:"value_divisor"`
+	PerCPULabel     string         `yaml:"per_cpu_label"`
+	Aggregation     string         `yaml:"aggregation"`
+	TimestampTable  string         `yaml:"timestamp_table"`
+	TTL             time.Duration  `yaml:"ttl"`
+	Untyped         bool           `yaml:"untyped"`
+	ZeroWhenEmpty   bool           `yaml:"emit_zero_when_empty"`
+	ValueDecoder    *ValueDecoder  `yaml:"value_decoder"`
+	SpinLockField   *int           `yaml:"spin_lock_field"`
+	PackedU32       *PackedU32     `yaml:"packed_u32"`
+	MaxSeries       int            `yaml:"max_series"`
+	SampleRatio     float64        `yaml:"sample_ratio"`
+	OnParseError    string         `yaml:"on_parse_error"`
+	DropIf          []DropIf       `yaml:"drop_if"`
+	IgnoreKeyFields []int          `yaml:"ignore_key_fields"`
+	ProcessRollup   *ProcessRollup `yaml:"process_rollup"`
+	Labels          []Label        `yaml:"labels"`
+}
+
+// ProcessRollup is an additional counter with values of threads
+// summed up into values of their processes
+type ProcessRollup struct {
+	Name     string `yaml:"name"`
+	TIDLabel string `yaml:"tid_label"`
+	PIDLabel string `yaml:"pid_label"`
+}
+
+// Gauge is a metric defining prometheus gauge
+type Gauge struct {
+	Name            string        `yaml:"name"`
+	Help            string        `yaml:"help"`
+	Table           string        `yaml:"table"`
+	PinnedTable     string        `yaml:"pinned_table"`
+	Global          string        `yaml:"global"`
+	ValueDivisor    float64       `yaml:"value_divisor"`
+	PerCPULabel     string        `yaml:"per_cpu_label"`
+	Aggregation     string        `yaml:"aggregation"`
+	Boolean         bool          `yaml:"boolean"`
+	KernelRate      bool          `yaml:"kernel_rate"`
+	StateSet        *StateSet     `yaml:"state_set"`
+	ValueDecoder    *ValueDecoder `yaml:"value_decoder"`
+	SpinLockField   *int          `yaml:"spin_lock_field"`
+	PackedU32       *PackedU32    `yaml:"packed_u32"`
+	MaxSeries       int           `yaml:"max_series"`
+	SampleRatio     float64       `yaml:"sample_ratio"`
+	OnParseError    string        `yaml:"on_parse_error"`
+	DropIf          []DropIf      `yaml:"drop_if"`
+	IgnoreKeyFields []int         `yaml:"ignore_key_fields"`
+	Labels          []Label       `yaml:"labels"`
+}
+
+// ValueDecoder reads metric value from a value rendered as a byte array,
+// which is how bcc renders packed structs, as a little-endian integer
+type ValueDecoder struct {
+	Type   string `yaml:"type"`
+	Offset int    `yaml:"offset"`
+}
+
+// PackedU32 splits u64 values holding two u32 counters into two series
+// with the label set to the name of the lower or the upper half
+type PackedU32 struct {
+	Label string `yaml:"label"`
+	Low   string `yaml:"low"`
+	High  string `yaml:"high"`
+}
+
+// StateSet turns gauge values into states with a series for each state,
+// where the series of the current state has value 1 and others have 0
+type StateSet struct {
+	Label  string            `yaml:"label"`
+	States map[uint64]string `yaml:"states"`
 }
 
 // Histogram is a metric defining prometheus histogram
 type Histogram struct {
-	Name             string              `yaml:"name"`
-	Help             string              `yaml:"help"`
-	Table            string              `yaml:"table"`
-	BucketType       HistogramBucketType `yaml:"bucket_type"`
-	BucketMultiplier float64             `yaml:"bucket_multiplier"`
-	BucketMin        int                 `yaml:"bucket_min"`
-	BucketMax        int                 `yaml:"bucket_max"`
-	Labels           []Label             `yaml:"labels"`
+	Name               string               `yaml:"name"`
+	Help               string               `yaml:"help"`
+	Table              string               `yaml:"table"`
+	BucketType         HistogramBucketType  `yaml:"bucket_type"`
+	BucketMultiplier   float64              `yaml:"bucket_multiplier"`
+	BucketMultipliers  *BucketMultipliers   `yaml:"bucket_multipliers"`
+	BucketMin          int                  `yaml:"bucket_min"`
+	BucketMax          int                  `yaml:"bucket_max"`
+	BoundariesTable    string               `yaml:"boundaries_table"`
+	RebucketBoundaries []float64            `yaml:"rebucket_boundaries"`
+	InfBucket          bool                 `yaml:"inf_bucket"`
+	OverflowBucket     *int                 `yaml:"overflow_bucket"`
+	RawBuckets         bool                 `yaml:"raw_buckets"`
+	TotalMetric        string               `yaml:"total_metric"`
+	TotalTable         string               `yaml:"total_table"`
+	EventsMetric       bool                 `yaml:"events_metric"`
+	Aggregated         *AggregatedHistogram `yaml:"aggregated"`
+	PerCPULabel        string               `yaml:"per_cpu_label"`
+	MaxSeries          int                  `yaml:"max_series"`
+	SampleRatio        float64              `yaml:"sample_ratio"`
+	OnParseError       string               `yaml:"on_parse_error"`
+	DropIf             []DropIf             `yaml:"drop_if"`
+	IgnoreKeyFields    []int                `yaml:"ignore_key_fields"`
+	Labels             []Label              `yaml:"labels"`
+}
+
+// BucketMultipliers are bucket multipliers for values of a label of
+// a histogram, used instead of bucket_multiplier for these values
+type BucketMultipliers struct {
+	Label  string             `yaml:"label"`
+	Values map[string]float64 `yaml:"values"`
+}
+
+// AggregatedHistogram is an additional histogram with some labels
+// of the histogram summed out
+type AggregatedHistogram struct {
+	Name       string   `yaml:"name"`
+	DropLabels []string `yaml:"drop_labels"`
+}
+
+// Queue is a metric defining prometheus histogram of values
+// popped out of BPF_MAP_TYPE_QUEUE or BPF_MAP_TYPE_STACK table
+type Queue struct {
+	Name    string    `yaml:"name"`
+	Help    string    `yaml:"help"`
+	Table   string    `yaml:"table"`
+	Buckets []float64 `yaml:"buckets"`
+}
+
+// PerfHistogram is a metric defining prometheus histogram of samples
+// sent by the program to BPF_PERF_OUTPUT table, which are bucketed
+// in user space rather than in the kernel
+type PerfHistogram struct {
+	Name         string        `yaml:"name"`
+	Help         string        `yaml:"help"`
+	Table        string        `yaml:"table"`
+	Buckets      []float64     `yaml:"buckets"`
+	Value        SampleField   `yaml:"value"`
+	ValueDivisor float64       `yaml:"value_divisor"`
+	Labels       []SampleLabel `yaml:"labels"`
+}
+
+// SampleField is a field of samples from perf buffers at the byte offset,
+// either an integer of value type or a string of the given size
+type SampleField struct {
+	Type   string `yaml:"type"`
+	Offset int    `yaml:"offset"`
+	Size   int    `yaml:"size"`
+}
+
+// SampleLabel is a label decoded from a field of samples
+type SampleLabel struct {
+	Label `yaml:",inline"`
+	Field SampleField `yaml:"field"`
+}
+
+// DropIf is a condition to drop table rows with the decoded label
+// either equal to the value or matching the regexp
+type DropIf struct {
+	Label  string `yaml:"label"`
+	Value  string `yaml:"value"`
+	Regexp string `yaml:"regexp"`
+}
+
+// Custom is a metric emitted by an emitter registered in exporter,
+// extra labels are the ones the emitter adds after decoded labels
+type Custom struct {
+	Name         string        `yaml:"name"`
+	Help         string        `yaml:"help"`
+	Table        string        `yaml:"table"`
+	Emitter      string        `yaml:"emitter"`
+	PerCPULabel  string        `yaml:"per_cpu_label"`
+	Aggregation  string        `yaml:"aggregation"`
+	ValueDecoder *ValueDecoder `yaml:"value_decoder"`
+	OnParseError string        `yaml:"on_parse_error"`
+	ExtraLabels  []string      `yaml:"extra_labels"`
+	Labels       []Label       `yaml:"labels"`
 }
 
 // Label defines how to decode an element from eBPF table key
 // with the list of decoders
 type Label struct {
-	Name     string    `yaml:"name"`
-	Decoders []Decoder `yaml:"decoders"`
+	Name      string    `yaml:"name"`
+	ExportAs  string    `yaml:"export_as"`
+	MaxValues int       `yaml:"max_values"`
+	Decoders  []Decoder `yaml:"decoders"`
 }
 
 // Decoder defines how to decode value
 type Decoder struct {
-	Name      string            `yaml:"name"`
-	StaticMap map[string]string `yaml:"static_map"`
-	Regexps   []string          `yaml:"regexps"`
+	Name        string            `yaml:"name"`
+	StaticMap   map[string]string `yaml:"static_map"`
+	Regexps     []string          `yaml:"regexps"`
+	StackTable  string            `yaml:"stack_table"`
+	Binary      string            `yaml:"binary"`
+	ByteOrder   string            `yaml:"byte_order"`
+	File        string            `yaml:"file"`
+	KeyColumn   string            `yaml:"key_column"`
+	ValueColumn string            `yaml:"value_column"`
+	Resolve     bool              `yaml:"resolve"`
+	Template    string            `yaml:"template"`
+	Field       *ValueDecoder     `yaml:"field"`
 }
 
+// Aggregation is an enum to define how to reduce values of per-CPU maps
+const (
+	// AggregationSum means values for all CPUs are summed, which is the default
+	AggregationSum = "sum"
+	// AggregationMax means the maximum value across all CPUs is taken
+	AggregationMax = "max"
+	// AggregationMin means the minimum value across all CPUs is taken
+	AggregationMin = "min"
+	// AggregationAvg means values for all CPUs are averaged
+	AggregationAvg = "avg"
+)
+
+// Parse error policies define what happens with table values that cannot be parsed
+const (
+	// OnParseErrorFail means the whole table fails to be read, which is the default
+	OnParseErrorFail = "fail"
+	// OnParseErrorSkip means the value is logged and skipped
+	OnParseErrorSkip = "skip"
+)
+
+// Cgroup attach types define where cgroup programs are attached
+const (
+	// CgroupAttachIngress means cgroup_skb program for incoming packets
+	CgroupAttachIngress = "ingress"
+	// CgroupAttachEgress means cgroup_skb program for outgoing packets
+	CgroupAttachEgress = "egress"
+	// CgroupAttachSock means cgroup_sock program for socket creation
+	CgroupAttachSock = "sock"
+)
+
 // HistogramBucketType is an enum to define how to interpret histogram
 type HistogramBucketType string
 
@@ -63,3 +374,25 @@ const (
 	// HistogramBucketLinear means histogram with linear keys
 	HistogramBucketLinear = "linear"
 )
+
+// Value types define integer types of value decoders
+const (
+	// ValueTypeU8 means one byte unsigned integer
+	ValueTypeU8 = "u8"
+	// ValueTypeU16 means two byte unsigned integer
+	ValueTypeU16 = "u16"
+	// ValueTypeU32 means four byte unsigned integer
+	ValueTypeU32 = "u32"
+	// ValueTypeU64 means eight byte unsigned integer
+	ValueTypeU64 = "u64"
+	// ValueTypeString means NUL terminated string, only for sample fields
+	ValueTypeString = "string"
+)
+
+// Byte orders define how addresses are stored in the kernel
+const (
+	// ByteOrderNetwork means big endian, which is the default
+	ByteOrderNetwork = "network"
+	// ByteOrderHost means the byte order of the host
+	ByteOrderHost = "host"
+)
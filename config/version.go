@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// CurrentVersion is the latest version of the config schema
+const CurrentVersion = 2
+
+// versionOneFields are fields of the first version of the config schema
+// as <type>.<yaml key>, every other field needs version 2
+var versionOneFields = map[string]bool{
+	"Config.version":              true,
+	"Config.programs":             true,
+	"Program.name":                true,
+	"Program.metrics":             true,
+	"Program.kprobes":             true,
+	"Program.kretprobes":          true,
+	"Program.code":                true,
+	"Metrics.counters":            true,
+	"Metrics.histograms":          true,
+	"Counter.name":                true,
+	"Counter.help":                true,
+	"Counter.table":               true,
+	"Counter.labels":              true,
+	"Histogram.name":              true,
+	"Histogram.help":              true,
+	"Histogram.table":             true,
+	"Histogram.bucket_type":       true,
+	"Histogram.bucket_multiplier": true,
+	"Histogram.bucket_min":        true,
+	"Histogram.bucket_max":        true,
+	"Histogram.labels":            true,
+	"Label.name":                  true,
+	"Label.decoders":              true,
+	"Decoder.name":                true,
+	"Decoder.static_map":          true,
+	"Decoder.regexps":             true,
+}
+
+// deprecatedFields are fields as <type>.<yaml key> that still work,
+// but are going away, with advice on what to use instead
+var deprecatedFields = map[string]string{}
+
+// CheckVersion checks raw config against the version it declares and returns
+// warnings about fields from newer versions, deprecated and unknown fields.
+// Configs without version are not checked for newer fields, since they
+// cannot be told apart from configs written before versions existed.
+func CheckVersion(data []byte) ([]string, error) {
+	declared := struct {
+		Version int `yaml:"version"`
+	}{}
+
+	err := yaml.Unmarshal(data, &declared)
+	if err != nil {
+		return nil, err
+	}
+
+	if declared.Version < 0 || declared.Version > CurrentVersion {
+		return nil, fmt.Errorf("config version %d is not supported, the latest supported version is %d", declared.Version, CurrentVersion)
+	}
+
+	raw := map[interface{}]interface{}{}
+
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings := []string{}
+
+	if declared.Version == 0 {
+		warnings = append(warnings, fmt.Sprintf("config has no version, set `version: %d` to get warnings about fields it does not have", CurrentVersion))
+	}
+
+	checkFields(reflect.TypeOf(Config{}), raw, "", func(path, field string, known bool) {
+		switch {
+		case !known:
+			warnings = append(warnings, fmt.Sprintf("unknown field %s is ignored", path))
+		case deprecatedFields[field] != "":
+			warnings = append(warnings, fmt.Sprintf("field %s is deprecated: %s", path, deprecatedFields[field]))
+		case declared.Version == 1 && !versionOneFields[field]:
+			warnings = append(warnings, fmt.Sprintf("field %s needs config version 2, but version 1 is declared", path))
+		}
+	})
+
+	return dedupe(warnings), nil
+}
+
+// checkFields walks raw config along the type and calls the check for every
+// field in it, fields of maps and custom unmarshalers are not walked into,
+// since their keys are data rather than fields of the schema
+func checkFields(t reflect.Type, raw interface{}, path string, check func(path, field string, known bool)) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if reflect.PtrTo(t).Implements(reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()) {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return
+		}
+
+		for _, item := range items {
+			checkFields(t.Elem(), item, path, check)
+		}
+	case reflect.Struct:
+		fields, ok := raw.(map[interface{}]interface{})
+		if !ok {
+			return
+		}
+
+		keys := []string{}
+		for key := range fields {
+			keys = append(keys, fmt.Sprintf("%v", key))
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+
+			field, ok := structField(t, key)
+			if !ok {
+				check(fieldPath, t.Name()+"."+key, false)
+				continue
+			}
+
+			check(fieldPath, t.Name()+"."+key, true)
+			checkFields(field.Type, fields[key], fieldPath, check)
+		}
+	}
+}
+
+// structField finds the field of the struct with the yaml key,
+// including fields of inlined structs
+func structField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+
+		if len(tag) > 1 && tag[1] == "inline" {
+			if inlined, ok := structField(field.Type, key); ok {
+				return inlined, true
+			}
+
+			continue
+		}
+
+		if tag[0] == key {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// dedupe removes repeated warnings, keeping the order
+func dedupe(warnings []string) []string {
+	unique := []string{}
+	seen := map[string]bool{}
+
+	for _, warning := range warnings {
+		if seen[warning] {
+			continue
+		}
+
+		seen[warning] = true
+		unique = append(unique, warning)
+	}
+
+	return unique
+}
@@ -0,0 +1,55 @@
+package decoder
+
+import "sync/atomic"
+
+// CacheStats is the number of hits and misses of a decoder cache
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// cacheCounter counts hits and misses of a decoder cache
+type cacheCounter struct {
+	hits   uint64
+	misses uint64
+}
+
+func (c *cacheCounter) hit() {
+	atomic.AddUint64(&c.hits, 1)
+}
+
+func (c *cacheCounter) miss() {
+	atomic.AddUint64(&c.misses, 1)
+}
+
+func (c *cacheCounter) cacheStats() CacheStats {
+	return CacheStats{Hits: atomic.LoadUint64(&c.hits), Misses: atomic.LoadUint64(&c.misses)}
+}
+
+// cachingDecoder is a decoder that caches results of expensive lookups
+type cachingDecoder interface {
+	cacheStats() CacheStats
+}
+
+// CacheStats returns cache hits and misses of caching decoders by their names,
+// hits and misses of the cache of results are added to the decoders they are for
+func (s *Set) CacheStats() map[string]CacheStats {
+	stats := map[string]CacheStats{}
+
+	for name, decoder := range s.decoders {
+		if caching, ok := decoder.(cachingDecoder); ok {
+			stats[name] = caching.cacheStats()
+		}
+	}
+
+	if s.results != nil {
+		for name, results := range s.results.cacheStats() {
+			stats[name] = CacheStats{
+				Hits:   stats[name].Hits + results.Hits,
+				Misses: stats[name].Misses + results.Misses,
+			}
+		}
+	}
+
+	return stats
+}
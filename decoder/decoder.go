@@ -3,46 +3,135 @@ package decoder
 import (
 	"errors"
 	"fmt"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
 )
 
 // ErrSkipLabelSet instructs exporter to skip label set
 var ErrSkipLabelSet = errors.New("this label set should be skipped")
 
-// Decoder transforms one string value into anoter string value
+// Decoder transforms one string value into anoter string value. Input is
+// either an element of the key as rendered by bcc, like "0x1" or "\"sda\"",
+// or the output of the previous decoder, config is the decoder definition
+// from the label. Returning ErrSkipLabelSet skips the whole table row.
 type Decoder interface {
-	Decode(string, config.Decoder) (string, error)
+	Decode(in string, conf config.Decoder) (string, error)
+}
+
+var (
+	registeredLock sync.Mutex
+	registered     = map[string]Decoder{}
+)
+
+// Register makes a custom decoder available under the name in every Set
+// created afterwards, the same decoder is shared by all programs. It panics
+// if the name is already taken, so it is meant to be called from init
+// function or main before creating exporter
+func Register(name string, decoder Decoder) {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	if decoder == nil {
+		panic(fmt.Sprintf("decoder %q is nil", name))
+	}
+
+	if _, ok := builtinDecoders(nil)[name]; ok {
+		panic(fmt.Sprintf("decoder %q is built in", name))
+	}
+
+	if _, ok := registered[name]; ok {
+		panic(fmt.Sprintf("decoder %q is already registered", name))
+	}
+
+	registered[name] = decoder
 }
 
 // Set is a set of decoders that may be applied to produce a label
 type Set struct {
-	decoders map[string]Decoder
+	decoders    map[string]Decoder
+	results     *resultCache
+	durations   map[string]*durationCounter
+	sampleEvery uint64
 }
 
-// NewSet creates a Set with all known decoders
-func NewSet() *Set {
-	return &Set{
-		decoders: map[string]Decoder{
-			"ksym":       &KSym{},
-			"regexp":     &Regexp{},
-			"static_map": &StaticMap{},
-			"string":     &String{},
-			"uint64":     &UInt64{},
-		},
+// NewSet creates a Set with all known decoders, module is used
+// by decoders that need to read additional tables of the program
+func NewSet(module *bcc.Module) *Set {
+	decoders := builtinDecoders(module)
+
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	for name, decoder := range registered {
+		decoders[name] = decoder
+	}
+
+	return &Set{decoders: decoders}
+}
+
+// CacheResults enables caching of up to size most recently decoded results
+// of cacheable decoders, size of zero or less keeps caching disabled
+func (s *Set) CacheResults(size int) {
+	if size <= 0 {
+		s.results = nil
+		return
+	}
+
+	s.results = newResultCache(size)
+}
+
+// builtinDecoders returns new instances of built in decoders
+func builtinDecoders(module *bcc.Module) map[string]Decoder {
+	return map[string]Decoder{
+		"file_map":     &FileMap{},
+		"inet_ip":      &InetIP{},
+		"kstack":       &KStack{stacks: stackReader{module: module}},
+		"ksym":         &KSym{},
+		"mntns":        &Namespace{kind: "mnt"},
+		"netns":        &Namespace{kind: "net"},
+		"offset_field": &OffsetField{},
+		"pidns":        &Namespace{kind: "pid"},
+		"port":         &Port{},
+		"regexp":       &Regexp{},
+		"static_map":   &StaticMap{},
+		"string":       &String{},
+		"template":     &Template{},
+		"uint64":       &UInt64{},
+		"ustack":       &UStack{stacks: stackReader{module: module}},
 	}
 }
 
 // Decode transforms input string according to label configuration
 func (s *Set) Decode(in string, label config.Label) (string, error) {
+	return s.decode(in, label, false)
+}
+
+// DecodeTrace is the same as Decode, but it logs input
+// and output of every decoder it applies along the way
+func (s *Set) DecodeTrace(in string, label config.Label) (string, error) {
+	return s.decode(in, label, true)
+}
+
+func (s *Set) decode(in string, label config.Label, trace bool) (string, error) {
 	result := in
 
-	for _, decoder := range label.Decoders {
+	for i := range label.Decoders {
+		decoder := &label.Decoders[i]
+
 		if _, ok := s.decoders[decoder.Name]; !ok {
 			return result, fmt.Errorf("unknown decoder %q", decoder.Name)
 		}
 
-		decoded, err := s.decoders[decoder.Name].Decode(result, decoder)
+		decoded, err := s.timedDecode(result, decoder)
+
+		if trace {
+			log.Printf("Trace: label %q decoder %q: %q -> %q (error: %v)", label.Name, decoder.Name, result, decoded, err)
+		}
+
 		if err != nil {
 			if err == ErrSkipLabelSet {
 				return decoded, err
@@ -55,3 +144,42 @@ func (s *Set) Decode(in string, label config.Label) (string, error) {
 
 	return result, nil
 }
+
+// timedDecode applies the decoder, timing the call if it is sampled
+func (s *Set) timedDecode(in string, conf *config.Decoder) (string, error) {
+	counter, ok := s.durations[conf.Name]
+	if !ok || !counter.sampled(s.sampleEvery) {
+		return s.decodeOne(in, conf)
+	}
+
+	start := time.Now()
+	result, err := s.decodeOne(in, conf)
+	counter.observe(time.Since(start))
+
+	return result, err
+}
+
+// decodeOne applies the decoder to the input, going through the cache
+// of results for cacheable decoders, only successful results are cached
+func (s *Set) decodeOne(in string, conf *config.Decoder) (string, error) {
+	decoder := s.decoders[conf.Name]
+
+	if _, ok := decoder.(Cacheable); !ok || s.results == nil {
+		return decoder.Decode(in, *conf)
+	}
+
+	key := s.results.key(in, conf)
+
+	if result, ok := s.results.get(key); ok {
+		return result, nil
+	}
+
+	result, err := decoder.Decode(in, *conf)
+	if err != nil || !cacheableResult(result) {
+		return result, err
+	}
+
+	s.results.add(key, result)
+
+	return result, nil
+}
@@ -0,0 +1,61 @@
+package decoder
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DurationStats is the number and total duration of sampled decoder calls
+type DurationStats struct {
+	Count uint64
+	Sum   time.Duration
+}
+
+// durationCounter samples durations of calls of a decoder
+type durationCounter struct {
+	calls uint64
+	count uint64
+	sum   uint64
+}
+
+// sampled returns whether the call should be timed, which is every nth
+// call of the decoder, so that busy decoders are not slowed down by timing
+func (d *durationCounter) sampled(every uint64) bool {
+	return atomic.AddUint64(&d.calls, 1)%every == 0
+}
+
+func (d *durationCounter) observe(duration time.Duration) {
+	atomic.AddUint64(&d.count, 1)
+	atomic.AddUint64(&d.sum, uint64(duration))
+}
+
+func (d *durationCounter) durationStats() DurationStats {
+	return DurationStats{Count: atomic.LoadUint64(&d.count), Sum: time.Duration(atomic.LoadUint64(&d.sum))}
+}
+
+// SampleDurations enables timing of every nth call of each decoder,
+// zero or less keeps timing disabled
+func (s *Set) SampleDurations(every int) {
+	if every <= 0 {
+		s.durations = nil
+		return
+	}
+
+	s.sampleEvery = uint64(every)
+	s.durations = map[string]*durationCounter{}
+
+	for name := range s.decoders {
+		s.durations[name] = &durationCounter{}
+	}
+}
+
+// DurationStats returns sampled durations of decoder calls by decoder names
+func (s *Set) DurationStats() map[string]DurationStats {
+	stats := map[string]DurationStats{}
+
+	for name, counter := range s.durations {
+		stats[name] = counter.durationStats()
+	}
+
+	return stats
+}
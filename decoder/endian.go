@@ -0,0 +1,17 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// nativeEndian is the byte order of the host, which is the byte order
+// of numbers in keys that bcc renders as hex numbers
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
@@ -0,0 +1,146 @@
+package decoder
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// fileMapCheckInterval is how often files are checked for changes,
+// so that decoding every label does not make a syscall
+const fileMapCheckInterval = time.Second
+
+// FileMap is a decoder that maps values according to a mapping loaded
+// from a file, which is reloaded when the file changes
+type FileMap struct {
+	lock  sync.Mutex
+	files map[string]*fileMapping
+}
+
+// fileMapping is a mapping loaded from a file
+type fileMapping struct {
+	modified time.Time
+	checked  time.Time
+	values   map[string]string
+}
+
+// Decode maps values according to the mapping from the file,
+// unknown values are returned unchanged
+func (f *FileMap) Decode(in string, conf config.Decoder) (string, error) {
+	if conf.File == "" {
+		return "", fmt.Errorf("no file set for file_map decoder")
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.files == nil {
+		f.files = map[string]*fileMapping{}
+	}
+
+	key := fmt.Sprintf("%s:%s:%s", conf.File, conf.KeyColumn, conf.ValueColumn)
+
+	mapping, ok := f.files[key]
+	if !ok || time.Since(mapping.checked) > fileMapCheckInterval {
+		reloaded, err := reloadFileMapping(mapping, conf)
+		if err != nil {
+			if !ok {
+				return "", err
+			}
+
+			// Keep using the last good mapping while the file is being fixed
+			log.Printf("Error reloading mapping from %s, keeping the previous one: %s", conf.File, err)
+			mapping.checked = time.Now()
+		} else {
+			mapping = reloaded
+			f.files[key] = mapping
+		}
+	}
+
+	value, ok := mapping.values[in]
+	if !ok {
+		return in, nil
+	}
+
+	return value, nil
+}
+
+// reloadFileMapping loads the mapping from the file if it changed since
+// the previous mapping was loaded, which is nil on the first load
+func reloadFileMapping(previous *fileMapping, conf config.Decoder) (*fileMapping, error) {
+	info, err := os.Stat(conf.File)
+	if err != nil {
+		return nil, err
+	}
+
+	if previous != nil && info.ModTime().Equal(previous.modified) {
+		previous.checked = time.Now()
+		return previous, nil
+	}
+
+	values, err := readFileMapping(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileMapping{modified: info.ModTime(), checked: time.Now(), values: values}, nil
+}
+
+// readFileMapping reads a json object or a csv file with a header,
+// taking keys and values from the configured columns
+func readFileMapping(conf config.Decoder) (map[string]string, error) {
+	file, err := os.Open(conf.File)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	values := map[string]string{}
+
+	if filepath.Ext(conf.File) == ".json" {
+		err = json.NewDecoder(file).Decode(&values)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing json object of strings: %s", err)
+		}
+
+		return values, nil
+	}
+
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing csv: %s", err)
+	}
+
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no header in csv")
+	}
+
+	keyColumn, valueColumn := -1, -1
+
+	for i, name := range records[0] {
+		switch name {
+		case conf.KeyColumn:
+			keyColumn = i
+		case conf.ValueColumn:
+			valueColumn = i
+		}
+	}
+
+	if keyColumn == -1 || valueColumn == -1 {
+		return nil, fmt.Errorf("columns %q and %q are not both in csv header %q", conf.KeyColumn, conf.ValueColumn, records[0])
+	}
+
+	for _, record := range records[1:] {
+		values[record[keyColumn]] = record[valueColumn]
+	}
+
+	return values, nil
+}
@@ -0,0 +1,60 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// InetIP is a decoder that transforms IPv4 or IPv6 addresses into text form
+type InetIP struct{}
+
+// Decode transforms IPv4 address stored as a number or IPv4 and IPv6
+// addresses stored as byte arrays into text form, honoring byte order
+func (i *InetIP) Decode(in string, conf config.Decoder) (string, error) {
+	ip := []byte{}
+
+	if strings.HasPrefix(in, "[") {
+		for _, element := range strings.Fields(strings.Trim(in, "[ ]")) {
+			value, err := strconv.ParseUint(element, 0, 8)
+			if err != nil {
+				return "", fmt.Errorf("error parsing address byte %q: %s", element, err)
+			}
+
+			ip = append(ip, byte(value))
+		}
+	} else {
+		num, err := strconv.ParseUint(in, 0, 32)
+		if err != nil {
+			return "", err
+		}
+
+		// Numbers are rendered from host byte order, this restores
+		// bytes of the address as they are in memory
+		ip = make([]byte, 4)
+		nativeEndian.PutUint32(ip, uint32(num))
+	}
+
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return "", fmt.Errorf("address has %d bytes, expected %d or %d", len(ip), net.IPv4len, net.IPv6len)
+	}
+
+	switch conf.ByteOrder {
+	case "", config.ByteOrderNetwork:
+	case config.ByteOrderHost:
+		// Big endian hosts keep addresses in host order the same way
+		if nativeEndian == binary.LittleEndian {
+			for l, r := 0, len(ip)-1; l < r; l, r = l+1, r-1 {
+				ip[l], ip[r] = ip[r], ip[l]
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown byte order %q", conf.ByteOrder)
+	}
+
+	return net.IP(ip).String(), nil
+}
@@ -0,0 +1,38 @@
+package decoder
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+func TestInetIPByteOrder(t *testing.T) {
+	// The same address stored in network byte order is rendered
+	// by bcc as a different number depending on the host
+	network := fmt.Sprintf("0x%x", nativeEndian.Uint32([]byte{127, 0, 0, 1}))
+
+	cases := []struct {
+		in        string
+		byteOrder string
+		out       string
+	}{
+		{in: "0x7f000001", byteOrder: config.ByteOrderHost, out: "127.0.0.1"},
+		{in: network, byteOrder: config.ByteOrderNetwork, out: "127.0.0.1"},
+		{in: network, byteOrder: "", out: "127.0.0.1"},
+		{in: "[ 0x7f 0x0 0x0 0x1 ]", byteOrder: config.ByteOrderNetwork, out: "127.0.0.1"},
+		{in: "[ 0x20 0x1 0xd 0xb8 0x0 0x0 0x0 0x0 0x0 0x0 0x0 0x0 0x0 0x0 0x0 0x1 ]", byteOrder: config.ByteOrderNetwork, out: "2001:db8::1"},
+	}
+
+	for _, c := range cases {
+		out, err := (&InetIP{}).Decode(c.in, config.Decoder{ByteOrder: c.byteOrder})
+		if err != nil {
+			t.Errorf("Error decoding %q in %q byte order: %s", c.in, c.byteOrder, err)
+			continue
+		}
+
+		if out != c.out {
+			t.Errorf("Expected %q for %q in %q byte order, got %q", c.out, c.in, c.byteOrder, out)
+		}
+	}
+}
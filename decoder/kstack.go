@@ -0,0 +1,36 @@
+package decoder
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// KStack is a decoder that transforms kernel stack id into a folded stack
+type KStack struct {
+	lock   sync.Mutex
+	stacks stackReader
+	ksyms  ksymTable
+}
+
+// Decode transforms kernel stack id into a folded stack with frames
+// separated by semicolons, outermost frame goes first
+func (k *KStack) Decode(in string, conf config.Decoder) (string, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	addrs, unknown, err := k.stacks.read(in, conf)
+	if err != nil || unknown != "" {
+		return unknown, err
+	}
+
+	if k.ksyms == nil {
+		k.ksyms, err = loadKsymTable()
+		if err != nil {
+			return "", fmt.Errorf("error loading kernel symbols: %s", err)
+		}
+	}
+
+	return foldStack(addrs, k.ksyms.lookup), nil
+}
@@ -3,17 +3,23 @@ package decoder
 import (
 	"fmt"
 	"strconv"
+	"sync"
 
 	"github.com/cloudflare/ebpf_exporter/config"
 )
 
 // KSym is a decoder that transforms kernel address to a function name
 type KSym struct {
+	cacheCounter
+	lock  sync.Mutex
 	cache map[string]string
 }
 
 // Decode transforms kernel address to a function name
 func (k *KSym) Decode(in string, conf config.Decoder) (string, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
 	if k.cache == nil {
 		k.cache = map[string]string{}
 	}
@@ -25,14 +31,19 @@ func (k *KSym) Decode(in string, conf config.Decoder) (string, error) {
 
 	in = fmt.Sprintf("%x", num)
 
-	if _, ok := k.cache[in]; !ok {
-		name, err := Ksym(in)
-		if err != nil {
-			return fmt.Sprintf("unknown:%s", in), nil
-		}
+	if name, ok := k.cache[in]; ok {
+		k.hit()
+		return name, nil
+	}
+
+	k.miss()
 
-		k.cache[in] = name
+	name, err := Ksym(in)
+	if err != nil {
+		return fmt.Sprintf("unknown:%s", in), nil
 	}
 
-	return k.cache[in], nil
+	k.cache[in] = name
+
+	return name, nil
 }
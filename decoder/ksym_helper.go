@@ -3,9 +3,12 @@ package decoder
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -54,3 +57,66 @@ func ksym(addr string, r io.Reader) string {
 
 	return ""
 }
+
+// ksymEntry is a kernel symbol with its starting address
+type ksymEntry struct {
+	addr uint64
+	name string
+}
+
+// ksymTable is a list of kernel symbols sorted by address
+type ksymTable []ksymEntry
+
+// loadKsymTable reads all kernel symbols from `/proc/kallsyms`
+func loadKsymTable() (ksymTable, error) {
+	fd, err := os.Open(kallsyms)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err = fd.Close(); err != nil {
+			log.Printf("Error closing %s: %s", kallsyms, err)
+		}
+	}()
+
+	table := ksymTable{}
+
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		ar := strings.Fields(s.Text())
+		if len(ar) < 3 {
+			continue
+		}
+
+		addr, err := strconv.ParseUint(ar[0], 16, 64)
+		if err != nil || addr == 0 {
+			continue
+		}
+
+		table = append(table, ksymEntry{addr: addr, name: ar[2]})
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].addr < table[j].addr
+	})
+
+	return table, nil
+}
+
+// lookup finds the name of the kernel function that contains the address
+func (t ksymTable) lookup(addr uint64) string {
+	i := sort.Search(len(t), func(i int) bool {
+		return t[i].addr > addr
+	})
+
+	if i == 0 {
+		return fmt.Sprintf("unknown:%x", addr)
+	}
+
+	return t[i-1].name
+}
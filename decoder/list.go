@@ -0,0 +1,65 @@
+package decoder
+
+import "sort"
+
+// Description describes a decoder with options from decoder config it uses
+type Description struct {
+	Name    string
+	Help    string
+	Options []string
+}
+
+// Describer can be implemented by registered decoders to show up
+// in the list of decoders with a description and options
+type Describer interface {
+	Describe() (help string, options []string)
+}
+
+// builtinDescriptions are descriptions of built in decoders
+var builtinDescriptions = map[string]Description{
+	"file_map":     {Help: "Maps values with a mapping loaded from a json or csv file", Options: []string{"file", "key_column", "value_column"}},
+	"inet_ip":      {Help: "Transforms IPv4 and IPv6 addresses into text form", Options: []string{"byte_order"}},
+	"kstack":       {Help: "Transforms kernel stack id into a folded stack", Options: []string{"stack_table"}},
+	"ksym":         {Help: "Transforms kernel address into a function name"},
+	"mntns":        {Help: "Transforms mount namespace inode number into cgroup path of a process in it"},
+	"netns":        {Help: "Transforms network namespace inode number into cgroup path of a process in it"},
+	"offset_field": {Help: "Reads an integer field at an offset out of byte array keys", Options: []string{"field", "byte_order"}},
+	"pidns":        {Help: "Transforms pid namespace inode number into cgroup path of a process in it"},
+	"port":         {Help: "Transforms port numbers in network byte order into numbers or service names", Options: []string{"byte_order", "resolve"}},
+	"regexp":       {Help: "Only allows inputs matching any of regexps, other rows are skipped", Options: []string{"regexps"}},
+	"static_map":   {Help: "Maps values with a static mapping", Options: []string{"static_map"}},
+	"string":       {Help: "Transforms strings from the kernel into plain strings"},
+	"template":     {Help: "Renders inputs with go text/template", Options: []string{"template"}},
+	"uint64":       {Help: "Transforms hex numbers into regular numbers"},
+	"ustack":       {Help: "Transforms user stack id into a folded stack of the binary", Options: []string{"stack_table", "binary"}},
+}
+
+// List returns descriptions of built in and registered decoders sorted by name
+func List() []Description {
+	descriptions := []Description{}
+
+	for name := range builtinDecoders(nil) {
+		description := builtinDescriptions[name]
+		description.Name = name
+		descriptions = append(descriptions, description)
+	}
+
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+
+	for name, decoder := range registered {
+		description := Description{Name: name, Help: "Custom decoder"}
+
+		if describer, ok := decoder.(Describer); ok {
+			description.Help, description.Options = describer.Describe()
+		}
+
+		descriptions = append(descriptions, description)
+	}
+
+	sort.Slice(descriptions, func(i, j int) bool {
+		return descriptions[i].Name < descriptions[j].Name
+	})
+
+	return descriptions
+}
@@ -0,0 +1,137 @@
+package decoder
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// Cacheable is implemented by decoders that always decode the same input
+// with the same config into the same output, so that their results can be
+// kept in the cache of the Set. Decoders with results that change over time,
+// like lookups of running processes or of reusable stack ids, must not
+// implement it.
+type Cacheable interface {
+	Cacheable()
+}
+
+// Cacheable marks template decoder as cacheable
+func (t *Template) Cacheable() {}
+
+// Cacheable marks regexp decoder as cacheable
+func (r *Regexp) Cacheable() {}
+
+// Cacheable marks inet_ip decoder as cacheable
+func (i *InetIP) Cacheable() {}
+
+// Cacheable marks ksym decoder as cacheable, kernel symbols
+// do not move while the kernel is running
+func (k *KSym) Cacheable() {}
+
+// Cacheable marks kstack decoder as cacheable, stack ids are hashes of
+// stacks, so an id only points to another stack after a hash collision
+func (k *KStack) Cacheable() {}
+
+// resultKey identifies a decoded result by decoder and input, the config
+// of the decoder is identified by its address in the label, which stays
+// the same for every decode of the label and is cheap to compare
+type resultKey struct {
+	name string
+	conf *config.Decoder
+	in   string
+}
+
+type resultEntry struct {
+	key    resultKey
+	result string
+}
+
+// resultCache is a least recently used cache of decoded results
+type resultCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List
+	entries map[resultKey]*list.Element
+	stats   map[string]*cacheCounter
+}
+
+func newResultCache(size int) *resultCache {
+	return &resultCache{
+		size:    size,
+		order:   list.New(),
+		entries: map[resultKey]*list.Element{},
+		stats:   map[string]*cacheCounter{},
+	}
+}
+
+// key returns the key for the input of the decoder with the config
+func (c *resultCache) key(in string, conf *config.Decoder) resultKey {
+	return resultKey{name: conf.Name, conf: conf, in: in}
+}
+
+// cacheableResult returns whether the result can be cached, failed lookups
+// rendered as "unknown:<input>" may succeed later, so they are not cached
+func cacheableResult(result string) bool {
+	return !strings.HasPrefix(result, "unknown:")
+}
+
+// counter returns hit and miss counter of the decoder
+func (c *resultCache) counter(name string) *cacheCounter {
+	counter, ok := c.stats[name]
+	if !ok {
+		counter = &cacheCounter{}
+		c.stats[name] = counter
+	}
+
+	return counter
+}
+
+func (c *resultCache) get(key resultKey) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.counter(key.name).miss()
+		return "", false
+	}
+
+	c.counter(key.name).hit()
+	c.order.MoveToFront(element)
+
+	return element.Value.(*resultEntry).result, true
+}
+
+func (c *resultCache) add(key resultKey, result string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*resultEntry).result = result
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&resultEntry{key: key, result: result})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*resultEntry).key)
+	}
+}
+
+// cacheStats returns hits and misses of the cache by decoder names
+func (c *resultCache) cacheStats() map[string]CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := map[string]CacheStats{}
+	for name, counter := range c.stats {
+		stats[name] = counter.cacheStats()
+	}
+
+	return stats
+}
@@ -0,0 +1,60 @@
+package decoder
+
+import (
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// countingDecoder is a cacheable decoder that counts its calls
+type countingDecoder struct {
+	calls  int
+	result string
+}
+
+func (c *countingDecoder) Decode(in string, conf config.Decoder) (string, error) {
+	c.calls++
+	return c.result + in, nil
+}
+
+func (c *countingDecoder) Cacheable() {}
+
+func TestResultCache(t *testing.T) {
+	counting := &countingDecoder{}
+
+	s := &Set{decoders: map[string]Decoder{"counting": counting}}
+	s.CacheResults(10)
+
+	label := config.Label{Name: "label", Decoders: []config.Decoder{{Name: "counting"}}}
+	other := config.Label{Name: "other", Decoders: []config.Decoder{{Name: "counting"}}}
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.Decode("1", label); err != nil {
+			t.Fatalf("Error decoding: %s", err)
+		}
+	}
+
+	if counting.calls != 1 {
+		t.Errorf("Expected repeated input of the label to be decoded once, got %d calls", counting.calls)
+	}
+
+	if _, err := s.Decode("1", other); err != nil {
+		t.Fatalf("Error decoding: %s", err)
+	}
+
+	if counting.calls != 2 {
+		t.Errorf("Expected the same input of another label to be decoded again, got %d calls", counting.calls)
+	}
+
+	counting.result = "unknown:"
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.Decode("2", label); err != nil {
+			t.Fatalf("Error decoding: %s", err)
+		}
+	}
+
+	if counting.calls != 4 {
+		t.Errorf("Expected failed lookups not to be cached, got %d calls", counting.calls)
+	}
+}
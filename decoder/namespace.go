@@ -0,0 +1,137 @@
+package decoder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// Namespace is a decoder that transforms namespace inode number into
+// cgroup path of a process in the namespace, which identifies the container
+type Namespace struct {
+	cacheCounter
+	lock  sync.Mutex
+	kind  string
+	cache map[uint64]string
+}
+
+// Decode transforms namespace inode number into cgroup path, if there is
+// no process in the namespace, inode number is returned unchanged
+func (n *Namespace) Decode(in string, conf config.Decoder) (string, error) {
+	inode, err := strconv.ParseUint(in, 0, 64)
+	if err != nil {
+		return "", err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.cache == nil {
+		n.cache = map[uint64]string{}
+	}
+
+	if name, ok := n.cache[inode]; ok {
+		n.hit()
+		return name, nil
+	}
+
+	n.miss()
+
+	// New containers appear all the time, so all processes are scanned again
+	paths, err := namespaceCgroups(n.kind)
+	if err != nil {
+		return "", err
+	}
+
+	for scanned, path := range paths {
+		n.cache[scanned] = path
+	}
+
+	if _, ok := n.cache[inode]; !ok {
+		n.cache[inode] = fmt.Sprintf("%d", inode)
+	}
+
+	return n.cache[inode], nil
+}
+
+// namespaceCgroups maps inode numbers of namespaces of the kind
+// to cgroup paths of processes in them
+func namespaceCgroups(kind string) (map[uint64]string, error) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	paths := map[uint64]string{}
+
+	for _, dir := range dirs {
+		_, err = strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+
+		// Process may have exited while we were looking
+		link, err := os.Readlink(filepath.Join("/proc", dir.Name(), "ns", kind))
+		if err != nil {
+			continue
+		}
+
+		inode, err := parseNamespaceLink(link)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := paths[inode]; ok {
+			continue
+		}
+
+		path, err := procCgroup(filepath.Join("/proc", dir.Name(), "cgroup"))
+		if err != nil {
+			continue
+		}
+
+		paths[inode] = path
+	}
+
+	return paths, nil
+}
+
+// parseNamespaceLink parses inode number from namespace link like "net:[4026531992]"
+func parseNamespaceLink(link string) (uint64, error) {
+	start := strings.Index(link, "[")
+	if start == -1 || !strings.HasSuffix(link, "]") {
+		return 0, fmt.Errorf("unexpected namespace link %q", link)
+	}
+
+	return strconv.ParseUint(link[start+1:len(link)-1], 10, 64)
+}
+
+// procCgroup reads cgroup path of a process from `/proc/<pid>/cgroup`,
+// preferring the unified hierarchy if it is present
+func procCgroup(path string) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "0::") {
+			return strings.TrimPrefix(line, "0::"), nil
+		}
+	}
+
+	parts := strings.SplitN(lines[0], ":", 3)
+	if len(parts) != 3 {
+		return "", fmt.Errorf("unexpected cgroup line %q", lines[0])
+	}
+
+	return parts[2], nil
+}
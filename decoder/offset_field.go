@@ -0,0 +1,94 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// OffsetField is a decoder that reads an integer field at an offset
+// out of keys rendered by bcc as byte arrays, like packed structs
+type OffsetField struct{}
+
+// Decode reads the integer field out of the byte array or out of the bytes
+// of an integer in host byte order and renders it as hex number the way
+// bcc renders integer keys, so that other decoders can be applied to it
+func (o *OffsetField) Decode(in string, conf config.Decoder) (string, error) {
+	if conf.Field == nil {
+		return "", errors.New("no field defined in config")
+	}
+
+	var size int
+
+	switch conf.Field.Type {
+	case config.ValueTypeU8:
+		size = 1
+	case config.ValueTypeU16:
+		size = 2
+	case config.ValueTypeU32:
+		size = 4
+	case config.ValueTypeU64:
+		size = 8
+	default:
+		return "", fmt.Errorf("unknown field type %q", conf.Field.Type)
+	}
+
+	buf := []byte{}
+
+	if strings.HasPrefix(in, "[") {
+		for _, element := range strings.Fields(strings.Trim(in, "[ ]")) {
+			value, err := strconv.ParseUint(element, 0, 8)
+			if err != nil {
+				return "", fmt.Errorf("error parsing key byte %q: %s", element, err)
+			}
+
+			buf = append(buf, byte(value))
+		}
+	} else {
+		num, err := strconv.ParseUint(in, 0, 64)
+		if err != nil {
+			return "", err
+		}
+
+		// Numbers are rendered from host byte order, this restores bytes
+		// as they are in memory of a 64 bit integer
+		buf = make([]byte, 8)
+		nativeEndian.PutUint64(buf, num)
+	}
+
+	offset := conf.Field.Offset
+	if offset < 0 || offset+size > len(buf) {
+		return "", fmt.Errorf("%s at offset %d is out of %d bytes of key", conf.Field.Type, offset, len(buf))
+	}
+
+	var order binary.ByteOrder
+
+	switch conf.ByteOrder {
+	case "", config.ByteOrderHost:
+		order = nativeEndian
+	case config.ByteOrderNetwork:
+		order = binary.BigEndian
+	default:
+		return "", fmt.Errorf("unknown byte order %q", conf.ByteOrder)
+	}
+
+	return fmt.Sprintf("0x%x", readUint(buf[offset:offset+size], order)), nil
+}
+
+// readUint reads an unsigned integer of 1, 2, 4 or 8 bytes in the byte order
+func readUint(b []byte, order binary.ByteOrder) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(order.Uint16(b))
+	case 4:
+		return uint64(order.Uint32(b))
+	default:
+		return order.Uint64(b)
+	}
+}
@@ -0,0 +1,72 @@
+package decoder
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+func TestOffsetField(t *testing.T) {
+	// Bytes of integers in host byte order, as they are in memory
+	u16 := make([]byte, 2)
+	nativeEndian.PutUint16(u16, 0x1234)
+
+	u64 := make([]byte, 8)
+	nativeEndian.PutUint64(u64, 0x1122334455667788)
+
+	cases := []struct {
+		in       string
+		field    config.ValueDecoder
+		order    string
+		expected string
+	}{
+		{
+			in:       "[ 0x1 0x2 0x3 0x4 ]",
+			field:    config.ValueDecoder{Type: config.ValueTypeU8, Offset: 2},
+			expected: "0x3",
+		},
+		{
+			in:       fmt.Sprintf("[ 0x0 0x%x 0x%x ]", u16[0], u16[1]),
+			field:    config.ValueDecoder{Type: config.ValueTypeU16, Offset: 1},
+			expected: "0x1234",
+		},
+		{
+			in:       "[ 0x0 0x1f 0x90 ]",
+			field:    config.ValueDecoder{Type: config.ValueTypeU16, Offset: 1},
+			order:    config.ByteOrderNetwork,
+			expected: "0x1f90",
+		},
+		{
+			in:       "0x1122334455667788",
+			field:    config.ValueDecoder{Type: config.ValueTypeU64, Offset: 0},
+			expected: "0x1122334455667788",
+		},
+		{
+			in:       "0x1122334455667788",
+			field:    config.ValueDecoder{Type: config.ValueTypeU8, Offset: 0},
+			expected: fmt.Sprintf("0x%x", u64[0]),
+		},
+	}
+
+	for _, c := range cases {
+		field := c.field
+
+		out, err := (&OffsetField{}).Decode(c.in, config.Decoder{Field: &field, ByteOrder: c.order})
+		if err != nil {
+			t.Errorf("Error decoding %s of %q: %s", c.field.Type, c.in, err)
+			continue
+		}
+
+		if out != c.expected {
+			t.Errorf("Expected %q for %s at offset %d of %q, got %q", c.expected, c.field.Type, c.field.Offset, c.in, out)
+		}
+	}
+
+	field := config.ValueDecoder{Type: config.ValueTypeU32, Offset: 2}
+
+	_, err := (&OffsetField{}).Decode("[ 0x1 0x2 0x3 0x4 ]", config.Decoder{Field: &field})
+	if err == nil {
+		t.Errorf("Expected field out of key bytes to be rejected")
+	}
+}
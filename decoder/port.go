@@ -0,0 +1,97 @@
+package decoder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// servicesPath is the file with names of well-known ports
+const servicesPath = "/etc/services"
+
+// Port is a decoder that transforms 16 bit port numbers stored in network
+// byte order, like __be16 ports of sockets, into port numbers or services
+type Port struct {
+	once     sync.Once
+	path     string
+	services map[uint16]string
+}
+
+// Decode transforms port number into text form, honoring byte order,
+// and into service name from /etc/services if resolving is enabled
+func (p *Port) Decode(in string, conf config.Decoder) (string, error) {
+	num, err := strconv.ParseUint(in, 0, 16)
+	if err != nil {
+		return "", err
+	}
+
+	port := uint16(num)
+
+	// Numbers are rendered from host byte order, so network order
+	// needs bytes restored as they are in memory and read again
+	switch conf.ByteOrder {
+	case "", config.ByteOrderNetwork:
+		buf := make([]byte, 2)
+		nativeEndian.PutUint16(buf, port)
+		port = binary.BigEndian.Uint16(buf)
+	case config.ByteOrderHost:
+	default:
+		return "", fmt.Errorf("unknown byte order %q", conf.ByteOrder)
+	}
+
+	if conf.Resolve {
+		p.once.Do(func() {
+			path := p.path
+			if path == "" {
+				path = servicesPath
+			}
+
+			p.services = readServices(path)
+		})
+
+		if service, ok := p.services[port]; ok {
+			return service, nil
+		}
+	}
+
+	return strconv.Itoa(int(port)), nil
+}
+
+// readServices reads names of ports from services file, taking the first
+// name for every port, missing or unreadable file means no names
+func readServices(path string) map[uint16]string {
+	services := map[uint16]string{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return services
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines look like "http 80/tcp www # WorldWideWeb HTTP"
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) < 2 {
+			continue
+		}
+
+		num, err := strconv.ParseUint(strings.SplitN(fields[1], "/", 2)[0], 10, 16)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := services[uint16(num)]; !ok {
+			services[uint16(num)] = fields[0]
+		}
+	}
+
+	return services
+}
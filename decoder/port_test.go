@@ -0,0 +1,95 @@
+package decoder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+func TestPortByteOrder(t *testing.T) {
+	// Port 80 in network byte order is rendered by bcc as 0x5000
+	// on little endian hosts and as 0x50 on big endian ones
+	network := fmt.Sprintf("0x%x", nativeEndian.Uint16([]byte{0, 80}))
+
+	cases := []struct {
+		in        string
+		byteOrder string
+		out       string
+	}{
+		{in: network, byteOrder: "", out: "80"},
+		{in: network, byteOrder: config.ByteOrderNetwork, out: "80"},
+		{in: "0x50", byteOrder: config.ByteOrderHost, out: "80"},
+		{in: "0x1f90", byteOrder: config.ByteOrderHost, out: "8080"},
+	}
+
+	for _, c := range cases {
+		out, err := (&Port{}).Decode(c.in, config.Decoder{ByteOrder: c.byteOrder})
+		if err != nil {
+			t.Errorf("Error decoding %q in %q byte order: %s", c.in, c.byteOrder, err)
+			continue
+		}
+
+		if out != c.out {
+			t.Errorf("Expected %q for %q in %q byte order, got %q", c.out, c.in, c.byteOrder, out)
+		}
+	}
+
+	if nativeEndian.Uint16([]byte{0, 80}) == 0x5000 {
+		out, err := (&Port{}).Decode("0x5000", config.Decoder{ByteOrder: config.ByteOrderNetwork})
+		if err != nil || out != "80" {
+			t.Errorf("Expected 0x5000 in network byte order to be 80, got %q (%v)", out, err)
+		}
+	}
+}
+
+func TestPortResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "port")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %s", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "services")
+
+	services := "# Network services\n" +
+		"http\t\t80/tcp\t\twww\t\t# WorldWideWeb HTTP\n" +
+		"http\t\t80/udp\n" +
+		"not-a-port\tfoo/tcp\n" +
+		"\n" +
+		"https\t\t443/tcp\n"
+
+	err = ioutil.WriteFile(path, []byte(services), 0644)
+	if err != nil {
+		t.Fatalf("Error writing services file: %s", err)
+	}
+
+	port := &Port{path: path}
+
+	cases := map[string]string{
+		"0x50":   "http",
+		"0x1bb":  "https",
+		"0x1f90": "8080",
+	}
+
+	for in, expected := range cases {
+		out, err := port.Decode(in, config.Decoder{ByteOrder: config.ByteOrderHost, Resolve: true})
+		if err != nil {
+			t.Errorf("Error decoding %q: %s", in, err)
+			continue
+		}
+
+		if out != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, in, out)
+		}
+	}
+
+	out, err := (&Port{path: filepath.Join(dir, "missing")}).Decode("0x50", config.Decoder{ByteOrder: config.ByteOrderHost, Resolve: true})
+	if err != nil || out != "80" {
+		t.Errorf("Expected number for missing services file, got %q (%v)", out, err)
+	}
+}
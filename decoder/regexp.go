@@ -4,12 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sync"
 
 	"github.com/cloudflare/ebpf_exporter/config"
 )
 
 // Regexp is a decoder that only allows inputs matching regexp
 type Regexp struct {
+	lock  sync.Mutex
 	cache map[string]*regexp.Regexp
 }
 
@@ -19,6 +21,9 @@ func (r *Regexp) Decode(in string, conf config.Decoder) (string, error) {
 		return "", errors.New("no regexps defined in config")
 	}
 
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
 	if r.cache == nil {
 		r.cache = map[string]*regexp.Regexp{}
 	}
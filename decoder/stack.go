@@ -0,0 +1,97 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// stackReader reads stack traces from BPF_STACK_TRACE maps of a module
+type stackReader struct {
+	module *bcc.Module
+	tables map[string]*bcc.Table
+}
+
+// read returns addresses of the stack with the given stack id, innermost
+// frame goes first; unknown is set if the stack id cannot be resolved
+func (s *stackReader) read(in string, conf config.Decoder) (addrs []uint64, unknown string, err error) {
+	if conf.StackTable == "" {
+		return nil, "", errors.New("no stack_table defined in config")
+	}
+
+	if s.module == nil {
+		return nil, "", errors.New("no module to read stack table from")
+	}
+
+	id, err := strconv.ParseInt(in, 0, 64)
+	if err != nil {
+		return nil, fmt.Sprintf("invalid:%s", in), err
+	}
+
+	// Negative stack ids are errors returned by bpf_get_stackid()
+	if id < 0 {
+		return nil, fmt.Sprintf("unknown:%d", id), nil
+	}
+
+	if s.tables == nil {
+		s.tables = map[string]*bcc.Table{}
+	}
+
+	if _, ok := s.tables[conf.StackTable]; !ok {
+		s.tables[conf.StackTable] = bcc.NewTable(s.module.TableId(conf.StackTable), s.module)
+	}
+
+	leaf, ok := s.tables[conf.StackTable].Get(fmt.Sprintf("0x%x", id))
+	if !ok {
+		return nil, fmt.Sprintf("unknown:%d", id), nil
+	}
+
+	addrs, err = parseStack(fmt.Sprintf("%s", leaf))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return addrs, "", nil
+}
+
+// parseStack extracts non-zero addresses from stack trace map value
+// that looks like `{ [ 0xffffffff81000000 0xffffffff81000001 0x0 ] }`
+func parseStack(in string) ([]uint64, error) {
+	addrs := []uint64{}
+
+	elements := strings.FieldsFunc(in, func(r rune) bool {
+		return r == ' ' || r == '{' || r == '}' || r == '[' || r == ']'
+	})
+
+	for _, element := range elements {
+		addr, err := strconv.ParseUint(element, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing stack frame %q: %s", element, err)
+		}
+
+		// Stack trace is padded with zero addresses
+		if addr == 0 {
+			break
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs, nil
+}
+
+// foldStack symbolizes addresses and joins them with semicolons,
+// turning innermost-first stack into outermost-first folded stack
+func foldStack(addrs []uint64, symbolize func(addr uint64) string) string {
+	frames := make([]string, 0, len(addrs))
+
+	for i := len(addrs) - 1; i >= 0; i-- {
+		frames = append(frames, symbolize(addrs[i]))
+	}
+
+	return strings.Join(frames, ";")
+}
@@ -1,7 +1,10 @@
 package decoder
 
 import (
+	"fmt"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/cloudflare/ebpf_exporter/config"
 )
@@ -9,7 +12,45 @@ import (
 // String is a decoded that decodes strings coming from the kernel
 type String struct{}
 
-// Decode transforms strings coming from the kernel
+// Decode transforms strings coming from the kernel, which bcc renders either
+// quoted for char arrays or as byte arrays like "[ 0x73 0x64 0x61 0x0 ]"
+// for unsigned ones, in which case bytes are reassembled up to the first NUL
 func (s *String) Decode(in string, conf config.Decoder) (string, error) {
-	return strings.Trim(in, "\""), nil
+	if !strings.HasPrefix(in, "[") {
+		return sanitizeUTF8(strings.Trim(in, "\"")), nil
+	}
+
+	buf := []byte{}
+
+	for _, element := range strings.Fields(strings.Trim(in, "[ ]")) {
+		value, err := strconv.ParseUint(element, 0, 8)
+		if err != nil {
+			return "", fmt.Errorf("error parsing string byte %q: %s", element, err)
+		}
+
+		if value == 0 {
+			break
+		}
+
+		buf = append(buf, byte(value))
+	}
+
+	return sanitizeUTF8(string(buf)), nil
+}
+
+// sanitizeUTF8 replaces invalid UTF-8 sequences, which prometheus
+// does not accept in label values, with the replacement character
+func sanitizeUTF8(in string) string {
+	if utf8.ValidString(in) {
+		return in
+	}
+
+	out := strings.Builder{}
+
+	// Ranging over invalid bytes yields the replacement character for each
+	for _, r := range in {
+		out.WriteRune(r)
+	}
+
+	return out.String()
 }
@@ -0,0 +1,32 @@
+package decoder
+
+import (
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+func TestStringDecode(t *testing.T) {
+	cases := map[string]string{
+		`"sda"`:                       "sda",
+		`"kworker/0:1"`:               "kworker/0:1",
+		"[ 0x73 0x64 0x61 0x0 0x0 ]":  "sda",
+		"[ 0x73 0x64 0x0 0x61 ]":      "sd",
+		"[ 0x0 0x73 ]":                "",
+		"[ 0x73 0xc3 0x28 0x0 ]":      "s�(",
+		"\"s\xc3\x28\"":               "s�(",
+		"[ 0x66 0xc3 0xa9 0x65 0x0 ]": "fée",
+	}
+
+	for in, expected := range cases {
+		out, err := (&String{}).Decode(in, config.Decoder{})
+		if err != nil {
+			t.Errorf("Error decoding %q: %s", in, err)
+			continue
+		}
+
+		if out != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, in, out)
+		}
+	}
+}
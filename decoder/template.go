@@ -0,0 +1,100 @@
+package decoder
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// templateFuncs are the only functions available to templates in addition
+// to text/template builtins, none of them have side effects
+var templateFuncs = template.FuncMap{
+	"uint": func(in string) (uint64, error) {
+		return strconv.ParseUint(in, 0, 64)
+	},
+	"int": func(in string) (int64, error) {
+		return strconv.ParseInt(in, 0, 64)
+	},
+	"hex": func(in uint64) string {
+		return fmt.Sprintf("0x%x", in)
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim": func(in string) string {
+		return strings.Trim(in, "\" ")
+	},
+	"join": strings.Join,
+}
+
+// templateData is what templates are executed with
+type templateData struct {
+	// Input is the decoder input as is
+	Input string
+	// Fields are elements of the input split on whitespace and commas
+	// with brackets removed, like "0x1" and "0x2" for "{0x1, 0x2}"
+	Fields []string
+}
+
+// Template is a decoder that renders inputs with go text/template
+// from config, which is useful for unusual layouts of keys
+type Template struct {
+	lock  sync.Mutex
+	cache map[string]*template.Template
+}
+
+// ParseTemplate parses text of the template decoder, it allows
+// to check templates from config before decoding anything
+func ParseTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, fmt.Errorf("no template set for template decoder")
+	}
+
+	parsed, err := template.New("decoder").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template %q: %s", text, err)
+	}
+
+	return parsed, nil
+}
+
+// Decode renders the template with the input and its fields
+func (t *Template) Decode(in string, conf config.Decoder) (string, error) {
+	t.lock.Lock()
+
+	if t.cache == nil {
+		t.cache = map[string]*template.Template{}
+	}
+
+	parsed, ok := t.cache[conf.Template]
+	if !ok {
+		var err error
+
+		parsed, err = ParseTemplate(conf.Template)
+		if err != nil {
+			t.lock.Unlock()
+			return "", err
+		}
+
+		t.cache[conf.Template] = parsed
+	}
+
+	t.lock.Unlock()
+
+	fields := strings.FieldsFunc(in, func(r rune) bool {
+		return strings.ContainsRune("{}[], \t\n", r)
+	})
+
+	buf := bytes.Buffer{}
+
+	err := parsed.Execute(&buf, templateData{Input: in, Fields: fields})
+	if err != nil {
+		return "", fmt.Errorf("error executing template: %s", err)
+	}
+
+	return buf.String(), nil
+}
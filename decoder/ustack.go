@@ -0,0 +1,81 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// UStack is a decoder that transforms user stack id into a folded stack
+type UStack struct {
+	cacheCounter
+	lock     sync.Mutex
+	stacks   stackReader
+	mappings map[string][]procMapping
+	symbols  map[string]elfSymbols
+}
+
+// Decode transforms user stack id into a folded stack with frames
+// separated by semicolons, outermost frame goes first
+func (u *UStack) Decode(in string, conf config.Decoder) (string, error) {
+	if conf.Binary == "" {
+		return "", errors.New("no binary defined in config")
+	}
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	addrs, unknown, err := u.stacks.read(in, conf)
+	if err != nil || unknown != "" {
+		return unknown, err
+	}
+
+	if u.mappings == nil {
+		u.mappings = map[string][]procMapping{}
+	}
+
+	if u.symbols == nil {
+		u.symbols = map[string]elfSymbols{}
+	}
+
+	return foldStack(addrs, func(addr uint64) string {
+		return u.symbolize(conf.Binary, addr)
+	}), nil
+}
+
+// symbolize resolves user space address into a function name using
+// the address space of a process running the binary
+func (u *UStack) symbolize(binary string, addr uint64) string {
+	mapping, ok := findMapping(u.mappings[binary], addr)
+	if ok {
+		u.hit()
+	} else {
+		u.miss()
+
+		// Process may have been restarted, which changes the address space
+		mappings, err := binaryMappings(binary)
+		if err != nil {
+			return fmt.Sprintf("unknown:%x", addr)
+		}
+
+		u.mappings[binary] = mappings
+
+		mapping, ok = findMapping(mappings, addr)
+		if !ok {
+			return fmt.Sprintf("unknown:%x", addr)
+		}
+	}
+
+	if _, ok := u.symbols[mapping.path]; !ok {
+		symbols, err := loadElfSymbols(mapping.path)
+		if err != nil {
+			return fmt.Sprintf("unknown:%x", addr)
+		}
+
+		u.symbols[mapping.path] = symbols
+	}
+
+	return u.symbols[mapping.path].lookup(addr - mapping.start + mapping.offset)
+}
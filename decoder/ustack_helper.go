@@ -0,0 +1,203 @@
+package decoder
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// procMapping is an executable file mapping of a process
+type procMapping struct {
+	start  uint64
+	end    uint64
+	offset uint64
+	path   string
+}
+
+// findMapping finds the mapping that contains the address
+func findMapping(mappings []procMapping, addr uint64) (procMapping, bool) {
+	for _, mapping := range mappings {
+		if addr >= mapping.start && addr < mapping.end {
+			return mapping, true
+		}
+	}
+
+	return procMapping{}, false
+}
+
+// binaryMappings finds a process that has the binary mapped and returns
+// all of its executable mappings, including shared libraries
+func binaryMappings(binary string) ([]procMapping, error) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		_, err = strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+
+		mappings, err := procMappings(filepath.Join("/proc", dir.Name(), "maps"))
+		if err != nil {
+			// Process may have exited while we were looking
+			continue
+		}
+
+		for _, mapping := range mappings {
+			if mapping.path == binary {
+				return mappings, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no process found with %s mapped", binary)
+}
+
+// procMappings reads executable file mappings from `/proc/<pid>/maps`
+func procMappings(path string) ([]procMapping, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err = fd.Close(); err != nil {
+			log.Printf("Error closing %s: %s", path, err)
+		}
+	}()
+
+	mappings := []procMapping{}
+
+	s := bufio.NewScanner(fd)
+	for s.Scan() {
+		// 55d4c3a00000-55d4c3a26000 r-xp 00002000 fd:01 1234 /usr/bin/app
+		ar := strings.Fields(s.Text())
+		if len(ar) < 6 || !strings.Contains(ar[1], "x") || !strings.HasPrefix(ar[5], "/") {
+			continue
+		}
+
+		bounds := strings.SplitN(ar[0], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+
+		start, err := strconv.ParseUint(bounds[0], 16, 64)
+		if err != nil {
+			continue
+		}
+
+		end, err := strconv.ParseUint(bounds[1], 16, 64)
+		if err != nil {
+			continue
+		}
+
+		offset, err := strconv.ParseUint(ar[2], 16, 64)
+		if err != nil {
+			continue
+		}
+
+		mappings = append(mappings, procMapping{start: start, end: end, offset: offset, path: ar[5]})
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return mappings, nil
+}
+
+// elfSymbol is a function symbol from an ELF file
+type elfSymbol struct {
+	addr uint64
+	size uint64
+	name string
+}
+
+// elfSymbols is a list of function symbols of an ELF file sorted by address
+// with loadable segments used to translate file offsets into addresses
+type elfSymbols struct {
+	symbols  []elfSymbol
+	segments []elf.ProgHeader
+}
+
+// loadElfSymbols reads function symbols from both regular and dynamic
+// symbol tables of an ELF file
+func loadElfSymbols(path string) (elfSymbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return elfSymbols{}, err
+	}
+	defer func() {
+		if err = f.Close(); err != nil {
+			log.Printf("Error closing %s: %s", path, err)
+		}
+	}()
+
+	result := elfSymbols{}
+
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			result.segments = append(result.segments, prog.ProgHeader)
+		}
+	}
+
+	// Stripped binaries have no regular symbol table, so errors
+	// are ignored here and only dynamic symbols are used instead
+	symbols, _ := f.Symbols()
+	dynamic, _ := f.DynamicSymbols()
+
+	for _, symbol := range append(symbols, dynamic...) {
+		if elf.ST_TYPE(symbol.Info) != elf.STT_FUNC || symbol.Value == 0 {
+			continue
+		}
+
+		result.symbols = append(result.symbols, elfSymbol{addr: symbol.Value, size: symbol.Size, name: symbol.Name})
+	}
+
+	if len(result.symbols) == 0 {
+		return elfSymbols{}, fmt.Errorf("no function symbols found in %s", path)
+	}
+
+	sort.Slice(result.symbols, func(i, j int) bool {
+		return result.symbols[i].addr < result.symbols[j].addr
+	})
+
+	return result, nil
+}
+
+// lookup finds the name of the function that contains the file offset,
+// which is independent of where the file is loaded (PIE and ASLR)
+func (e elfSymbols) lookup(offset uint64) string {
+	addr := offset
+
+	for _, segment := range e.segments {
+		if offset >= segment.Off && offset < segment.Off+segment.Filesz {
+			addr = offset - segment.Off + segment.Vaddr
+			break
+		}
+	}
+
+	i := sort.Search(len(e.symbols), func(i int) bool {
+		return e.symbols[i].addr > addr
+	})
+
+	if i == 0 {
+		return fmt.Sprintf("unknown:%x", addr)
+	}
+
+	symbol := e.symbols[i-1]
+	if symbol.size > 0 && addr >= symbol.addr+symbol.size {
+		return fmt.Sprintf("unknown:%x", addr)
+	}
+
+	return symbol.name
+}
@@ -0,0 +1,171 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h
+// and linux/errno.h, batch operations are available since Linux 5.6
+const (
+	bpfMapLookupBatch = 24
+	bpfMapTypeHash    = 1
+	bpfMapTypeLRUHash = 9
+	errnoENOTSUPP     = syscall.Errno(524)
+)
+
+// bpfMapBatchAttr is the part of bpf_attr used by map batch commands
+type bpfMapBatchAttr struct {
+	inBatch   uint64
+	outBatch  uint64
+	keys      uint64
+	values    uint64
+	count     uint32
+	mapFd     uint32
+	elemFlags uint64
+	flags     uint64
+}
+
+// errBatchUnsupported means that the kernel or the map type
+// does not support batch lookups
+var errBatchUnsupported = fmt.Errorf("batch lookups are not supported")
+
+// tableEntries reads all entries of the table, in batches of batchSize
+// entries if it is set and supported, falling back to iterating otherwise
+func tableEntries(table *bcc.Table, batchSize int) ([]bcc.Entry, error) {
+	if batchSize > 0 {
+		entries, err := tableEntriesBatch(table, batchSize)
+		if err != errBatchUnsupported {
+			return entries, err
+		}
+	}
+
+	entries := []bcc.Entry{}
+
+	for entry := range table.Iter() {
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// batchableTable returns whether the table can be read in batches, which
+// needs integer keys and values that are rendered without help from bcc
+// and maps that are not per-CPU, since their values are laid out differently
+func batchableTable(tableConfig map[string]interface{}) bool {
+	keySize := uint32(tableConfig["key_size"].(uint64))
+	leafSize := uint32(tableConfig["leaf_size"].(uint64))
+
+	if !integerSize(keySize) || !integerSize(leafSize) {
+		return false
+	}
+
+	for _, field := range []string{"key_desc", "leaf_desc"} {
+		desc, _ := tableConfig[field].(string)
+		if !integerDesc(desc) {
+			return false
+		}
+	}
+
+	info, err := mapInfo(tableConfig["fd"].(int))
+	if err != nil {
+		return false
+	}
+
+	switch info.mapType {
+	case bpfMapTypeHash, bpfMapTypeArray, bpfMapTypeLRUHash:
+		return true
+	default:
+		return false
+	}
+}
+
+// integerDesc returns whether the type described by bcc is an integer,
+// descriptions of scalar types are just their names, like "unsigned int"
+func integerDesc(desc string) bool {
+	name := ""
+
+	err := json.Unmarshal([]byte(desc), &name)
+	if err != nil {
+		return false
+	}
+
+	return !strings.Contains(name, "float") && !strings.Contains(name, "double")
+}
+
+// tableEntriesBatch reads all entries of the table with BPF_MAP_LOOKUP_BATCH,
+// which needs one syscall per batch instead of two syscalls per entry
+func tableEntriesBatch(table *bcc.Table, batchSize int) ([]bcc.Entry, error) {
+	tableConfig := table.Config()
+
+	if !batchableTable(tableConfig) {
+		return nil, errBatchUnsupported
+	}
+
+	fd := tableConfig["fd"].(int)
+	keySize := int(tableConfig["key_size"].(uint64))
+	leafSize := int(tableConfig["leaf_size"].(uint64))
+
+	keys := make([]byte, keySize*batchSize)
+	values := make([]byte, leafSize*batchSize)
+
+	// Batch token is either u32 or a key depending on the map type
+	tokenSize := keySize
+	if tokenSize < 4 {
+		tokenSize = 4
+	}
+
+	inBatch := make([]byte, tokenSize)
+	outBatch := make([]byte, tokenSize)
+
+	entries := []bcc.Entry{}
+
+	for first := true; ; first = false {
+		attr := bpfMapBatchAttr{
+			outBatch: uint64(uintptr(unsafe.Pointer(&outBatch[0]))),
+			keys:     uint64(uintptr(unsafe.Pointer(&keys[0]))),
+			values:   uint64(uintptr(unsafe.Pointer(&values[0]))),
+			count:    uint32(batchSize),
+			mapFd:    uint32(fd),
+		}
+
+		// The first batch starts from the beginning of the map
+		if !first {
+			attr.inBatch = uint64(uintptr(unsafe.Pointer(&inBatch[0])))
+		}
+
+		_, _, errno := syscall.Syscall(sysBPF, bpfMapLookupBatch, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+
+		switch errno {
+		case 0, syscall.ENOENT:
+		case syscall.EINVAL, syscall.EOPNOTSUPP, errnoENOTSUPP:
+			if first {
+				return nil, errBatchUnsupported
+			}
+
+			return nil, fmt.Errorf("error looking up batch: %s", errno)
+		default:
+			return nil, fmt.Errorf("error looking up batch: %s", errno)
+		}
+
+		// Integers are rendered as hex numbers, the same way bcc does it
+		for i := 0; i < int(attr.count); i++ {
+			entries = append(entries, bcc.Entry{
+				Key:   fmt.Sprintf("0x%x", nativeUint(keys[i*keySize:(i+1)*keySize])),
+				Value: fmt.Sprintf("0x%x", nativeUint(values[i*leafSize:(i+1)*leafSize])),
+			})
+		}
+
+		// ENOENT means that there are no more entries after this batch
+		if errno == syscall.ENOENT {
+			return entries, nil
+		}
+
+		copy(inBatch, outBatch)
+	}
+}
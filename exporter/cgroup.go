@@ -0,0 +1,77 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h
+const (
+	bpfProgAttach           = 8
+	bpfProgTypeCgroupSKB    = 8
+	bpfProgTypeCgroupSock   = 9
+	bpfCgroupInetIngress    = 0
+	bpfCgroupInetEgress     = 1
+	bpfCgroupInetSockCreate = 2
+)
+
+// bpfProgAttachAttr is the part of bpf_attr used by BPF_PROG_ATTACH
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+// attachCgroupProgram loads the target function and attaches it to the cgroup
+func attachCgroupProgram(module *bcc.Module, cgroupProgram config.CgroupProgram) error {
+	progType, attachType := 0, 0
+
+	switch cgroupProgram.AttachType {
+	case config.CgroupAttachIngress:
+		progType, attachType = bpfProgTypeCgroupSKB, bpfCgroupInetIngress
+	case config.CgroupAttachEgress:
+		progType, attachType = bpfProgTypeCgroupSKB, bpfCgroupInetEgress
+	case config.CgroupAttachSock:
+		progType, attachType = bpfProgTypeCgroupSock, bpfCgroupInetSockCreate
+	default:
+		return fmt.Errorf("unknown cgroup attach type %q", cgroupProgram.AttachType)
+	}
+
+	target, err := loadFunction(module, cgroupProgram.Target, progType)
+	if err != nil {
+		return fmt.Errorf("failed to load target %q: %s", cgroupProgram.Target, err)
+	}
+
+	cgroup, err := os.Open(cgroupProgram.Cgroup)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup: %s", err)
+	}
+
+	defer func() {
+		if err = cgroup.Close(); err != nil {
+			log.Printf("Error closing cgroup %s: %s", cgroupProgram.Cgroup, err)
+		}
+	}()
+
+	// No attach flags means that the program replaces the one attached
+	// previously, which is what we want when the exporter restarts
+	attr := bpfProgAttachAttr{
+		targetFd:    uint32(cgroup.Fd()),
+		attachBpfFd: uint32(target),
+		attachType:  uint32(attachType),
+	}
+
+	_, _, errno := syscall.Syscall(sysBPF, bpfProgAttach, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return fmt.Errorf("failed to attach %q to cgroup %s: %s", cgroupProgram.Target, cgroupProgram.Cgroup, errno)
+	}
+
+	return nil
+}
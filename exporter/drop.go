@@ -0,0 +1,72 @@
+package exporter
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// dropCondition matches the value of the label with the index
+type dropCondition struct {
+	index  int
+	value  string
+	regexp *regexp.Regexp
+}
+
+// dropMatcher matches decoded labels against drop_if conditions
+type dropMatcher []dropCondition
+
+// newDropMatcher makes a matcher for conditions on the labels
+func newDropMatcher(conditions []config.DropIf, labels []config.Label) (dropMatcher, error) {
+	matcher := dropMatcher{}
+
+	for _, condition := range conditions {
+		index := -1
+
+		for i, label := range labels {
+			if label.Name == condition.Label {
+				index = i
+				break
+			}
+		}
+
+		if index == -1 {
+			return nil, fmt.Errorf("drop_if refers to unknown label %q", condition.Label)
+		}
+
+		compiled := dropCondition{index: index, value: condition.Value}
+
+		if condition.Regexp != "" {
+			re, err := regexp.Compile(condition.Regexp)
+			if err != nil {
+				return nil, fmt.Errorf("error compiling drop_if regexp %q for label %q: %s", condition.Regexp, condition.Label, err)
+			}
+
+			compiled.regexp = re
+		}
+
+		matcher = append(matcher, compiled)
+	}
+
+	return matcher, nil
+}
+
+// matches returns whether any of the conditions matches the labels
+func (m dropMatcher) matches(labels []string) bool {
+	for _, condition := range m {
+		if condition.regexp != nil {
+			if condition.regexp.MatchString(labels[condition.index]) {
+				return true
+			}
+
+			continue
+		}
+
+		if labels[condition.index] == condition.value {
+			return true
+		}
+	}
+
+	return false
+}
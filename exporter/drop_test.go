@@ -0,0 +1,93 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+func TestDropMatcher(t *testing.T) {
+	labels := []config.Label{{Name: "device"}, {Name: "operation"}}
+
+	cases := []struct {
+		conditions []config.DropIf
+		values     []string
+		dropped    bool
+	}{
+		{
+			conditions: nil,
+			values:     []string{"sda", "read"},
+			dropped:    false,
+		},
+		{
+			conditions: []config.DropIf{{Label: "operation", Value: "read"}},
+			values:     []string{"sda", "read"},
+			dropped:    true,
+		},
+		{
+			conditions: []config.DropIf{{Label: "operation", Value: "read"}},
+			values:     []string{"sda", "write"},
+			dropped:    false,
+		},
+		{
+			conditions: []config.DropIf{{Label: "device", Regexp: "^loop"}},
+			values:     []string{"loop0", "read"},
+			dropped:    true,
+		},
+		{
+			conditions: []config.DropIf{{Label: "device", Regexp: "^loop"}},
+			values:     []string{"sda", "read"},
+			dropped:    false,
+		},
+		{
+			// Regexp takes precedence over value
+			conditions: []config.DropIf{{Label: "device", Value: "sda", Regexp: "^loop"}},
+			values:     []string{"sda", "read"},
+			dropped:    false,
+		},
+		{
+			conditions: []config.DropIf{{Label: "device", Value: "sda", Regexp: "^loop"}},
+			values:     []string{"loop1", "read"},
+			dropped:    true,
+		},
+		{
+			// Any matching condition drops the label set
+			conditions: []config.DropIf{{Label: "device", Regexp: "^loop"}, {Label: "operation", Value: "write"}},
+			values:     []string{"sda", "write"},
+			dropped:    true,
+		},
+		{
+			// Empty value only matches empty labels
+			conditions: []config.DropIf{{Label: "device"}},
+			values:     []string{"", "read"},
+			dropped:    true,
+		},
+	}
+
+	for _, c := range cases {
+		matcher, err := newDropMatcher(c.conditions, labels)
+		if err != nil {
+			t.Errorf("Error making matcher for %v: %s", c.conditions, err)
+			continue
+		}
+
+		if dropped := matcher.matches(c.values); dropped != c.dropped {
+			t.Errorf("Expected %v for %v with conditions %v, got %v", c.dropped, c.values, c.conditions, dropped)
+		}
+	}
+}
+
+func TestDropMatcherErrors(t *testing.T) {
+	labels := []config.Label{{Name: "device"}}
+
+	cases := [][]config.DropIf{
+		{{Label: "pid", Value: "1"}},
+		{{Label: "device", Regexp: "("}},
+	}
+
+	for _, conditions := range cases {
+		if _, err := newDropMatcher(conditions, labels); err == nil {
+			t.Errorf("Expected conditions %v to be rejected", conditions)
+		}
+	}
+}
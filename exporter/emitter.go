@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TableValue is a row of a kernel map with labels decoded from its key
+type TableValue struct {
+	Labels []string
+	Value  float64
+}
+
+// Emitter turns rows of a kernel map into prometheus metrics for custom
+// metrics. The desc has decoded labels followed by extra labels of the metric,
+// values of extra labels are up to the emitter. Returned metrics must use
+// the desc, otherwise the scrape fails.
+type Emitter interface {
+	Emit(desc *prometheus.Desc, values []TableValue) ([]prometheus.Metric, error)
+}
+
+var (
+	emittersLock sync.Mutex
+	emitters     = map[string]Emitter{}
+)
+
+// RegisterEmitter makes a custom emitter available under the name to custom
+// metrics in config. It panics if the name is already taken, so it is meant
+// to be called from init function or main before creating exporter
+func RegisterEmitter(name string, emitter Emitter) {
+	emittersLock.Lock()
+	defer emittersLock.Unlock()
+
+	if emitter == nil {
+		panic(fmt.Sprintf("emitter %q is nil", name))
+	}
+
+	if _, ok := emitters[name]; ok {
+		panic(fmt.Sprintf("emitter %q is already registered", name))
+	}
+
+	emitters[name] = emitter
+}
+
+// registeredEmitter returns the emitter registered under the name
+func registeredEmitter(name string) (Emitter, bool) {
+	emittersLock.Lock()
+	defer emittersLock.Unlock()
+
+	emitter, ok := emitters[name]
+
+	return emitter, ok
+}
+
+// validateEmitters checks that emitters of custom metrics are registered
+func validateEmitters(program config.Program) error {
+	for _, custom := range program.Metrics.Custom {
+		if _, ok := registeredEmitter(custom.Emitter); !ok {
+			return fmt.Errorf("emitter %q of metric %q in program %q is not registered", custom.Emitter, custom.Name, program.Name)
+		}
+	}
+
+	return nil
+}
+
+// customLabels returns labels of the custom metric, including extra labels
+func customLabels(custom config.Custom) []config.Label {
+	labels := perCPULabels(custom.PerCPULabel, custom.Labels)
+	labels = labels[0:len(labels):len(labels)]
+
+	for _, name := range custom.ExtraLabels {
+		labels = append(labels, config.Label{Name: name})
+	}
+
+	return labels
+}
+
+// collectCustom sends metrics made by emitters of custom metrics to prometheus
+func (e *Exporter) collectCustom(ch chan<- prometheus.Metric, programs []config.Program) bool {
+	success := true
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		for _, custom := range program.Metrics.Custom {
+			tableConfig := customTableConfig(custom)
+			tableConfig.trace = e.tracing(program.Name, custom.Name)
+
+			tableValues, err := e.tableValues(program.Name, custom.Table, tableConfig)
+			if err != nil {
+				e.collectTableError(program.Name, err, "Error getting table %q values for metric %q of program %q: %s", custom.Table, custom.Name, program.Name, err)
+				success = false
+				continue
+			}
+
+			values := make([]TableValue, len(tableValues))
+			for i, metricValue := range tableValues {
+				values[i] = TableValue{Labels: metricValue.labels, Value: metricValue.value}
+			}
+
+			emitter, _ := registeredEmitter(custom.Emitter)
+
+			metrics, err := emitter.Emit(e.descs[program.Name][custom.Name], values)
+			if err != nil {
+				e.collectError(program.Name, "Error emitting metric %q of program %q with emitter %q: %s", custom.Name, program.Name, custom.Emitter, err)
+				success = false
+				continue
+			}
+
+			for _, metric := range metrics {
+				ch <- metric
+			}
+		}
+	}
+
+	return success
+}
@@ -0,0 +1,31 @@
+package exporter
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// nativeEndian is the byte order of the host, which is the byte order
+// of numbers in keys and values of maps, as well as in BTF
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// nativeUint reads an unsigned integer of 1, 2, 4 or 8 bytes in host byte order
+func nativeUint(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(nativeEndian.Uint16(b))
+	case 4:
+		return uint64(nativeEndian.Uint32(b))
+	default:
+		return nativeEndian.Uint64(b)
+	}
+}
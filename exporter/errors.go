@@ -0,0 +1,74 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxErrorLength limits the length of error label of the last error metric
+const maxErrorLength = 256
+
+// lastError is the most recent collection error of all programs
+type lastError struct {
+	program string
+	message string
+	time    time.Time
+}
+
+// collectError logs collection error of the program and keeps
+// it as the last error to export as a metric
+func (e *Exporter) collectError(programName string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+
+	log.Print(message)
+
+	e.keepError(programName, message)
+}
+
+// keepError keeps the message as the last error, replacing the previous one
+func (e *Exporter) keepError(programName string, message string) {
+	if len(message) > maxErrorLength {
+		// Label values must be valid utf-8, so runes are not cut in half
+		end := maxErrorLength - 3
+		for end > 0 && !utf8.RuneStart(message[end]) {
+			end--
+		}
+
+		message = message[0:end] + "..."
+	}
+
+	e.lastErrorLock.Lock()
+	defer e.lastErrorLock.Unlock()
+
+	e.lastError = lastError{program: programName, message: message, time: time.Now()}
+}
+
+// collectLastError sends the last error to prometheus if it happened during
+// the scrape that started at the given time, the error is cleared once
+// its program is collected without errors
+func (e *Exporter) collectLastError(ch chan<- prometheus.Metric, programs []config.Program, start time.Time) {
+	e.lastErrorLock.Lock()
+	defer e.lastErrorLock.Unlock()
+
+	if e.lastError.program == "" {
+		return
+	}
+
+	for _, program := range programs {
+		if program.Name != e.lastError.program {
+			continue
+		}
+
+		if e.lastError.time.Before(start) {
+			e.lastError = lastError{}
+			return
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.errorDesc, prometheus.GaugeValue, 1, e.lastError.program, e.lastError.message)
+	}
+}
@@ -0,0 +1,80 @@
+package exporter
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestKeepErrorTruncatesOnRuneBoundary(t *testing.T) {
+	e := New(config.Config{})
+
+	// Three byte runes do not line up with the truncated length
+	e.keepError("bio", "x"+strings.Repeat("€", maxErrorLength))
+
+	message := e.lastError.message
+
+	if !utf8.ValidString(message) {
+		t.Errorf("Truncated error is not valid utf-8: %q", message)
+	}
+
+	if len(message) > maxErrorLength {
+		t.Errorf("Truncated error has %d bytes, expected at most %d", len(message), maxErrorLength)
+	}
+
+	if !strings.HasSuffix(message, "€...") {
+		t.Errorf("Expected truncated error to end with a whole rune and ellipsis, got %q", message)
+	}
+}
+
+func TestLastErrorIsSingleSeries(t *testing.T) {
+	programs := []config.Program{{Name: "bio"}, {Name: "nvme"}}
+
+	e := New(config.Config{Programs: programs})
+
+	start := time.Now()
+
+	e.keepError("bio", "bio failed")
+	e.keepError("nvme", "nvme failed")
+
+	ch := make(chan prometheus.Metric, 10)
+	e.collectLastError(ch, programs, start)
+	close(ch)
+
+	metrics := []prometheus.Metric{}
+	for metric := range ch {
+		metrics = append(metrics, metric)
+	}
+
+	if len(metrics) != 1 {
+		t.Fatalf("Expected one last error series, got %d", len(metrics))
+	}
+
+	out := &dto.Metric{}
+	if err := metrics[0].Write(out); err != nil {
+		t.Fatalf("Error writing metric: %s", err)
+	}
+
+	labels := map[string]string{}
+	for _, label := range out.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+
+	if labels["program"] != "nvme" || labels["error"] != "nvme failed" {
+		t.Errorf("Expected the latest error of nvme, got %v", labels)
+	}
+
+	// The next scrape without errors clears the error
+	ch = make(chan prometheus.Metric, 10)
+	e.collectLastError(ch, programs, time.Now())
+	close(ch)
+
+	if len(ch) != 0 {
+		t.Errorf("Expected last error to be cleared after a scrape without errors")
+	}
+}
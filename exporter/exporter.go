@@ -3,9 +3,14 @@ package exporter
 import (
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudflare/ebpf_exporter/config"
 	"github.com/cloudflare/ebpf_exporter/decoder"
@@ -18,245 +23,2040 @@ const prometheusNamespace = "ebpf_exporter"
 
 // Exporter is a ebpf_exporter instance implementing prometheus.Collector
 type Exporter struct {
-	config   config.Config
-	modules  map[string]*bcc.Module
-	ksyms    map[uint64]string
-	descs    map[string]map[string]*prometheus.Desc
-	decoders *decoder.Set
+	config         config.Config
+	hash           string
+	modules        map[string]*bcc.Module
+	ksyms          map[uint64]string
+	skipped        map[string]string
+	descs          map[string]map[string]*prometheus.Desc
+	decoders       map[string]*decoder.Set
+	queues         map[string]map[string]prometheus.Histogram
+	iters          map[string]*prometheus.HistogramVec
+	perfHistograms map[string]map[string]*prometheus.HistogramVec
+	pids           *pidCache
+	fds            map[string]map[string]int
+	insns          map[string]map[string]int
+	attached       map[string]map[string]int
+	kprobes        map[string]kprobeLinks
+	warnings       map[string]int
+	dropped        map[string]map[string]int
+	infoDesc       *prometheus.Desc
+	hashDesc       *prometheus.Desc
+	upDesc         *prometheus.Desc
+	insnDesc       *prometheus.Desc
+	warnDesc       *prometheus.Desc
+	runsDesc       *prometheus.Desc
+	timeDesc       *prometheus.Desc
+	hitsDesc       *prometheus.Desc
+	missDesc       *prometheus.Desc
+	durDesc        *prometheus.Desc
+	attsDesc       *prometheus.Desc
+	trace          *traceSelector
+	batch          int
+	decoderCache   int
+	decoderSample  int
+	mismatch       bool
+	attachAt       time.Time
+	quietPeriod    time.Duration
+	quietEmpty     bool
+	debugLogs      bool
+
+	// tableReader reads tables of programs, which tests replace
+	// to collect metrics without loading programs into the kernel
+	tableReader func(programName string, tableName string) ([]bcc.Entry, string, string, error)
+
+	droppedLock sync.Mutex
+	droppedDesc *prometheus.Desc
+
+	lastError     lastError
+	lastErrorLock sync.Mutex
+	errorDesc     *prometheus.Desc
+
+	inconsistent     map[string]int
+	inconsistentLock sync.Mutex
+	inconsistentDesc *prometheus.Desc
+
+	timeouts     map[string]int
+	running      map[string]bool
+	timeoutsLock sync.Mutex
+	timeoutsDesc *prometheus.Desc
+
+	perfDropped     map[string]map[string]int
+	perfLost        map[string]map[string]int
+	perfDroppedLock sync.Mutex
+	perfDroppedDesc *prometheus.Desc
+	perfLostDesc    *prometheus.Desc
+
+	reattached   map[string]int
+	reattachLock sync.Mutex
+	reattachDesc *prometheus.Desc
+}
+
+// traceSelector selects a metric to trace decoding of on the next scrape
+type traceSelector struct {
+	program string
+	metric  string
 }
 
 // New creates a new exporter with the provided config
 func New(config config.Config) *Exporter {
-	return &Exporter{
-		config:   config,
-		modules:  map[string]*bcc.Module{},
-		ksyms:    map[uint64]string{},
-		descs:    map[string]map[string]*prometheus.Desc{},
-		decoders: decoder.NewSet(),
+	e := &Exporter{
+		config:         config,
+		hash:           configHash(config),
+		modules:        map[string]*bcc.Module{},
+		ksyms:          map[uint64]string{},
+		skipped:        map[string]string{},
+		descs:          map[string]map[string]*prometheus.Desc{},
+		decoders:       map[string]*decoder.Set{},
+		queues:         map[string]map[string]prometheus.Histogram{},
+		iters:          map[string]*prometheus.HistogramVec{},
+		perfHistograms: map[string]map[string]*prometheus.HistogramVec{},
+		pids:           &pidCache{},
+		fds:            map[string]map[string]int{},
+		insns:          map[string]map[string]int{},
+		attached:       map[string]map[string]int{},
+		kprobes:        map[string]kprobeLinks{},
+		warnings:       map[string]int{},
+		dropped:        map[string]map[string]int{},
+		infoDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "program_info"), "Programs from config and whether they are attached, skipped or disabled", []string{"program", "state"}, nil),
+		hashDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "config_hash"), "Hash of the loaded config, which is the same on nodes with the same config", []string{"hash"}, nil),
+		upDesc:         prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "up"), "Whether the last collection of all metrics was successful", nil, nil),
+		insnDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "program_instructions"), "Number of instructions in loaded functions of programs", []string{"program", "function"}, nil),
+		warnDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "program_load_warnings_total"), "Number of functions of programs close to the verifier instruction limit", []string{"program"}, nil),
+		runsDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "bpf_program_runs_total"), "Number of runs of loaded functions of programs, needs bpf_stats enabled", []string{"program", "function"}, nil),
+		timeDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "bpf_program_run_time_seconds_total"), "Total run time of loaded functions of programs, needs bpf_stats enabled", []string{"program", "function"}, nil),
+		hitsDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "decoder_cache_hits_total"), "Number of cache hits of caching decoders", []string{"decoder"}, nil),
+		missDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "decoder_cache_misses_total"), "Number of cache misses of caching decoders", []string{"decoder"}, nil),
+		durDesc:        prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "decode_duration_seconds"), "Duration of sampled decoder calls", []string{"decoder"}, nil),
+		attsDesc:       prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "attached_probes"), "Number of probes attached by programs on startup by type", []string{"type"}, nil),
+
+		droppedDesc: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "series_dropped_total"), "Number of series dropped over max_series limit of metrics", []string{"program", "metric"}, nil),
+
+		errorDesc: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "last_error"), "The last collection error if it happened on the last scrape", []string{"program", "error"}, nil),
+
+		inconsistent:     map[string]int{},
+		inconsistentDesc: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "inconsistent_reads_total"), "Number of scrapes of programs with generation_table that changed while maps were read", []string{"program"}, nil),
+
+		timeouts:     map[string]int{},
+		running:      map[string]bool{},
+		timeoutsDesc: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "collect_timeouts_total"), "Number of scrapes where collection of programs with collect_timeout took too long", []string{"program"}, nil),
+
+		perfDropped:     map[string]map[string]int{},
+		perfLost:        map[string]map[string]int{},
+		perfDroppedDesc: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "perf_samples_dropped_total"), "Number of samples of perf histograms that could not be decoded", []string{"program", "metric"}, nil),
+		perfLostDesc:    prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "perf_samples_lost_total"), "Number of samples of perf histograms from ring buffers lost because the exporter could not keep up", []string{"program", "metric"}, nil),
+
+		reattached:   map[string]int{},
+		reattachDesc: prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", "reattach_total"), "Number of times kprobes of programs were reattached after kernel modules were loaded again", []string{"program"}, nil),
+	}
+
+	e.tableReader = e.readModuleTable
+
+	return e
+}
+
+// AddConstLabel adds a label with a constant value to every metric of every
+// program, it must be called before Attach to take effect
+func (e *Exporter) AddConstLabel(name, value string) {
+	for i, program := range e.config.Programs {
+		constLabels := map[string]string{name: value}
+
+		for k, v := range program.ConstLabels {
+			constLabels[k] = v
+		}
+
+		e.config.Programs[i].ConstLabels = constLabels
+	}
+}
+
+// LookupBatchSize enables reading tables in batches of the given size
+// on kernels that support it, which is faster for large tables
+func (e *Exporter) LookupBatchSize(size int) {
+	e.batch = size
+}
+
+// DecoderCacheSize sets how many decoded results of cacheable decoders
+// are cached for every program, zero disables caching
+func (e *Exporter) DecoderCacheSize(size int) {
+	e.decoderCache = size
+}
+
+// DecoderDurationSampling enables timing of every nth call of each decoder,
+// zero disables timing
+func (e *Exporter) DecoderDurationSampling(every int) {
+	e.decoderSample = every
+}
+
+// decoderSet returns a new set of decoders for the module
+func (e *Exporter) decoderSet(module *bcc.Module) *decoder.Set {
+	decoders := decoder.NewSet(module)
+	decoders.CacheResults(e.decoderCache)
+	decoders.SampleDurations(e.decoderSample)
+
+	return decoders
+}
+
+// TraceMetric enables logging of every decoding step for the metric
+// of the program, which happens once on the next scrape
+func (e *Exporter) TraceMetric(programName, metricName string) {
+	e.trace = &traceSelector{program: programName, metric: metricName}
+}
+
+// tracing checks whether decoding of the metric should be traced
+func (e *Exporter) tracing(programName, metricName string) bool {
+	return e.trace != nil && e.trace.program == programName && e.trace.metric == metricName
+}
+
+// Groups returns names of all program groups from config
+func (e *Exporter) Groups() []string {
+	groups := []string{}
+	seen := map[string]bool{}
+
+	for _, program := range e.config.Programs {
+		if program.Group == "" || seen[program.Group] {
+			continue
+		}
+
+		seen[program.Group] = true
+		groups = append(groups, program.Group)
+	}
+
+	return groups
+}
+
+// GroupCollector returns prometheus.Collector for programs of the group,
+// which allows to serve metrics of different groups separately
+func (e *Exporter) GroupCollector(group string) prometheus.Collector {
+	programs := []config.Program{}
+
+	for _, program := range e.config.Programs {
+		if program.Group == group {
+			programs = append(programs, program)
+		}
+	}
+
+	return &groupCollector{exporter: e, programs: programs}
+}
+
+// groupCollector is prometheus.Collector for a group of programs
+type groupCollector struct {
+	exporter *Exporter
+	programs []config.Program
+}
+
+// Describe satisfies prometheus.Collector interface
+func (g *groupCollector) Describe(ch chan<- *prometheus.Desc) {
+	g.exporter.describe(ch, g.programs)
+}
+
+// Collect satisfies prometheus.Collector interface
+func (g *groupCollector) Collect(ch chan<- prometheus.Metric) {
+	g.exporter.collect(ch, g.programs)
+}
+
+// Attach injects eBPF into kernel and attaches necessary kprobes
+func (e *Exporter) Attach() error {
+	release, kernel, err := runningKernelVersion()
+	if err != nil {
+		return fmt.Errorf("error detecting kernel version: %s", err)
+	}
+
+	err = e.validateMetricNames()
+	if err != nil {
+		return err
+	}
+
+	for _, program := range e.config.Programs {
+		_, attached := e.modules[program.Name]
+		_, skipped := e.skipped[program.Name]
+		if attached || skipped {
+			return fmt.Errorf("multiple programs with name %q", program.Name)
+		}
+
+		if e.disabled(program.Name) {
+			log.Printf("Skipping disabled program %q", program.Name)
+			e.skipped[program.Name] = "disabled"
+			continue
+		}
+
+		err = validateConstLabels(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateTemplates(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateSampleRatios(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateHistograms(program)
+		if err != nil {
+			return err
+		}
+
+		err = validatePackedValues(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateIgnoredKeyFields(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateMaxValues(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateZeroWhenEmpty(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateRollups(program)
+		if err != nil {
+			return err
+		}
+
+		err = validatePerfHistograms(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateEmitters(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateKernelRates(program)
+		if err != nil {
+			return err
+		}
+
+		err = validateGlobals(program)
+		if err != nil {
+			return err
+		}
+
+		supported, reason, err := kernelSupported(kernel, program)
+		if err != nil {
+			return err
+		}
+
+		if !supported {
+			log.Printf("Skipping program %q on kernel %s: %s", program.Name, release, reason)
+			e.skipped[program.Name] = "skipped"
+			continue
+		}
+
+		module := bcc.NewModule(e.programCode(program), compileFlags(kernel))
+		if module == nil {
+			return fmt.Errorf("error compiling module for program %q", program.Name)
+		}
+
+		err = validateTables(module, program)
+		if err != nil {
+			return err
+		}
+
+		err = checkPinnedGlobals(program)
+		if err != nil {
+			return err
+		}
+
+		err = populateProgArrays(module, program)
+		if err != nil {
+			return err
+		}
+
+		probes := map[string]int{}
+
+		e.kprobes[program.Name] = kprobeLinks{}
+
+		probes["kprobe"], err = attachKprobes(module, program.Kprobes, "kprobe", e.kprobes[program.Name])
+		if err != nil {
+			return fmt.Errorf("failed to attach kprobes in program %q: %s", program.Name, err)
+		}
+
+		probes["kretprobe"], err = attachKprobes(module, program.Kretprobes, "kretprobe", e.kprobes[program.Name])
+		if err != nil {
+			return fmt.Errorf("failed to attach kretprobes in program %q: %s", program.Name, err)
+		}
+
+		for _, tracepoint := range program.TracepointsGlob {
+			count, err := attachTracepointsGlob(module, tracepoint)
+			if err != nil {
+				return fmt.Errorf("failed to attach tracepoints in program %q: %s", program.Name, err)
+			}
+
+			probes["tracepoint"] += count
+		}
+
+		for _, perfEvent := range program.PerfEvents {
+			count, err := attachPerfEvent(module, perfEvent)
+			if err != nil {
+				return fmt.Errorf("failed to attach perf events in program %q: %s", program.Name, err)
+			}
+
+			probes["perf_event"] += count
+		}
+
+		for _, cgroupProgram := range program.CgroupPrograms {
+			err = attachCgroupProgram(module, cgroupProgram)
+			if err != nil {
+				return fmt.Errorf("failed to attach cgroup program in program %q: %s", program.Name, err)
+			}
+
+			probes["cgroup"]++
+		}
+
+		e.attached[program.Name] = probes
+		e.fds[program.Name] = functionDescriptors(module, program)
+		e.insns[program.Name], e.warnings[program.Name] = programInstructions(program.Name, e.fds[program.Name])
+		e.modules[program.Name] = module
+		e.queues[program.Name] = queueHistograms(program)
+		e.iters[program.Name] = iterationHistograms(program)
+		e.decoders[program.Name] = e.decoderSet(module)
+
+		err = e.attachPerfHistograms(module, program)
+		if err != nil {
+			return fmt.Errorf("failed to attach perf histograms in program %q: %s", program.Name, err)
+		}
+	}
+
+	e.logAttachSummary()
+
+	e.attachAt = time.Now()
+
+	return nil
+}
+
+// settledPrograms returns programs that were attached for longer than
+// their settle duration, metrics of other programs are not exported yet
+func (e *Exporter) settledPrograms(programs []config.Program) []config.Program {
+	settled := []config.Program{}
+
+	for _, program := range programs {
+		if time.Since(e.attachAt) < program.SettleDuration {
+			continue
+		}
+
+		settled = append(settled, program)
+	}
+
+	return settled
+}
+
+// attachTypes are types of probes counted in the attach summary
+var attachTypes = []string{"kprobe", "kretprobe", "tracepoint", "perf_event", "cgroup"}
+
+// attachedProbes returns the number of attached probes by type for the programs
+func (e *Exporter) attachedProbes(programs []config.Program) map[string]int {
+	probes := map[string]int{}
+
+	for _, program := range programs {
+		for probeType, count := range e.attached[program.Name] {
+			probes[probeType] += count
+		}
+	}
+
+	return probes
+}
+
+// logAttachSummary logs a single machine-parseable line with the number
+// of attached, skipped and disabled programs and attached probes
+func (e *Exporter) logAttachSummary() {
+	states := map[string]int{}
+
+	for _, program := range e.config.Programs {
+		state := "attached"
+		if skipped, ok := e.skipped[program.Name]; ok {
+			state = skipped
+		}
+
+		states[state]++
+	}
+
+	probes := e.attachedProbes(e.config.Programs)
+
+	summary := fmt.Sprintf("programs=%d attached=%d skipped=%d disabled=%d", len(e.config.Programs), states["attached"], states["skipped"], states["disabled"])
+	for _, probeType := range attachTypes {
+		summary += fmt.Sprintf(" %ss=%d", probeType, probes[probeType])
+	}
+
+	log.Printf("Attach summary: %s", summary)
+}
+
+// programCode returns code of the program with common code prepended
+func (e *Exporter) programCode(program config.Program) string {
+	if e.config.CommonCode == "" {
+		return program.Code
+	}
+
+	return e.config.CommonCode + "\n" + program.Code
+}
+
+// populateProgArrays loads functions of the program and puts them
+// into prog arrays, so that they can be used for tail calls
+func populateProgArrays(module *bcc.Module, program config.Program) error {
+	for _, progArray := range program.ProgArrays {
+		indices := map[int]string{}
+
+		for _, entry := range progArray.Entries {
+			if function, ok := indices[entry.Index]; ok {
+				return fmt.Errorf("index %d of prog array %q in program %q is used by both %q and %q", entry.Index, progArray.Table, program.Name, function, entry.Function)
+			}
+
+			indices[entry.Index] = entry.Function
+		}
+
+		table, err := moduleTable(module, progArray.Table)
+		if err != nil {
+			return fmt.Errorf("failed to find prog array in program %q: %s", program.Name, err)
+		}
+
+		for _, entry := range progArray.Entries {
+			progType, err := progArrayEntryType(program, entry)
+			if err != nil {
+				return fmt.Errorf("function %q of prog array %q in program %q: %s", entry.Function, progArray.Table, program.Name, err)
+			}
+
+			fd, err := loadFunction(module, entry.Function, progType)
+			if err != nil {
+				return fmt.Errorf("failed to load function %q for prog array %q in program %q: %s", entry.Function, progArray.Table, program.Name, err)
+			}
+
+			err = table.Set(fmt.Sprintf("%d", entry.Index), fmt.Sprintf("%d", fd))
+			if err != nil {
+				return fmt.Errorf("failed to put function %q at index %d of prog array %q in program %q: %s", entry.Function, entry.Index, progArray.Table, program.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// progArrayEntryType returns the program type to load the prog array function
+// as, tail calls only work between functions of the same type, so by default
+// it is the type of functions the program attaches, kprobe if it is unclear
+func progArrayEntryType(program config.Program, entry config.ProgArrayEntry) (int, error) {
+	kind := entry.Type
+
+	if kind == "" {
+		switch {
+		case len(program.TracepointsGlob) > 0 && len(program.Kprobes) == 0 && len(program.Kretprobes) == 0 && len(program.PerfEvents) == 0:
+			kind = "tracepoint"
+		case len(program.PerfEvents) > 0 && len(program.Kprobes) == 0 && len(program.Kretprobes) == 0 && len(program.TracepointsGlob) == 0:
+			kind = "perf_event"
+		default:
+			kind = "kprobe"
+		}
+	}
+
+	switch kind {
+	case "kprobe":
+		return bpfProgTypeKprobe, nil
+	case "tracepoint":
+		return bpfProgTypeTracepoint, nil
+	case "perf_event":
+		return bpfProgTypePerfEvent, nil
+	default:
+		return 0, fmt.Errorf("unknown type %q, expected kprobe, tracepoint or perf_event", kind)
+	}
+}
+
+// disabled checks whether the program is disabled in config
+func (e *Exporter) disabled(programName string) bool {
+	for _, name := range e.config.DisabledPrograms {
+		if name == programName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateConstLabels checks that constant labels of the program do not
+// collide with labels decoded from table keys of its metrics
+func validateConstLabels(program config.Program) error {
+	check := func(metric string, labels []config.Label) error {
+		for _, label := range labels {
+			if _, ok := program.ConstLabels[labelName(label)]; ok {
+				return fmt.Errorf("const label %q collides with label of metric %q in program %q", labelName(label), metric, program.Name)
+			}
+		}
+
+		return nil
+	}
+
+	for _, counter := range program.Metrics.Counters {
+		err := check(counter.Name, counterLabels(counter))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		err := check(gauge.Name, gaugeLabels(gauge))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, histogram := range program.Metrics.Histograms {
+		err := check(histogram.Name, perCPULabels(histogram.PerCPULabel, histogram.Labels))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, custom := range program.Metrics.Custom {
+		err := check(custom.Name, customLabels(custom))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, histogram := range program.Metrics.PerfHistograms {
+		labels := []config.Label{}
+		for _, label := range histogram.Labels {
+			labels = append(labels, label.Label)
+		}
+
+		err := check(histogram.Name, labels)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-// Attach injects eBPF into kernel and attaches necessary kprobes
-func (e *Exporter) Attach() error {
-	for _, program := range e.config.Programs {
-		if _, ok := e.modules[program.Name]; ok {
-			return fmt.Errorf("multiple programs with name %q", program.Name)
+// validateMetricNames checks that metrics with the same name in different
+// programs have the same type, help and label names, which prometheus
+// requires, and different const label values to tell their series apart
+func (e *Exporter) validateMetricNames() error {
+	type metric struct {
+		program     string
+		help        string
+		labels      string
+		constValues string
+	}
+
+	metrics := map[string]metric{}
+
+	var err error
+
+	add := func(programName, name, help string, labels []config.Label, constLabels map[string]string) {
+		names := []string{}
+		for _, label := range labels {
+			names = append(names, labelName(label))
+		}
+
+		constValues := []string{}
+		for constLabel, value := range constLabels {
+			names = append(names, constLabel)
+			constValues = append(constValues, fmt.Sprintf("%s=%q", constLabel, value))
+		}
+
+		// Prometheus does not care about the order of labels in descs
+		sort.Strings(names)
+		sort.Strings(constValues)
+
+		current := metric{program: programName, help: help, labels: strings.Join(names, ", "), constValues: strings.Join(constValues, ", ")}
+
+		previous, ok := metrics[name]
+		if !ok {
+			metrics[name] = current
+			return
+		}
+
+		if err != nil || previous.program == programName {
+			return
+		}
+
+		switch {
+		case previous.labels != current.labels:
+			err = fmt.Errorf("metric %q is defined in programs %q with labels [%s] and %q with labels [%s], programs can only share metrics with the same labels", name, previous.program, previous.labels, programName, current.labels)
+		case previous.help != current.help:
+			err = fmt.Errorf("metric %q is defined in programs %q with help %q and %q with help %q, programs can only share metrics with the same help", name, previous.program, previous.help, programName, current.help)
+		case previous.constValues == current.constValues:
+			err = fmt.Errorf("metric %q is defined in programs %q and %q with the same const labels {%s}, programs sharing metrics must tell their series apart with const_labels", name, previous.program, programName, current.constValues)
+		}
+	}
+
+	type metricType struct {
+		program string
+		kind    string
+	}
+
+	types := map[string]metricType{}
+
+	for _, program := range e.config.Programs {
+		if e.disabled(program.Name) {
+			continue
+		}
+
+		for name, kind := range programMetricTypes(program) {
+			previous, ok := types[name]
+			if !ok {
+				types[name] = metricType{program: program.Name, kind: kind}
+				continue
+			}
+
+			if err == nil && previous.kind != kind {
+				err = fmt.Errorf("metric %q is a %s in program %q and a %s in program %q, metrics with the same name must have the same type", name, previous.kind, previous.program, kind, program.Name)
+			}
+		}
+
+		e.programMetrics(program, add)
+
+		for _, queue := range program.Metrics.Queues {
+			add(program.Name, queue.Name, queue.Help, nil, program.ConstLabels)
+		}
+
+		for _, histogram := range program.Metrics.PerfHistograms {
+			labels := []config.Label{}
+			for _, label := range histogram.Labels {
+				labels = append(labels, label.Label)
+			}
+
+			add(program.Name, histogram.Name, histogram.Help, labels, program.ConstLabels)
+		}
+	}
+
+	return err
+}
+
+// programMetricTypes returns prometheus types of metrics of the program by their
+// names, custom metrics are left out, since their emitters pick their types
+func programMetricTypes(program config.Program) map[string]string {
+	types := map[string]string{}
+
+	for _, counter := range program.Metrics.Counters {
+		types[counter.Name] = "counter"
+		if counter.Untyped {
+			types[counter.Name] = "untyped"
+		}
+
+		if counter.ProcessRollup != nil {
+			types[counter.ProcessRollup.Name] = "counter"
+		}
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		types[gauge.Name] = "gauge"
+	}
+
+	for _, histogram := range program.Metrics.Histograms {
+		types[histogram.Name] = "histogram"
+
+		if histogram.EventsMetric {
+			types[histogramEventsMetric(histogram)] = "counter"
+		}
+
+		if histogram.TotalMetric != "" {
+			types[histogram.TotalMetric] = "counter"
+		}
+
+		if histogram.Aggregated != nil {
+			types[histogram.Aggregated.Name] = "histogram"
+		}
+	}
+
+	for _, queue := range program.Metrics.Queues {
+		types[queue.Name] = "histogram"
+	}
+
+	for _, histogram := range program.Metrics.PerfHistograms {
+		types[histogram.Name] = "histogram"
+	}
+
+	return types
+}
+
+// validateTemplates checks that templates of template decoders parse,
+// so that mistakes are found on startup rather than on scrapes
+func validateTemplates(program config.Program) error {
+	labels := map[string][]config.Label{}
+
+	for _, counter := range program.Metrics.Counters {
+		labels[counter.Name] = counter.Labels
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		labels[gauge.Name] = gauge.Labels
+	}
+
+	for _, histogram := range program.Metrics.Histograms {
+		labels[histogram.Name] = histogram.Labels
+	}
+
+	for _, custom := range program.Metrics.Custom {
+		labels[custom.Name] = custom.Labels
+	}
+
+	for _, histogram := range program.Metrics.PerfHistograms {
+		for _, label := range histogram.Labels {
+			labels[histogram.Name] = append(labels[histogram.Name], label.Label)
+		}
+	}
+
+	for metric, metricLabels := range labels {
+		for _, label := range metricLabels {
+			for _, labelDecoder := range label.Decoders {
+				if labelDecoder.Name != "template" {
+					continue
+				}
+
+				_, err := decoder.ParseTemplate(labelDecoder.Template)
+				if err != nil {
+					return fmt.Errorf("label %q of metric %q in program %q: %s", label.Name, metric, program.Name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Describe satisfies prometheus.Collector interface by sending descriptions
+// for all metrics the exporter can possibly report
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.describe(ch, e.config.Programs)
+}
+
+// describe sends descriptions for all metrics of the programs, which only
+// depend on config and not on contents of tables, so they are the same
+// for freshly attached programs with empty tables
+func (e *Exporter) describe(ch chan<- *prometheus.Desc, programs []config.Program) {
+	ch <- e.infoDesc
+	ch <- e.hashDesc
+	ch <- e.upDesc
+	ch <- e.insnDesc
+	ch <- e.warnDesc
+	ch <- e.runsDesc
+	ch <- e.timeDesc
+	ch <- e.hitsDesc
+	ch <- e.missDesc
+	ch <- e.durDesc
+	ch <- e.attsDesc
+	ch <- e.droppedDesc
+	ch <- e.errorDesc
+	ch <- e.inconsistentDesc
+	ch <- e.reattachDesc
+	ch <- e.timeoutsDesc
+	ch <- e.perfDroppedDesc
+	ch <- e.perfLostDesc
+
+	addDescs := func(programName string, name string, help string, labels []config.Label, constLabels map[string]string) {
+		if _, ok := e.descs[programName][name]; !ok {
+			labelNames := []string{}
+
+			for _, label := range labels {
+				labelNames = append(labelNames, labelName(label))
+			}
+
+			e.descs[programName][name] = prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", name), help, labelNames, constLabels)
+		}
+
+		ch <- e.descs[programName][name]
+	}
+
+	for _, program := range programs {
+		if _, ok := e.descs[program.Name]; !ok {
+			e.descs[program.Name] = map[string]*prometheus.Desc{}
+		}
+
+		e.programMetrics(program, addDescs)
+
+		for _, histogram := range e.queues[program.Name] {
+			histogram.Describe(ch)
+		}
+
+		if iters, ok := e.iters[program.Name]; ok {
+			iters.Describe(ch)
+		}
+
+		for _, histogram := range e.perfHistograms[program.Name] {
+			histogram.Describe(ch)
+		}
+	}
+}
+
+// programMetrics calls addDescs for every metric of the program that is
+// described with its own desc, along with help and labels of the metric
+func (e *Exporter) programMetrics(program config.Program, addDescs func(programName, name, help string, labels []config.Label, constLabels map[string]string)) {
+	for _, counter := range program.Metrics.Counters {
+		addDescs(program.Name, counter.Name, counter.Help, counterLabels(counter), sampleConstLabels(program.ConstLabels, counter.SampleRatio))
+
+		if counter.ProcessRollup != nil {
+			labels, _, _ := rollupLabels(counter)
+			addDescs(program.Name, counter.ProcessRollup.Name, fmt.Sprintf("%s (summed up by process)", counter.Help), labels, program.ConstLabels)
+		}
+		e.describeSchemaMismatches(addDescs, program, counter.Name, counter.Help)
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		addDescs(program.Name, gauge.Name, gaugeHelp(gauge), gaugeLabels(gauge), sampleConstLabels(program.ConstLabels, gauge.SampleRatio))
+		e.describeSchemaMismatches(addDescs, program, gauge.Name, gauge.Help)
+	}
+
+	for _, histogram := range program.Metrics.Histograms {
+		labels := histogramLabels(histogram)
+
+		addDescs(program.Name, histogram.Name, histogram.Help, histogramMetricLabels(histogram, labels), sampleConstLabels(program.ConstLabels, histogram.SampleRatio))
+		e.describeSchemaMismatches(addDescs, program, histogram.Name, histogram.Help)
+
+		if histogram.EventsMetric {
+			addDescs(program.Name, histogramEventsMetric(histogram), fmt.Sprintf("Number of events of %s", histogram.Help), labels, sampleConstLabels(program.ConstLabels, histogram.SampleRatio))
+		}
+
+		if histogram.TotalMetric != "" {
+			addDescs(program.Name, histogram.TotalMetric, fmt.Sprintf("Total of %s", histogram.Help), labels, sampleConstLabels(program.ConstLabels, histogram.SampleRatio))
+		}
+
+		if histogram.Aggregated != nil {
+			labels, _ := aggregatedHistogramLabels(histogram)
+			addDescs(program.Name, histogram.Aggregated.Name, fmt.Sprintf("Aggregate of %s", histogram.Help), histogramMetricLabels(histogram, labels), program.ConstLabels)
+		}
+	}
+
+	for _, custom := range program.Metrics.Custom {
+		addDescs(program.Name, custom.Name, custom.Help, customLabels(custom), program.ConstLabels)
+	}
+}
+
+// packedLabels adds label telling halves of packed values apart
+func packedLabels(labels []config.Label, packed *config.PackedU32) []config.Label {
+	if packed == nil {
+		return labels
+	}
+
+	return append(labels[0:len(labels):len(labels)], config.Label{Name: packed.Label})
+}
+
+// perCPULabels adds label with CPU number for metrics that
+// report values of per-CPU maps for each CPU separately
+func perCPULabels(perCPULabel string, labels []config.Label) []config.Label {
+	if perCPULabel == "" {
+		return labels
+	}
+
+	return append([]config.Label{{Name: perCPULabel}}, labels...)
+}
+
+// Collect satisfies prometeus.Collector interface and sends all metrics
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.collect(ch, e.config.Programs)
+}
+
+// collect sends all metrics of the programs
+func (e *Exporter) collect(ch chan<- prometheus.Metric, programs []config.Program) {
+	start := time.Now()
+
+	e.collectInfo(ch, programs)
+	e.collectAttachedProbes(ch, programs)
+	e.collectReattaches(ch, programs)
+	e.collectIterations(ch, programs)
+	e.collectPerfHistograms(ch, programs)
+
+	programs = e.settledPrograms(programs)
+
+	untimed := []config.Program{}
+	for _, program := range programs {
+		if program.CollectTimeout == 0 {
+			untimed = append(untimed, program)
+		}
+	}
+
+	success := e.collectMetrics(ch, untimed)
+
+	for _, program := range programs {
+		if program.CollectTimeout != 0 {
+			success = e.collectMetricsTimeout(ch, program) && success
+		}
+	}
+
+	e.collectInconsistentReads(ch, programs)
+	e.collectTimeouts(ch, programs)
+
+	e.collectDroppedSeries(ch, programs)
+	e.collectDecoderCaches(ch, programs)
+	e.collectDecoderDurations(ch, programs)
+	e.collectLastError(ch, programs, start)
+
+	up := float64(0)
+	if success {
+		up = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(e.upDesc, prometheus.GaugeValue, up)
+
+	// Tracing only happens for one scrape to avoid flooding logs
+	e.trace = nil
+}
+
+// collectMetrics sends metrics from maps of the programs
+func (e *Exporter) collectMetrics(ch chan<- prometheus.Metric, programs []config.Program) bool {
+	generations := e.readGenerations(programs)
+
+	success := e.collectCounters(ch, programs)
+	success = e.collectGauges(ch, programs) && success
+	success = e.collectHistograms(ch, programs) && success
+	success = e.collectQueues(ch, programs) && success
+	success = e.collectCustom(ch, programs) && success
+
+	e.checkGenerations(programs, generations)
+
+	return success
+}
+
+// collectInfo sends config hash, program info, instruction and run stats metrics to prometheus
+func (e *Exporter) collectInfo(ch chan<- prometheus.Metric, programs []config.Program) {
+	ch <- prometheus.MustNewConstMetric(e.hashDesc, prometheus.GaugeValue, 1, e.hash)
+
+	for _, program := range programs {
+		state := "attached"
+		if skipped, ok := e.skipped[program.Name]; ok {
+			state = skipped
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.infoDesc, prometheus.GaugeValue, 1, program.Name, state)
+
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		for function, instructions := range e.insns[program.Name] {
+			ch <- prometheus.MustNewConstMetric(e.insnDesc, prometheus.GaugeValue, float64(instructions), program.Name, function)
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.warnDesc, prometheus.CounterValue, float64(e.warnings[program.Name]), program.Name)
+
+		for function, fd := range e.fds[program.Name] {
+			info, err := functionInfo(fd)
+			if err != nil {
+				log.Printf("Error getting stats of function %q of program %q: %s", function, program.Name, err)
+				continue
+			}
+
+			ch <- prometheus.MustNewConstMetric(e.runsDesc, prometheus.CounterValue, float64(info.runCnt), program.Name, function)
+			ch <- prometheus.MustNewConstMetric(e.timeDesc, prometheus.CounterValue, float64(info.runTimeNs)/float64(time.Second), program.Name, function)
+		}
+	}
+}
+
+// collectAttachedProbes sends the number of attached probes by type to prometheus
+func (e *Exporter) collectAttachedProbes(ch chan<- prometheus.Metric, programs []config.Program) {
+	probes := e.attachedProbes(programs)
+
+	for _, probeType := range attachTypes {
+		ch <- prometheus.MustNewConstMetric(e.attsDesc, prometheus.GaugeValue, float64(probes[probeType]), probeType)
+	}
+}
+
+// collectDecoderDurations sends sampled durations of decoder calls
+// summed across all programs to prometheus
+func (e *Exporter) collectDecoderDurations(ch chan<- prometheus.Metric, programs []config.Program) {
+	stats := map[string]decoder.DurationStats{}
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		for name, decoderStats := range e.decoders[program.Name].DurationStats() {
+			stats[name] = decoder.DurationStats{
+				Count: stats[name].Count + decoderStats.Count,
+				Sum:   stats[name].Sum + decoderStats.Sum,
+			}
+		}
+	}
+
+	for name, decoderStats := range stats {
+		ch <- prometheus.MustNewConstSummary(e.durDesc, decoderStats.Count, decoderStats.Sum.Seconds(), nil, name)
+	}
+}
+
+// collectDecoderCaches sends cache hits and misses of caching decoders
+// summed across all programs to prometheus
+func (e *Exporter) collectDecoderCaches(ch chan<- prometheus.Metric, programs []config.Program) {
+	stats := map[string]decoder.CacheStats{}
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		for name, decoderStats := range e.decoders[program.Name].CacheStats() {
+			stats[name] = decoder.CacheStats{
+				Hits:   stats[name].Hits + decoderStats.Hits,
+				Misses: stats[name].Misses + decoderStats.Misses,
+			}
+		}
+	}
+
+	for name, decoderStats := range stats {
+		ch <- prometheus.MustNewConstMetric(e.hitsDesc, prometheus.CounterValue, float64(decoderStats.Hits), name)
+		ch <- prometheus.MustNewConstMetric(e.missDesc, prometheus.CounterValue, float64(decoderStats.Misses), name)
+	}
+}
+
+// collectCounters sends all known counters to prometheus
+func (e *Exporter) collectCounters(ch chan<- prometheus.Metric, programs []config.Program) bool {
+	success := true
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		for _, counter := range program.Metrics.Counters {
+			mismatches := e.schemaMismatches()
+
+			tableConfig := counterTableConfig(counter)
+			tableConfig.mismatches = mismatches
+			tableConfig.trace = e.tracing(program.Name, counter.Name)
+
+			tableValues, err := e.tableValues(program.Name, counter.Table, tableConfig)
+			if err != nil {
+				e.collectTableError(program.Name, err, "Error getting table %q values for metric %q of program %q: %s", counter.Table, counter.Name, program.Name, err)
+				success = false
+				continue
+			}
+
+			e.collectSchemaMismatches(ch, program.Name, counter.Name, mismatches)
+
+			// Divisor applies to sums the same way as to values of threads
+			divisor := counter.ValueDivisor
+			if divisor == 0 {
+				divisor = 1
+			}
+
+			// Rollups cover all threads, including ones not exported
+			if counter.ProcessRollup != nil {
+				rolled, err := e.rollupValues(tableValues, counter)
+				if err != nil {
+					e.collectError(program.Name, "Error summing up metric %q of program %q by process: %s", counter.Name, program.Name, err)
+					success = false
+				}
+
+				for _, metricValue := range rolled {
+					ch <- prometheus.MustNewConstMetric(e.descs[program.Name][counter.ProcessRollup.Name], prometheus.CounterValue, metricValue.value/divisor, metricValue.labels...)
+				}
+			}
+
+			timestamps := map[string]time.Time{}
+
+			if counter.TimestampTable != "" {
+				timestamps, err = e.tableTimestamps(program.Name, counter.TimestampTable)
+				if err != nil {
+					e.collectTableError(program.Name, err, "Error getting timestamps from table %q for metric %q of program %q: %s", counter.TimestampTable, counter.Name, program.Name, err)
+					success = false
+				}
+			}
+
+			now := time.Now()
+
+			// Stale entries linger in LRU maps until they are evicted
+			live := []metricValue{}
+			for _, metricValue := range tableValues {
+				timestamp, ok := timestamps[metricValue.raw]
+				if ok && counter.TTL > 0 && now.Sub(timestamp) > counter.TTL {
+					continue
+				}
+
+				live = append(live, metricValue)
+			}
+
+			// Idle programs have empty tables, which would leave no series at all
+			empty := len(live) == 0
+
+			tableValues = sampleSeries(live, counter.SampleRatio)
+
+			tableValues, dropped := limitSeries(tableValues, counter.MaxSeries)
+			e.dropSeries(program.Name, counter.Name, dropped)
+
+			if counter.ZeroWhenEmpty && empty {
+				tableValues = []metricValue{{labels: make([]string, len(counterLabels(counter)))}}
+			}
+
+			desc := e.descs[program.Name][counter.Name]
+
+			valueType := prometheus.CounterValue
+			if counter.Untyped {
+				valueType = prometheus.UntypedValue
+			}
+
+			for _, metricValue := range tableValues {
+				timestamp, ok := timestamps[metricValue.raw]
+
+				metric := prometheus.MustNewConstMetric(desc, valueType, metricValue.value/divisor, metricValue.labels...)
+
+				if ok {
+					metric = newMetricWithTimestamp(timestamp, metric)
+				}
+
+				ch <- metric
+			}
+		}
+	}
+
+	return success
+}
+
+// collectGauges sends all known gauges to prometheus
+func (e *Exporter) collectGauges(ch chan<- prometheus.Metric, programs []config.Program) bool {
+	success := true
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		for _, gauge := range program.Metrics.Gauges {
+			mismatches := e.schemaMismatches()
+
+			tableConfig := gaugeTableConfig(gauge)
+			tableConfig.mismatches = mismatches
+			tableConfig.trace = e.tracing(program.Name, gauge.Name)
+
+			tableValues, err := e.tableValues(program.Name, gauge.Table, tableConfig)
+			if err != nil {
+				e.collectTableError(program.Name, err, "Error getting table %q values for metric %q of program %q: %s", gauge.Table, gauge.Name, program.Name, err)
+				success = false
+				continue
+			}
+
+			e.collectSchemaMismatches(ch, program.Name, gauge.Name, mismatches)
+
+			tableValues = sampleSeries(tableValues, gauge.SampleRatio)
+
+			tableValues, dropped := limitSeries(tableValues, gauge.MaxSeries)
+			e.dropSeries(program.Name, gauge.Name, dropped)
+
+			desc := e.descs[program.Name][gauge.Name]
+
+			divisor := gauge.ValueDivisor
+			if divisor == 0 {
+				divisor = 1
+			}
+
+			for _, metricValue := range tableValues {
+				if gauge.StateSet != nil {
+					for state, name := range gauge.StateSet.States {
+						value := float64(0)
+						if uint64(metricValue.value) == state {
+							value = 1
+						}
+
+						ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append(metricValue.labels, name)...)
+					}
+
+					continue
+				}
+
+				value := metricValue.value / divisor
+				if gauge.Boolean && value != 0 {
+					value = 1
+				}
+
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, metricValue.labels...)
+			}
+		}
+	}
+
+	return success
+}
+
+// gaugeHelp returns help of the gauge, noting that values of kernel rates
+// are already rates, so that nobody applies rate() to them again
+func gaugeHelp(gauge config.Gauge) string {
+	if !gauge.KernelRate {
+		return gauge.Help
+	}
+
+	return gauge.Help + " (rate computed in the kernel, do not apply rate() to it)"
+}
+
+// counterLabels returns labels of the counter, including the packed value label
+func counterLabels(counter config.Counter) []config.Label {
+	return packedLabels(perCPULabels(counter.PerCPULabel, counter.Labels), counter.PackedU32)
+}
+
+// labelName returns the name of the label in exported metrics, which is
+// the name from config unless the label is exported under another name
+func labelName(label config.Label) string {
+	if label.ExportAs != "" {
+		return label.ExportAs
+	}
+
+	return label.Name
+}
+
+// gaugeLabels returns labels of the gauge, including the packed value
+// and the state labels
+func gaugeLabels(gauge config.Gauge) []config.Label {
+	labels := packedLabels(perCPULabels(gauge.PerCPULabel, gauge.Labels), gauge.PackedU32)
+
+	if gauge.StateSet != nil {
+		labels = append(labels[0:len(labels):len(labels)], config.Label{Name: gauge.StateSet.Label})
+	}
+
+	return labels
+}
+
+// collectHistograms sends all known historams to prometheus
+func (e *Exporter) collectHistograms(ch chan<- prometheus.Metric, programs []config.Program) bool {
+	success := true
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		for _, histogram := range program.Metrics.Histograms {
+			skip := false
+
+			histograms := map[string]histogramWithLabels{}
+
+			mismatches := e.schemaMismatches()
+
+			tableConfig := histogramTableConfig(histogram)
+			tableConfig.mismatches = mismatches
+			tableConfig.trace = e.tracing(program.Name, histogram.Name)
+
+			tableValues, err := e.tableValues(program.Name, histogram.Table, tableConfig)
+			if err != nil {
+				e.collectTableError(program.Name, err, "Error getting table %q values for metric %q of program %q: %s", histogram.Table, histogram.Name, program.Name, err)
+				success = false
+				continue
+			}
+
+			e.collectSchemaMismatches(ch, program.Name, histogram.Name, mismatches)
+
+			// Taking the last label and using int as bucket delimiter, for example:
+			//
+			// Before:
+			// * [sda, read, 1ms] -> 10
+			// * [sda, read, 2ms] -> 2
+			// * [sda, read, 4ms] -> 5
+			//
+			// After:
+			// * [sda, read] -> {1ms -> 10, 2ms -> 2, 4ms -> 5}
+			for _, metricValue := range tableValues {
+				labels := metricValue.labels[0 : len(metricValue.labels)-1]
+
+				key := fmt.Sprintf("%#v", labels)
+
+				if _, ok := histograms[key]; !ok {
+					histograms[key] = histogramWithLabels{
+						labels:  labels,
+						buckets: map[float64]uint64{},
+					}
+				}
+
+				leUint, err := strconv.ParseUint(metricValue.labels[len(metricValue.labels)-1], 0, 64)
+				if err != nil {
+					e.collectError(program.Name, "Error parsing float value for bucket %#v in table %q of program %q: %s", metricValue.labels, histogram.Table, program.Name, err)
+					success = false
+					skip = true
+					break
+				}
+
+				histograms[key].buckets[float64(leUint)] = uint64(metricValue.value)
+			}
+
+			if skip {
+				continue
+			}
+
+			// Aggregated histograms cover all series, including ones not exported
+			aggregated := map[string]histogramWithLabels{}
+			if histogram.Aggregated != nil {
+				_, positions := aggregatedHistogramLabels(histogram)
+				aggregated = aggregateHistograms(histograms, positions)
+			}
+
+			sampleHistogramSeries(histograms, histogram.SampleRatio)
+
+			e.dropSeries(program.Name, histogram.Name, limitHistogramSeries(histograms, histogram.MaxSeries))
+
+			baseKeyer, err := e.histogramKeyer(program.Name, histogram)
+			if err != nil {
+				e.collectTableError(program.Name, err, "Error making bucket keys for metric %q in program %q: %s", histogram.Name, program.Name, err)
+				success = false
+				continue
+			}
+
+			desc := e.descs[program.Name][histogram.Name]
+			labels := histogramLabels(histogram)
+
+			for _, histogramSet := range histograms {
+				keyer := multipliedKeyer(baseKeyer, bucketMultiplier(histogram, labels, histogramSet.labels))
+
+				metrics, err := histogramMetrics(desc, histogramSet, histogram, keyer)
+				if err != nil {
+					e.collectError(program.Name, "Error transforming histogram for metric %q in program %q: %s", histogram.Name, program.Name, err)
+					success = false
+					continue
+				}
+
+				for _, metric := range metrics {
+					ch <- metric
+				}
+
+				if histogram.EventsMetric {
+					count := histogramCount(histogramSet.buckets, histogram)
+					ch <- prometheus.MustNewConstMetric(e.descs[program.Name][histogramEventsMetric(histogram)], prometheus.CounterValue, count, histogramSet.labels...)
+				}
+
+				// Without a dedicated table the total is estimated from buckets
+				if histogram.TotalMetric != "" && histogram.TotalTable == "" {
+					total := histogramTotal(histogramSet.buckets, histogram, keyer)
+					ch <- prometheus.MustNewConstMetric(e.descs[program.Name][histogram.TotalMetric], prometheus.CounterValue, total, histogramSet.labels...)
+				}
+			}
+
+			aggregatedLabels := []config.Label{}
+			if histogram.Aggregated != nil {
+				aggregatedLabels, _ = aggregatedHistogramLabels(histogram)
+			}
+
+			for _, histogramSet := range aggregated {
+				keyer := multipliedKeyer(baseKeyer, bucketMultiplier(histogram, aggregatedLabels, histogramSet.labels))
+
+				metrics, err := histogramMetrics(e.descs[program.Name][histogram.Aggregated.Name], histogramSet, histogram, keyer)
+				if err != nil {
+					e.collectError(program.Name, "Error transforming histogram for metric %q in program %q: %s", histogram.Aggregated.Name, program.Name, err)
+					success = false
+					continue
+				}
+
+				for _, metric := range metrics {
+					ch <- metric
+				}
+			}
+
+			if histogram.TotalMetric != "" && histogram.TotalTable != "" {
+				success = e.collectHistogramTotalTable(ch, program, histogram) && success
+			}
+		}
+	}
+
+	return success
+}
+
+// histogramKeyer makes a keyer for the histogram, which either uses bucket type
+// or reads bucket boundaries from a table mapping bucket keys to boundaries
+func (e *Exporter) histogramKeyer(programName string, histogram config.Histogram) (histogramKeyer, error) {
+	if histogram.BoundariesTable == "" {
+		return histogramKeyerMaker(histogram)
+	}
+
+	boundaries := map[float64]float64{}
+
+	module := e.modules[programName]
+
+	table, err := moduleTable(module, histogram.BoundariesTable)
+	if err != nil {
+		return nil, err
+	}
+
+	for entry := range table.Iter() {
+		bucket, err := strconv.ParseUint(strings.Trim(entry.Key, "{}[], "), 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %q in table %q cannot be parsed as uint64: %s", entry.Key, histogram.BoundariesTable, err)
+		}
+
+		boundary, err := strconv.ParseUint(entry.Value, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("boundary %q in table %q cannot be parsed as uint64: %s", entry.Value, histogram.BoundariesTable, err)
+		}
+
+		boundaries[float64(bucket)] = float64(boundary)
+	}
+
+	// Programs usually fill boundaries once they start running
+	if len(boundaries) == 0 {
+		return nil, emptyTableError{table: histogram.BoundariesTable}
+	}
+
+	return boundariesKeyerMaker(histogram, boundaries)
+}
+
+// queueHistograms creates histograms for queues of the program, which keep
+// values popped out of queues, since they can only be read once
+func queueHistograms(program config.Program) map[string]prometheus.Histogram {
+	histograms := map[string]prometheus.Histogram{}
+
+	for _, queue := range program.Metrics.Queues {
+		buckets := queue.Buckets
+		if len(buckets) == 0 {
+			buckets = prometheus.DefBuckets
+		}
+
+		histograms[queue.Name] = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   prometheusNamespace,
+			Name:        queue.Name,
+			Help:        queue.Help,
+			ConstLabels: program.ConstLabels,
+			Buckets:     buckets,
+		})
+	}
+
+	return histograms
+}
+
+// iterationHistograms creates a histogram of durations of reading tables
+// of the program, the program is a const label, so that programs in
+// different groups are exported separately
+func iterationHistograms(program config.Program) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   prometheusNamespace,
+		Name:        "table_iteration_duration_seconds",
+		Help:        "Duration of reading all entries of tables of programs",
+		ConstLabels: prometheus.Labels{"program": program.Name},
+		Buckets:     prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"table"})
+}
+
+// observeIteration records the duration of reading a table of the program,
+// pinned tables are recorded under their path
+func (e *Exporter) observeIteration(programName, tableName, pinned string, duration time.Duration) {
+	iters, ok := e.iters[programName]
+	if !ok {
+		return
+	}
+
+	if pinned != "" {
+		tableName = pinned
+	}
+
+	iters.WithLabelValues(tableName).Observe(duration.Seconds())
+}
+
+// collectIterations sends durations of reading tables of programs to prometheus
+func (e *Exporter) collectIterations(ch chan<- prometheus.Metric, programs []config.Program) {
+	for _, program := range programs {
+		if iters, ok := e.iters[program.Name]; ok {
+			iters.Collect(ch)
+		}
+	}
+}
+
+// collectQueues drains all known queues and sends their histograms to prometheus
+func (e *Exporter) collectQueues(ch chan<- prometheus.Metric, programs []config.Program) bool {
+	success := true
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		for _, queue := range program.Metrics.Queues {
+			histogram := e.queues[program.Name][queue.Name]
+
+			values, err := drainQueue(e.modules[program.Name], queue.Table)
+			if err != nil {
+				e.collectTableError(program.Name, err, "Error draining queue %q for metric %q of program %q: %s", queue.Table, queue.Name, program.Name, err)
+				success = false
+			}
+
+			for _, value := range values {
+				histogram.Observe(float64(value))
+			}
+
+			histogram.Collect(ch)
+		}
+	}
+
+	return success
+}
+
+// collectHistogramTotalTable sends histogram total from a dedicated table
+// that has the same labels as the histogram without the bucket label
+func (e *Exporter) collectHistogramTotalTable(ch chan<- prometheus.Metric, program config.Program, histogram config.Histogram) bool {
+	tableValues, err := e.tableValues(program.Name, histogram.TotalTable, histogramTotalTableConfig(histogram))
+	if err != nil {
+		e.collectTableError(program.Name, err, "Error getting table %q values for metric %q of program %q: %s", histogram.TotalTable, histogram.TotalMetric, program.Name, err)
+		return false
+	}
+
+	desc := e.descs[program.Name][histogram.TotalMetric]
+
+	tableValues = sampleSeries(tableValues, histogram.SampleRatio)
+
+	for _, metricValue := range tableValues {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, metricValue.value, metricValue.labels...)
+	}
+
+	return true
+}
+
+func (e *Exporter) tableValues(programName string, tableName string, tableConfig tableConfig) ([]metricValue, error) {
+	values := []metricValue{}
+
+	decoders := e.decoders[programName]
+
+	labels := tableConfig.labels
+
+	var entries []bcc.Entry
+	var err error
+
+	// Fields of struct keys can contain spaces, like strings or nested arrays
+	typed := false
+	// Keys that are char arrays are strings, which are kept as a single element
+	whole := false
+	// Values with bpf_spin_lock have the lock as one of the fields of a struct
+	spinLock := -1
+
+	start := time.Now()
+
+	if tableConfig.global != "" {
+		entries, err = pinnedGlobalEntries(tableConfig.pinned, tableConfig.global)
+	} else if tableConfig.pinned != "" {
+		entries, err = pinnedTableEntries(tableConfig.pinned)
+	} else {
+		var keyDesc, leafDesc string
+
+		entries, keyDesc, leafDesc, err = e.tableReader(programName, tableName)
+
+		typed = structKey(keyDesc)
+		whole = charArrayKey(keyDesc)
+		spinLock = spinLockField(leafDesc)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tableConfig.spinLockField != nil {
+		spinLock = *tableConfig.spinLockField
+	}
+
+	e.observeIteration(programName, tableName, tableConfig.pinned, time.Since(start))
+
+	drop, err := newDropMatcher(tableConfig.dropIf, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		elements := splitPlainKey(entry.Key)
+		if typed {
+			elements = splitKey(entry.Key)
+		} else if whole {
+			elements = []string{strings.TrimSpace(entry.Key)}
+		}
+
+		if tableConfig.trace {
+			log.Printf("Trace: table %q key %q value %q elements %q", tableName, entry.Key, entry.Value, elements)
+		}
+
+		elements, err = ignoreKeyFields(elements, tableConfig.ignoreKeyFields)
+		if err != nil {
+			return nil, fmt.Errorf("key %q cannot be read: %s", entry.Key, err)
+		}
+
+		// Metrics without labels read a scalar from a single well-known key
+		if len(labels) == 0 {
+			if len(values) > 0 {
+				return nil, fmt.Errorf("table has more than one key, but we expect one for metric without labels")
+			}
+
+			elements = []string{}
+		}
+
+		if len(elements) != len(labels) {
+			if tableConfig.mismatches == nil {
+				return nil, fmt.Errorf("key %q has %d elements, but we expect %d", entry.Key, len(elements), len(labels))
+			}
+
+			cpuValues, err := readValue(entry.Value, tableConfig.valueDecoder, spinLock)
+			if err != nil {
+				return nil, fmt.Errorf("value %q for key %q cannot be read: %s", entry.Value, entry.Key, err)
+			}
+
+			value, err := aggregate(cpuValues, tableConfig.aggregation)
+			if err != nil {
+				return nil, err
+			}
+
+			*tableConfig.mismatches = append(*tableConfig.mismatches, metricValue{raw: entry.Key, value: value})
+			continue
 		}
 
-		module := bcc.NewModule(program.Code, []string{})
-		if module == nil {
-			return fmt.Errorf("error compiling module for program %q", program.Name)
+		mv := metricValue{
+			raw:    entry.Key,
+			labels: make([]string, len(labels)),
 		}
 
-		for kprobeName, targetName := range program.Kprobes {
-			target, err := module.LoadKprobe(targetName)
-			if err != nil {
-				return fmt.Errorf("failed to load target %q in program %q: %s", targetName, program.Name, err)
+		skip := false
+
+		for i, label := range labels {
+			decode := decoders.Decode
+			if tableConfig.trace {
+				decode = decoders.DecodeTrace
 			}
 
-			err = module.AttachKprobe(kprobeName, target)
+			decoded, err := decode(elements[i], label)
 			if err != nil {
-				return fmt.Errorf("failed to attach kprobe %q to %q in program %q: %s", kprobeName, targetName, program.Name, err)
+				if err == decoder.ErrSkipLabelSet {
+					skip = true
+					break
+				}
+				return nil, fmt.Errorf("error decoding %q for label %q: %s", elements[i], label.Name, err)
 			}
+
+			mv.labels[i] = decoded
 		}
 
-		for kretprobeName, targetName := range program.Kretprobes {
-			target, err := module.LoadKprobe(targetName)
-			if err != nil {
-				return fmt.Errorf("failed to load target %s in program %s: %s", targetName, program.Name, err)
+		if skip || drop.matches(mv.labels) {
+			continue
+		}
+
+		cpuValues, err := readValue(entry.Value, tableConfig.valueDecoder, spinLock)
+		if err != nil {
+			if tableConfig.onParseError == config.OnParseErrorSkip {
+				e.tableWarning(err, "Skipping value %q for key %v of table %q: %s", entry.Value, mv.labels, tableName, err)
+				continue
 			}
 
-			err = module.AttachKretprobe(kretprobeName, target)
-			if err != nil {
-				return fmt.Errorf("failed to attach kretprobe %s to %s in program %s: %s", kretprobeName, targetName, program.Name, err)
+			return nil, fmt.Errorf("value %q for key %v cannot be read: %s", entry.Value, mv.labels, err)
+		}
+
+		// Packed values make a row for each half with an additional last label
+		for _, half := range packedHalves(cpuValues, tableConfig.packedU32) {
+			rowLabels := mv.labels
+			if tableConfig.packedU32 != nil {
+				rowLabels = append(rowLabels[0:len(rowLabels):len(rowLabels)], half.label)
+			}
+
+			// Values of per-CPU tables are either aggregated or reported
+			// separately for each CPU with an additional first label
+			if tableConfig.perCPULabel == "" {
+				value, err := aggregate(half.values, tableConfig.aggregation)
+				if err != nil {
+					return nil, err
+				}
+
+				values = append(values, metricValue{raw: entry.Key, labels: rowLabels, value: value})
+				continue
+			}
+
+			for cpu, value := range half.values {
+				values = append(values, metricValue{
+					raw:    entry.Key,
+					labels: append([]string{strconv.Itoa(cpu)}, rowLabels...),
+					value:  float64(value),
+				})
 			}
 		}
+	}
 
-		e.modules[program.Name] = module
+	offset := 0
+	if tableConfig.perCPULabel != "" {
+		offset = 1
 	}
 
-	return nil
+	return limitCardinality(values, labels, offset, tableName), nil
 }
 
-// Describe satisfies prometheus.Collector interface by sending descriptions
-// for all metrics the exporter can possibly report
-func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	addDescs := func(programName string, name string, help string, labels []config.Label) {
-		if _, ok := e.descs[programName][name]; !ok {
-			labelNames := []string{}
-
-			for _, label := range labels {
-				labelNames = append(labelNames, label.Name)
+// validateMaxValues checks that max_values is only set on labels of counters
+// and histograms, since rows that become identical after stripping a label
+// are merged by summing their values, which only makes sense for counts
+func validateMaxValues(program config.Program) error {
+	check := func(what, name string, labels []config.Label) error {
+		for _, label := range labels {
+			if label.MaxValues != 0 {
+				return fmt.Errorf("%s %q in program %q has max_values on label %q, which is only supported for counters and histograms", what, name, program.Name, label.Name)
 			}
-
-			e.descs[programName][name] = prometheus.NewDesc(prometheus.BuildFQName(prometheusNamespace, "", name), help, labelNames, nil)
 		}
 
-		ch <- e.descs[programName][name]
+		return nil
 	}
 
-	for _, program := range e.config.Programs {
-		if _, ok := e.descs[program.Name]; !ok {
-			e.descs[program.Name] = map[string]*prometheus.Desc{}
+	for _, gauge := range program.Metrics.Gauges {
+		err := check("gauge", gauge.Name, gauge.Labels)
+		if err != nil {
+			return err
 		}
+	}
 
-		for _, counter := range program.Metrics.Counters {
-			addDescs(program.Name, counter.Name, counter.Help, counter.Labels)
+	for _, custom := range program.Metrics.Custom {
+		err := check("custom metric", custom.Name, custom.Labels)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, histogram := range program.Metrics.Histograms {
+		if len(histogram.Labels) == 0 {
+			continue
 		}
 
-		for _, histogram := range program.Metrics.Histograms {
-			addDescs(program.Name, histogram.Name, histogram.Help, histogram.Labels[0:len(histogram.Labels)-1])
+		bucket := histogram.Labels[len(histogram.Labels)-1]
+		if bucket.MaxValues != 0 {
+			return fmt.Errorf("histogram %q in program %q has max_values on bucket label %q", histogram.Name, program.Name, bucket.Name)
 		}
 	}
-}
 
-// Collect satisfies prometeus.Collector interface and sends all metrics
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.collectCounters(ch)
-	e.collectHistograms(ch)
+	return nil
 }
 
-// collectCounters sends all known counters to prometheus
-func (e *Exporter) collectCounters(ch chan<- prometheus.Metric) {
-	for _, program := range e.config.Programs {
-		for _, counter := range program.Metrics.Counters {
-			tableValues, err := e.tableValues(e.modules[program.Name], counter.Table, counter.Labels)
-			if err != nil {
-				log.Printf("Error getting table %q values for metric %q of program %q: %s", counter.Table, counter.Name, program.Name, err)
-				continue
+// validateZeroWhenEmpty checks that the zero series of counters with
+// emit_zero_when_empty, which has empty values of all labels, could be
+// produced by decoders of labels, so that it does not look like a row
+// that static_map or regexp decoders would never let through
+func validateZeroWhenEmpty(program config.Program) error {
+	for _, counter := range program.Metrics.Counters {
+		if !counter.ZeroWhenEmpty {
+			continue
+		}
+
+		for _, label := range counter.Labels {
+			for _, decoder := range label.Decoders {
+				switch decoder.Name {
+				case "static_map":
+					if !staticMapHasValue(decoder.StaticMap, "") {
+						return fmt.Errorf("counter %q in program %q has emit_zero_when_empty, but static_map of label %q never produces an empty value", counter.Name, program.Name, label.Name)
+					}
+				case "regexp":
+					if !regexpsMatch(decoder.Regexps, "") {
+						return fmt.Errorf("counter %q in program %q has emit_zero_when_empty, but regexps of label %q do not allow an empty value", counter.Name, program.Name, label.Name)
+					}
+				}
 			}
+		}
+	}
 
-			desc := e.descs[program.Name][counter.Name]
+	return nil
+}
 
-			for _, metricValue := range tableValues {
-				ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, metricValue.value, metricValue.labels...)
-			}
+// staticMapHasValue returns whether the value is one of values of the mapping
+func staticMapHasValue(mapping map[string]string, value string) bool {
+	for _, mapped := range mapping {
+		if mapped == value {
+			return true
 		}
 	}
+
+	return false
 }
 
-// collectHistograms sends all known historams to prometheus
-func (e *Exporter) collectHistograms(ch chan<- prometheus.Metric) {
-	for _, program := range e.config.Programs {
-		for _, histogram := range program.Metrics.Histograms {
-			skip := false
+// regexpsMatch returns whether any of regexps matches the value,
+// regexps that do not compile are reported when decoding
+func regexpsMatch(exprs []string, value string) bool {
+	for _, expr := range exprs {
+		compiled, err := regexp.Compile(expr)
+		if err == nil && compiled.MatchString(value) {
+			return true
+		}
+	}
 
-			histograms := map[string]histogramWithLabels{}
+	return false
+}
 
-			tableValues, err := e.tableValues(e.modules[program.Name], histogram.Table, histogram.Labels)
-			if err != nil {
-				log.Printf("Error getting table %q values for metric %q of program %q: %s", histogram.Table, histogram.Name, program.Name, err)
-				continue
-			}
+// readModuleTable reads entries of the table of the program along with
+// descriptions of types of its keys and values
+func (e *Exporter) readModuleTable(programName string, tableName string) ([]bcc.Entry, string, string, error) {
+	table, err := moduleTable(e.modules[programName], tableName)
+	if err != nil {
+		return nil, "", "", err
+	}
 
-			// Taking the last label and using int as bucket delimiter, for example:
-			//
-			// Before:
-			// * [sda, read, 1ms] -> 10
-			// * [sda, read, 2ms] -> 2
-			// * [sda, read, 4ms] -> 5
-			//
-			// After:
-			// * [sda, read] -> {1ms -> 10, 2ms -> 2, 4ms -> 5}
-			for _, metricValue := range tableValues {
-				labels := metricValue.labels[0 : len(metricValue.labels)-1]
+	keyDesc, _ := table.Config()["key_desc"].(string)
+	leafDesc, _ := table.Config()["leaf_desc"].(string)
 
-				key := fmt.Sprintf("%#v", labels)
+	entries, err := tableEntries(table, e.batch)
+	if err != nil {
+		return nil, "", "", err
+	}
 
-				if _, ok := histograms[key]; !ok {
-					histograms[key] = histogramWithLabels{
-						labels:  labels,
-						buckets: map[float64]uint64{},
-					}
-				}
+	return entries, keyDesc, leafDesc, nil
+}
 
-				leUint, err := strconv.ParseUint(metricValue.labels[len(metricValue.labels)-1], 0, 64)
-				if err != nil {
-					log.Printf("Error parsing float value for bucket %#v in table %q of program %q: %s", metricValue.labels, histogram.Table, program.Name, err)
-					skip = true
-					break
-				}
+// limitCardinality strips values of labels that have more distinct values
+// than allowed by max_values and merges rows that become identical,
+// offset is the number of labels before the ones decoded from the key
+func limitCardinality(values []metricValue, labels []config.Label, offset int, tableName string) []metricValue {
+	stripped := false
 
-				histograms[key].buckets[float64(leUint)] = uint64(metricValue.value)
-			}
+	for i, label := range labels {
+		if label.MaxValues == 0 {
+			continue
+		}
 
-			if skip {
-				continue
-			}
+		distinct := map[string]struct{}{}
+		for _, mv := range values {
+			distinct[mv.labels[i+offset]] = struct{}{}
+		}
 
-			desc := e.descs[program.Name][histogram.Name]
+		if len(distinct) <= label.MaxValues {
+			continue
+		}
 
-			for _, histogramSet := range histograms {
-				buckets, count, err := transformHistogram(histogramSet.buckets, histogram)
-				if err != nil {
-					log.Printf("Error transforming histogram for metric %q in program %q: %s", histogram.Name, program.Name, err)
-					continue
-				}
+		log.Printf("Stripping label %q of table %q with %d values, which is more than %d allowed", label.Name, tableName, len(distinct), label.MaxValues)
 
-				// Sum is explicitly set to zero. We only take bucket values from
-				// eBPF tables, which means we lose precision and cannot calculate
-				// average values from histograms anyway.
-				// Lack of sum also means we cannot have +Inf bucket, only some finite
-				// value bucket, eBPF programs must cap bucket values to work with this.
-				ch <- prometheus.MustNewConstHistogram(desc, count, 0, buckets, histogramSet.labels...)
-			}
+		for _, mv := range values {
+			mv.labels[i+offset] = ""
+		}
+
+		stripped = true
+	}
+
+	if !stripped {
+		return values
+	}
+
+	merged := []metricValue{}
+	indices := map[string]int{}
+
+	for _, mv := range values {
+		key := fmt.Sprintf("%#v", mv.labels)
+
+		if i, ok := indices[key]; ok {
+			merged[i].value += mv.value
+			continue
 		}
+
+		indices[key] = len(merged)
+		merged = append(merged, mv)
 	}
+
+	return merged
 }
 
-func (e *Exporter) tableValues(module *bcc.Module, tableName string, labels []config.Label) ([]metricValue, error) {
-	values := []metricValue{}
+// tableTimestamps reads timestamps from bpf_ktime_get_ns() in the table
+// and converts them to wall clock, keyed by raw keys of the table
+func (e *Exporter) tableTimestamps(programName string, tableName string) (map[string]time.Time, error) {
+	timestamps := map[string]time.Time{}
 
-	table := bcc.NewTable(module.TableId(tableName), module)
+	monotonic, err := monotonicNow()
+	if err != nil {
+		return nil, fmt.Errorf("error reading monotonic clock: %s", err)
+	}
 
-	for entry := range table.Iter() {
-		elements := strings.Fields(strings.Trim(entry.Key, "{ }"))
+	now := time.Now()
 
-		if len(elements) != len(labels) {
-			return nil, fmt.Errorf("key %q has %d elements, but we expect %d", entry.Key, len(elements), len(labels))
+	entries, _, _, err := e.tableReader(programName, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		ns, err := strconv.ParseUint(entry.Value, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("timestamp %q for key %q cannot be parsed as uint64: %s", entry.Value, entry.Key, err)
 		}
 
-		mv := metricValue{
-			raw:    entry.Key,
-			labels: make([]string, len(labels)),
+		timestamp := monotonicToWall(ns, now, monotonic)
+
+		// Timestamps from the future are not from bpf_ktime_get_ns()
+		if timestamp.After(now.Add(maxTimestampSkew)) {
+			log.Printf("Ignoring implausible timestamp %s for key %q in table %q of program %q", timestamp, entry.Key, tableName, programName)
+			continue
 		}
 
-		skip := false
+		timestamps[entry.Key] = timestamp
+	}
 
-		for i, label := range labels {
-			decoded, err := e.decoders.Decode(elements[i], label)
-			if err != nil {
-				if err == decoder.ErrSkipLabelSet {
-					skip = true
-					break
-				}
-				return nil, fmt.Errorf("error decoding %q for label %q: %s", elements[i], label.Name, err)
-			}
+	return timestamps, nil
+}
 
-			mv.labels[i] = decoded
+// aggregate reduces values of per-CPU tables into a single value
+func aggregate(values []uint64, aggregation string) (float64, error) {
+	if len(values) == 0 {
+		return 0, fmt.Errorf("no values to aggregate")
+	}
+
+	result := float64(values[0])
+
+	switch aggregation {
+	case "", config.AggregationSum, config.AggregationAvg:
+		for _, value := range values[1:] {
+			result += float64(value)
 		}
 
-		if skip {
-			continue
+		if aggregation == config.AggregationAvg {
+			result /= float64(len(values))
+		}
+	case config.AggregationMax:
+		for _, value := range values[1:] {
+			result = math.Max(result, float64(value))
 		}
+	case config.AggregationMin:
+		for _, value := range values[1:] {
+			result = math.Min(result, float64(value))
+		}
+	default:
+		return 0, fmt.Errorf("unknown aggregation: %q", aggregation)
+	}
+
+	return result, nil
+}
 
-		value, err := strconv.ParseUint(entry.Value, 0, 64)
+// parseValue parses table value, which is either a single number
+// or an array of numbers like `[ 0x1 0x2 ]` for per-CPU tables
+func parseValue(in string) ([]uint64, error) {
+	in = strings.TrimSpace(in)
+
+	if !strings.HasPrefix(in, "[") {
+		value, err := strconv.ParseUint(in, 0, 64)
 		if err != nil {
-			return nil, fmt.Errorf("value %q for key %v cannot be parsed as uint64: %s", entry.Value, mv.labels, err)
+			return nil, err
 		}
 
-		mv.value = float64(value)
+		return []uint64{value}, nil
+	}
+
+	values := []uint64{}
+
+	for _, element := range strings.Fields(strings.Trim(in, "[ ]")) {
+		value, err := strconv.ParseUint(element, 0, 64)
+		if err != nil {
+			return nil, err
+		}
 
-		values = append(values, mv)
+		values = append(values, value)
 	}
 
 	return values, nil
 }
 
-func (e Exporter) exportTables() (map[string]map[string][]metricValue, error) {
+// tablesHave returns whether any program has the table
+func tablesHave(tables map[string]map[string][]metricValue, tableName string) bool {
+	for _, programTables := range tables {
+		if _, ok := programTables[tableName]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exportTables reads values of tables of attached programs, only tables
+// with the name and of the program with the name are read if they are set
+func (e *Exporter) exportTables(programName, tableName string) (map[string]map[string][]metricValue, error) {
 	tables := map[string]map[string][]metricValue{}
 
 	for _, program := range e.config.Programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		if programName != "" && program.Name != programName {
+			continue
+		}
+
 		module := e.modules[program.Name]
 		if module == nil {
 			return nil, fmt.Errorf("module for program %q is not attached", program.Name)
@@ -266,22 +2066,48 @@ func (e Exporter) exportTables() (map[string]map[string][]metricValue, error) {
 			tables[program.Name] = map[string][]metricValue{}
 		}
 
-		metricTables := map[string][]config.Label{}
+		metricTables := map[string]tableConfig{}
 
 		for _, counter := range program.Metrics.Counters {
 			if counter.Table != "" {
-				metricTables[counter.Table] = counter.Labels
+				metricTables[counter.Table] = counterTableConfig(counter)
+			}
+
+			if counter.PinnedTable != "" {
+				metricTables[pinnedName(counter.PinnedTable, counter.Global)] = counterTableConfig(counter)
+			}
+		}
+
+		for _, gauge := range program.Metrics.Gauges {
+			if gauge.Table != "" {
+				metricTables[gauge.Table] = gaugeTableConfig(gauge)
+			}
+
+			if gauge.PinnedTable != "" {
+				metricTables[pinnedName(gauge.PinnedTable, gauge.Global)] = gaugeTableConfig(gauge)
 			}
 		}
 
+		for _, custom := range program.Metrics.Custom {
+			metricTables[custom.Table] = customTableConfig(custom)
+		}
+
 		for _, histogram := range program.Metrics.Histograms {
 			if histogram.Table != "" {
-				metricTables[histogram.Table] = histogram.Labels
+				metricTables[histogram.Table] = histogramTableConfig(histogram)
+			}
+
+			if histogram.TotalTable != "" {
+				metricTables[histogram.TotalTable] = histogramTotalTableConfig(histogram)
 			}
 		}
 
-		for name, labels := range metricTables {
-			metricValues, err := e.tableValues(e.modules[program.Name], name, labels)
+		for name, tableConfig := range metricTables {
+			if tableName != "" && name != tableName {
+				continue
+			}
+
+			metricValues, err := e.tableValues(program.Name, name, tableConfig)
 			if err != nil {
 				return nil, fmt.Errorf("error getting values for table %q of program %q", name, program.Name)
 			}
@@ -293,9 +2119,30 @@ func (e Exporter) exportTables() (map[string]map[string][]metricValue, error) {
 	return tables, nil
 }
 
-// TablesHandler is a debug handler to print raw values of kernel maps
+// TablesHandler is a debug handler to print raw values of kernel maps,
+// values that are not whole are printed with as many significant digits
+// as set in precision query parameter, the shortest exact form by default.
+// Output can be limited to one program and one table with program and table
+// query parameters, which respond with 404 if there is nothing to show.
 func (e *Exporter) TablesHandler(w http.ResponseWriter, r *http.Request) {
-	tables, err := e.exportTables()
+	precision := -1
+
+	if param := r.URL.Query().Get("precision"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Header().Add("Content-type", "text/plain")
+			fmt.Fprintf(w, "precision %q is not a positive number\n", param)
+			return
+		}
+
+		precision = parsed
+	}
+
+	programName := r.URL.Query().Get("program")
+	tableName := r.URL.Query().Get("table")
+
+	tables, err := e.exportTables(programName, tableName)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Header().Add("Content-type", "text/plain")
@@ -303,9 +2150,28 @@ func (e *Exporter) TablesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if programName != "" && tables[programName] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Header().Add("Content-type", "text/plain")
+		fmt.Fprintf(w, "program %q is not attached\n", programName)
+		return
+	}
+
+	if tableName != "" && !tablesHave(tables, tableName) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Header().Add("Content-type", "text/plain")
+		fmt.Fprintf(w, "table %q is not used by metrics of attached programs\n", tableName)
+		return
+	}
+
 	w.Header().Add("Content-type", "text/plain")
 
 	for program, tables := range tables {
+		// Programs without the table are left out when looking for it
+		if tableName != "" && len(tables) == 0 {
+			continue
+		}
+
 		fmt.Fprintf(w, "## Program: %s\n\n", program)
 
 		for name, table := range tables {
@@ -313,13 +2179,120 @@ func (e *Exporter) TablesHandler(w http.ResponseWriter, r *http.Request) {
 
 			fmt.Fprintf(w, "```\n")
 			for _, row := range table {
-				fmt.Fprintf(w, "%s (%v) -> %f\n", row.raw, row.labels, row.value)
+				fmt.Fprintf(w, "%s (%v) -> %s\n", row.raw, row.labels, formatTableValue(row.value, precision))
 			}
 			fmt.Fprintf(w, "```\n\n")
 		}
 	}
 }
 
+// formatTableValue formats whole values as integers and other values with
+// the number of significant digits, -1 means the shortest exact form
+func formatTableValue(value float64, precision int) string {
+	if value == math.Trunc(value) {
+		return strconv.FormatFloat(value, 'f', 0, 64)
+	}
+
+	return strconv.FormatFloat(value, 'g', precision, 64)
+}
+
+// tableConfig describes how to read values of a kernel map
+type tableConfig struct {
+	// labels are decoded from the key
+	labels []config.Label
+	// perCPULabel is set to report values of per-CPU maps for each CPU
+	perCPULabel string
+	// aggregation reduces values of per-CPU maps if they are not reported for each CPU
+	aggregation string
+	// valueDecoder reads the value from a byte array instead of parsing a number
+	valueDecoder *config.ValueDecoder
+	// spinLockField overrides the position of the spin lock field detected in value structs
+	spinLockField *int
+	// packedU32 splits values into two rows for lower and upper u32 halves
+	packedU32 *config.PackedU32
+	// onParseError is set to skip values that cannot be parsed instead of failing
+	onParseError string
+	// pinned is a path to a pinned map to read instead of the table of the program
+	pinned string
+	// global is a variable to read from the pinned data section map
+	global string
+	// dropIf drops rows with decoded labels matching any of the conditions
+	dropIf []config.DropIf
+	// ignoreKeyFields are positions of key fields that are not decoded into labels
+	ignoreKeyFields []int
+	// mismatches collects rows with keys not matching labels instead of failing
+	mismatches *[]metricValue
+	// trace enables logging of every decoding step
+	trace bool
+}
+
+// counterTableConfig returns how to read the table of the counter
+func counterTableConfig(counter config.Counter) tableConfig {
+	return tableConfig{
+		labels:          counter.Labels,
+		perCPULabel:     counter.PerCPULabel,
+		aggregation:     counter.Aggregation,
+		valueDecoder:    counter.ValueDecoder,
+		spinLockField:   counter.SpinLockField,
+		packedU32:       counter.PackedU32,
+		onParseError:    counter.OnParseError,
+		pinned:          counter.PinnedTable,
+		global:          counter.Global,
+		dropIf:          counter.DropIf,
+		ignoreKeyFields: counter.IgnoreKeyFields,
+	}
+}
+
+// gaugeTableConfig returns how to read the table of the gauge
+func gaugeTableConfig(gauge config.Gauge) tableConfig {
+	return tableConfig{
+		labels:          gauge.Labels,
+		perCPULabel:     gauge.PerCPULabel,
+		aggregation:     gauge.Aggregation,
+		valueDecoder:    gauge.ValueDecoder,
+		spinLockField:   gauge.SpinLockField,
+		packedU32:       gauge.PackedU32,
+		onParseError:    gauge.OnParseError,
+		pinned:          gauge.PinnedTable,
+		global:          gauge.Global,
+		dropIf:          gauge.DropIf,
+		ignoreKeyFields: gauge.IgnoreKeyFields,
+	}
+}
+
+// histogramTableConfig returns how to read the table of the histogram
+func histogramTableConfig(histogram config.Histogram) tableConfig {
+	return tableConfig{
+		labels:          histogram.Labels,
+		perCPULabel:     histogram.PerCPULabel,
+		onParseError:    histogram.OnParseError,
+		dropIf:          histogram.DropIf,
+		ignoreKeyFields: histogram.IgnoreKeyFields,
+	}
+}
+
+// histogramTotalTableConfig returns how to read the total table of the
+// histogram, which has the labels of the histogram without the bucket label
+func histogramTotalTableConfig(histogram config.Histogram) tableConfig {
+	return tableConfig{
+		labels:          histogram.Labels[0 : len(histogram.Labels)-1],
+		perCPULabel:     histogram.PerCPULabel,
+		onParseError:    histogram.OnParseError,
+		ignoreKeyFields: histogram.IgnoreKeyFields,
+	}
+}
+
+// customTableConfig returns how to read the table of the custom metric
+func customTableConfig(custom config.Custom) tableConfig {
+	return tableConfig{
+		labels:       custom.Labels,
+		perCPULabel:  custom.PerCPULabel,
+		aggregation:  custom.Aggregation,
+		valueDecoder: custom.ValueDecoder,
+		onParseError: custom.OnParseError,
+	}
+}
+
 // metricValue is a row in a kernel map
 type metricValue struct {
 	// raw is a raw key value provided by kernel
@@ -0,0 +1,398 @@
+package exporter
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/cloudflare/ebpf_exporter/decoder"
+	"github.com/iovisor/gobpf/bcc"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestExporter creates an exporter that reads the given entries instead of
+// tables of programs loaded into the kernel, as if programs were attached
+func newTestExporter(t *testing.T, cfg config.Config, tables map[string][]bcc.Entry) *Exporter {
+	e := New(cfg)
+
+	for _, program := range cfg.Programs {
+		e.decoders[program.Name] = decoder.NewSet(nil)
+	}
+
+	e.tableReader = func(programName string, tableName string) ([]bcc.Entry, string, string, error) {
+		return tables[tableName], "", "", nil
+	}
+
+	err := e.validateMetricNames()
+	if err != nil {
+		t.Fatalf("Error validating metric names: %s", err)
+	}
+
+	return e
+}
+
+// scrape collects metrics of the exporter through a registry, which fails
+// if collected metrics do not match their descriptions
+func scrape(t *testing.T, e *Exporter) map[string]*dto.MetricFamily {
+	registry := prometheus.NewPedanticRegistry()
+
+	err := registry.Register(e)
+	if err != nil {
+		t.Fatalf("Error registering exporter: %s", err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: %s", err)
+	}
+
+	scraped := map[string]*dto.MetricFamily{}
+	for _, family := range families {
+		scraped[family.GetName()] = family
+	}
+
+	if up, ok := scraped["ebpf_exporter_up"]; !ok || up.GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Fatalf("Collection was not successful: %v", scraped["ebpf_exporter_last_error"])
+	}
+
+	return scraped
+}
+
+// describedNames returns names of all metrics described by the exporter
+func describedNames(e *Exporter) map[string]bool {
+	ch := make(chan *prometheus.Desc)
+
+	go func() {
+		e.Describe(ch)
+		close(ch)
+	}()
+
+	names := map[string]bool{}
+
+	for desc := range ch {
+		// Desc has no accessor for the name, it is the first quoted string
+		name := strings.SplitN(desc.String(), "\"", 3)[1]
+		names[name] = true
+	}
+
+	return names
+}
+
+func testCountersConfig() config.Config {
+	return config.Config{
+		Programs: []config.Program{
+			{
+				Name: "bio",
+				Metrics: config.Metrics{
+					Counters: []config.Counter{
+						{
+							Name:  "bio_requests_total",
+							Help:  "Block IO requests",
+							Table: "requests",
+							Labels: []config.Label{
+								{
+									Name: "operation",
+									Decoders: []config.Decoder{
+										{Name: "uint64"},
+										{Name: "static_map", StaticMap: map[string]string{"1": "read", "2": "write"}},
+									},
+								},
+								{
+									Name:      "pid",
+									MaxValues: 2,
+									Decoders: []config.Decoder{
+										{Name: "uint64"},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestScrapeOnlyHasDeclaredMetrics(t *testing.T) {
+	e := newTestExporter(t, testCountersConfig(), map[string][]bcc.Entry{
+		"requests": {
+			{Key: "{ 0x1 0x2a }", Value: "0x5"},
+			{Key: "{ 0x2 0x2a }", Value: "0x7"},
+		},
+	})
+
+	described := describedNames(e)
+
+	for name, family := range scrape(t, e) {
+		if !described[name] {
+			t.Errorf("Metric %q is scraped, but not described", name)
+		}
+
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if strings.Contains(label.GetValue(), "0x") {
+					t.Errorf("Metric %q has raw key in label %q: %q", name, label.GetName(), label.GetValue())
+				}
+			}
+		}
+	}
+}
+
+func TestScrapeStripsLabelsOverMaxValues(t *testing.T) {
+	e := newTestExporter(t, testCountersConfig(), map[string][]bcc.Entry{
+		"requests": {
+			{Key: "{ 0x1 0x1 }", Value: "0x1"},
+			{Key: "{ 0x1 0x2 }", Value: "0x2"},
+			{Key: "{ 0x1 0x3 }", Value: "0x3"},
+			{Key: "{ 0x2 0x1 }", Value: "0x4"},
+		},
+	})
+
+	family, ok := scrape(t, e)["ebpf_exporter_bio_requests_total"]
+	if !ok {
+		t.Fatalf("Metric is missing from the scrape")
+	}
+
+	expected := map[string]float64{"read": 6, "write": 4}
+
+	if len(family.GetMetric()) != len(expected) {
+		t.Fatalf("Expected %d series, got %d: %v", len(expected), len(family.GetMetric()), family.GetMetric())
+	}
+
+	for _, metric := range family.GetMetric() {
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+
+		if labels["pid"] != "" {
+			t.Errorf("Expected pid label to be stripped, got %q", labels["pid"])
+		}
+
+		if value := metric.GetCounter().GetValue(); value != expected[labels["operation"]] {
+			t.Errorf("Expected %v for operation %q, got %v", expected[labels["operation"]], labels["operation"], value)
+		}
+	}
+}
+
+func TestMaxValuesOnlyForCounts(t *testing.T) {
+	program := config.Program{
+		Name: "bio",
+		Metrics: config.Metrics{
+			Gauges: []config.Gauge{
+				{
+					Name:   "bio_inflight",
+					Table:  "inflight",
+					Labels: []config.Label{{Name: "pid", MaxValues: 10}},
+				},
+			},
+		},
+	}
+
+	if err := validateMaxValues(program); err == nil {
+		t.Errorf("Expected max_values on gauge label to be rejected")
+	}
+
+	program.Metrics.Gauges = nil
+	program.Metrics.Histograms = []config.Histogram{
+		{
+			Name:   "bio_latency_seconds",
+			Table:  "latency",
+			Labels: []config.Label{{Name: "pid", MaxValues: 10}, {Name: "bucket"}},
+		},
+	}
+
+	if err := validateMaxValues(program); err != nil {
+		t.Errorf("Expected max_values on histogram label to be allowed: %s", err)
+	}
+}
+
+func TestEmptyTablesStillDescribeMetrics(t *testing.T) {
+	cfg := testCountersConfig()
+	cfg.Programs[0].Metrics.Gauges = []config.Gauge{
+		{
+			Name:   "bio_inflight_requests",
+			Help:   "Block IO requests in flight",
+			Table:  "inflight",
+			Labels: []config.Label{{Name: "device", Decoders: []config.Decoder{{Name: "string"}}}},
+		},
+	}
+	cfg.Programs[0].Metrics.Histograms = []config.Histogram{
+		{
+			Name:       "bio_latency_seconds",
+			Help:       "Block IO latency",
+			Table:      "latency",
+			BucketType: config.HistogramBucketExp2,
+			BucketMin:  0,
+			BucketMax:  26,
+			Labels:     []config.Label{{Name: "bucket", Decoders: []config.Decoder{{Name: "uint64"}}}},
+		},
+	}
+
+	e := newTestExporter(t, cfg, map[string][]bcc.Entry{})
+
+	described := describedNames(e)
+
+	for _, name := range []string{"ebpf_exporter_bio_requests_total", "ebpf_exporter_bio_inflight_requests", "ebpf_exporter_bio_latency_seconds"} {
+		if !described[name] {
+			t.Errorf("Metric %q is not described with empty tables", name)
+		}
+	}
+
+	scraped := scrape(t, e)
+
+	for _, name := range []string{"ebpf_exporter_bio_requests_total", "ebpf_exporter_bio_inflight_requests", "ebpf_exporter_bio_latency_seconds"} {
+		if _, ok := scraped[name]; ok {
+			t.Errorf("Metric %q has series with empty tables", name)
+		}
+	}
+}
+
+func TestSharedMetricNames(t *testing.T) {
+	counter := func(program string, constLabels map[string]string) config.Program {
+		return config.Program{
+			Name:        program,
+			ConstLabels: constLabels,
+			Metrics: config.Metrics{
+				Counters: []config.Counter{{Name: "requests_total", Help: "Requests", Table: "requests"}},
+			},
+		}
+	}
+
+	gauge := config.Program{
+		Name:        "inflight",
+		ConstLabels: map[string]string{"subsystem": "inflight"},
+		Metrics: config.Metrics{
+			Gauges: []config.Gauge{{Name: "requests_total", Help: "Requests", Table: "requests"}},
+		},
+	}
+
+	cases := []struct {
+		programs []config.Program
+		err      string
+	}{
+		{
+			programs: []config.Program{counter("bio", map[string]string{"subsystem": "bio"}), counter("nvme", map[string]string{"subsystem": "nvme"})},
+		},
+		{
+			programs: []config.Program{counter("bio", map[string]string{"subsystem": "disk"}), counter("nvme", map[string]string{"subsystem": "disk"})},
+			err:      `metric "requests_total" is defined in programs "bio" and "nvme" with the same const labels`,
+		},
+		{
+			programs: []config.Program{counter("bio", nil), counter("nvme", nil)},
+			err:      `metric "requests_total" is defined in programs "bio" and "nvme" with the same const labels`,
+		},
+		{
+			programs: []config.Program{counter("bio", map[string]string{"subsystem": "bio"}), gauge},
+			err:      `metric "requests_total" is a counter in program "bio" and a gauge in program "inflight"`,
+		},
+	}
+
+	for _, c := range cases {
+		err := New(config.Config{Programs: c.programs}).validateMetricNames()
+
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("Unexpected error: %s", err)
+		case c.err != "" && err == nil:
+			t.Errorf("Expected error %q, got none", c.err)
+		case c.err != "" && !strings.HasPrefix(err.Error(), c.err):
+			t.Errorf("Expected error %q, got %q", c.err, err)
+		}
+	}
+}
+
+func TestZeroWhenEmptyAfterTTL(t *testing.T) {
+	cfg := config.Config{
+		Programs: []config.Program{
+			{
+				Name: "bio",
+				Metrics: config.Metrics{
+					Counters: []config.Counter{
+						{
+							Name:           "bio_requests_total",
+							Help:           "Block IO requests",
+							Table:          "requests",
+							TimestampTable: "updated",
+							TTL:            time.Second,
+							ZeroWhenEmpty:  true,
+							Labels:         []config.Label{{Name: "pid", Decoders: []config.Decoder{{Name: "uint64"}}}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	monotonic, err := monotonicNow()
+	if err != nil {
+		t.Fatalf("Error reading monotonic clock: %s", err)
+	}
+
+	stale := fmt.Sprintf("0x%x", uint64(monotonic-time.Minute))
+
+	e := newTestExporter(t, cfg, map[string][]bcc.Entry{
+		"requests": {{Key: "0x2a", Value: "0x5"}},
+		"updated":  {{Key: "0x2a", Value: stale}},
+	})
+
+	describedNames(e)
+
+	family, ok := scrape(t, e)["ebpf_exporter_bio_requests_total"]
+	if !ok {
+		t.Fatalf("Metric is missing from the scrape")
+	}
+
+	if len(family.GetMetric()) != 1 {
+		t.Fatalf("Expected only the zero series, got %v", family.GetMetric())
+	}
+
+	metric := family.GetMetric()[0]
+
+	if value := metric.GetCounter().GetValue(); value != 0 {
+		t.Errorf("Expected zero series, got value %v", value)
+	}
+
+	for _, label := range metric.GetLabel() {
+		if label.GetValue() != "" {
+			t.Errorf("Expected empty label %q, got %q", label.GetName(), label.GetValue())
+		}
+	}
+}
+
+func TestZeroWhenEmptyNeedsEmptyLabelValues(t *testing.T) {
+	program := config.Program{
+		Name: "bio",
+		Metrics: config.Metrics{
+			Counters: []config.Counter{
+				{
+					Name:          "bio_requests_total",
+					Table:         "requests",
+					ZeroWhenEmpty: true,
+					Labels: []config.Label{
+						{Name: "operation", Decoders: []config.Decoder{{Name: "static_map", StaticMap: map[string]string{"1": "read"}}}},
+					},
+				},
+			},
+		},
+	}
+
+	if err := validateZeroWhenEmpty(program); err == nil {
+		t.Errorf("Expected static_map without empty value to be rejected")
+	}
+
+	program.Metrics.Counters[0].Labels[0].Decoders = []config.Decoder{{Name: "regexp", Regexps: []string{"^sd"}}}
+
+	if err := validateZeroWhenEmpty(program); err == nil {
+		t.Errorf("Expected regexp not matching empty value to be rejected")
+	}
+
+	program.Metrics.Counters[0].Labels[0].Decoders = []config.Decoder{{Name: "regexp", Regexps: []string{"^sd", "^$"}}}
+
+	if err := validateZeroWhenEmpty(program); err != nil {
+		t.Errorf("Expected regexp matching empty value to be allowed: %s", err)
+	}
+}
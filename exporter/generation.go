@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// generation is a value of the generation table of a program, which the
+// program increments before and after updating several maps together,
+// so an odd value means that an update is in progress
+type generation struct {
+	value uint64
+	ok    bool
+}
+
+// readGeneration reads the generation table of the program
+func (e *Exporter) readGeneration(program config.Program) generation {
+	values, err := e.tableValues(program.Name, program.GenerationTable, tableConfig{})
+	if err != nil {
+		e.collectTableError(program.Name, err, "Error reading generation table %q of program %q: %s", program.GenerationTable, program.Name, err)
+		return generation{}
+	}
+
+	if len(values) == 0 {
+		return generation{}
+	}
+
+	return generation{value: uint64(values[0].value), ok: true}
+}
+
+// readGenerations reads generation tables of programs before their maps are read
+func (e *Exporter) readGenerations(programs []config.Program) map[string]generation {
+	generations := map[string]generation{}
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok || program.GenerationTable == "" {
+			continue
+		}
+
+		generations[program.Name] = e.readGeneration(program)
+	}
+
+	return generations
+}
+
+// checkGenerations reads generation tables of programs again after their maps
+// are read and counts reads that overlapped with updates, in which case values
+// of related maps may come from different updates and not match each other
+func (e *Exporter) checkGenerations(programs []config.Program, generations map[string]generation) {
+	e.inconsistentLock.Lock()
+	defer e.inconsistentLock.Unlock()
+
+	for _, program := range programs {
+		before, ok := generations[program.Name]
+		if !ok || !before.ok {
+			continue
+		}
+
+		after := e.readGeneration(program)
+		if !after.ok {
+			continue
+		}
+
+		if before.value != after.value || before.value%2 == 1 {
+			e.inconsistent[program.Name]++
+		}
+	}
+}
+
+// collectInconsistentReads sends the number of inconsistent reads of programs
+// with generation tables to prometheus
+func (e *Exporter) collectInconsistentReads(ch chan<- prometheus.Metric, programs []config.Program) {
+	e.inconsistentLock.Lock()
+	defer e.inconsistentLock.Unlock()
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok || program.GenerationTable == "" {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.inconsistentDesc, prometheus.CounterValue, float64(e.inconsistent[program.Name]), program.Name)
+	}
+}
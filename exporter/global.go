@@ -0,0 +1,367 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"syscall"
+	"unsafe"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h and linux/btf.h
+const (
+	bpfBtfGetFdByID = 19
+	btfMagic        = 0xeb9f
+	btfKindVar      = 14
+	btfKindDatasec  = 15
+)
+
+// btfTrailerSizes are sizes of data following types of each kind in BTF,
+// those with per member data are multiplied by the number of members
+var btfTrailerSizes = map[uint32]struct{ fixed, member int }{
+	1:  {4, 0},  // int
+	3:  {12, 0}, // array
+	4:  {0, 12}, // struct
+	5:  {0, 12}, // union
+	6:  {0, 8},  // enum
+	13: {0, 8},  // func proto
+	14: {4, 0},  // var
+	15: {0, 12}, // datasec
+	17: {4, 0},  // decl tag
+	19: {0, 12}, // enum64
+}
+
+// bpfBtfGetAttr is the part of bpf_attr used by BPF_BTF_GET_FD_BY_ID
+type bpfBtfGetAttr struct {
+	btfID     uint32
+	nextID    uint32
+	openFlags uint32
+}
+
+// bpfBtfInfo is the beginning of struct bpf_btf_info from linux/bpf.h
+type bpfBtfInfo struct {
+	btf     uint64
+	btfSize uint32
+	id      uint32
+}
+
+// btfHeader is struct btf_header from linux/btf.h
+type btfHeader struct {
+	Magic   uint16
+	Version uint8
+	Flags   uint8
+	HdrLen  uint32
+	TypeOff uint32
+	TypeLen uint32
+	StrOff  uint32
+	StrLen  uint32
+}
+
+// globalVariable is where a global variable is in the value of its data section
+type globalVariable struct {
+	offset uint32
+	size   uint32
+}
+
+// validateGlobals checks that globals are read from pinned maps as scalars
+func validateGlobals(program config.Program) error {
+	check := func(what, name, pinned, global string, labels []config.Label) error {
+		if global == "" {
+			return nil
+		}
+
+		if pinned == "" {
+			return fmt.Errorf("%s %q in program %q has global, but no pinned_table with the data section", what, name, program.Name)
+		}
+
+		if len(labels) > 0 {
+			return fmt.Errorf("%s %q in program %q has global, which cannot have labels", what, name, program.Name)
+		}
+
+		return nil
+	}
+
+	for _, counter := range program.Metrics.Counters {
+		err := check("counter", counter.Name, counter.PinnedTable, counter.Global, counter.Labels)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		err := check("gauge", gauge.Name, gauge.PinnedTable, gauge.Global, gauge.Labels)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPinnedGlobals checks that globals exist in data sections that are
+// already pinned, sections pinned later are only checked when read,
+// which is logged, so that a typo in the path does not go unnoticed
+func checkPinnedGlobals(program config.Program) error {
+	check := func(what, name, pinned, global string) error {
+		if global == "" {
+			return nil
+		}
+
+		fd, err := pinnedMap(pinned)
+		if err != nil {
+			log.Printf("Warning: global %q of %s %q in program %q cannot be checked, it is only read once the data section is pinned: %s", global, what, name, program.Name, err)
+			return nil
+		}
+
+		defer syscall.Close(fd)
+
+		_, err = findGlobal(fd, global)
+		if err != nil {
+			return fmt.Errorf("%s %q in program %q: %s", what, name, program.Name, err)
+		}
+
+		return nil
+	}
+
+	for _, counter := range program.Metrics.Counters {
+		err := check("counter", counter.Name, counter.PinnedTable, counter.Global)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		err := check("gauge", gauge.Name, gauge.PinnedTable, gauge.Global)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pinnedName returns the name of the pinned map to list its values under,
+// globals are listed separately for each variable of the data section
+func pinnedName(path, global string) string {
+	if global == "" {
+		return path
+	}
+
+	return path + ":" + global
+}
+
+// pinnedGlobalEntries reads the global variable from the data section map
+// pinned at the path, like .bss or .data of a program loaded with libbpf,
+// as a single entry for a metric without labels
+func pinnedGlobalEntries(path string, name string) ([]bcc.Entry, error) {
+	fd, err := pinnedMap(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer syscall.Close(fd)
+
+	variable, err := findGlobal(fd, name)
+	if err != nil {
+		return nil, fmt.Errorf("pinned map %s: %s", path, err)
+	}
+
+	info, err := mapInfo(fd)
+	if err != nil {
+		return nil, fmt.Errorf("error getting info of pinned map %s: %s", path, err)
+	}
+
+	key := make([]byte, 4)
+	value := make([]byte, info.valueSize)
+
+	attr := bpfMapElemAttr{
+		mapFd: uint32(fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+
+	_, _, errno := syscall.Syscall(sysBPF, bpfMapLookupElem, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return nil, fmt.Errorf("error looking up pinned map %s: %s", path, errno)
+	}
+
+	if variable.offset+variable.size > uint32(len(value)) {
+		return nil, fmt.Errorf("global %q is out of %d bytes of pinned map %s", name, len(value), path)
+	}
+
+	return []bcc.Entry{{Key: "0x0", Value: fmt.Sprintf("0x%x", nativeUint(value[variable.offset:variable.offset+variable.size]))}}, nil
+}
+
+// findGlobal finds the integer global variable by name in BTF
+// of the data section map, which describes its value
+func findGlobal(fd int, name string) (globalVariable, error) {
+	info, err := mapInfo(fd)
+	if err != nil {
+		return globalVariable{}, fmt.Errorf("error getting map info: %s", err)
+	}
+
+	if info.mapType != bpfMapTypeArray || info.maxEntries != 1 || info.btfID == 0 {
+		return globalVariable{}, fmt.Errorf("map is not a global data section with BTF")
+	}
+
+	data, err := mapBTF(info.btfID)
+	if err != nil {
+		return globalVariable{}, fmt.Errorf("error reading BTF: %s", err)
+	}
+
+	types, strings, err := parseBTF(data)
+	if err != nil {
+		return globalVariable{}, fmt.Errorf("error parsing BTF: %s", err)
+	}
+
+	section, ok := types[info.btfValueTypeID]
+	if !ok || btfKind(section) != btfKindDatasec {
+		return globalVariable{}, fmt.Errorf("value of the map is not a data section in BTF")
+	}
+
+	for i := 0; i < btfVlen(section); i++ {
+		member := section[12+i*12:]
+
+		variable, ok := types[nativeEndian.Uint32(member)]
+		if !ok || btfKind(variable) != btfKindVar {
+			continue
+		}
+
+		if btfString(strings, nativeEndian.Uint32(variable)) != name {
+			continue
+		}
+
+		size := nativeEndian.Uint32(member[8:])
+		if !integerSize(size) {
+			return globalVariable{}, fmt.Errorf("global %q has %d bytes, only integers are supported", name, size)
+		}
+
+		return globalVariable{offset: nativeEndian.Uint32(member[4:]), size: size}, nil
+	}
+
+	return globalVariable{}, fmt.Errorf("global %q not found in BTF of the data section", name)
+}
+
+// mapBTF reads raw BTF of the map by its id
+func mapBTF(id uint32) ([]byte, error) {
+	attr := bpfBtfGetAttr{btfID: id}
+
+	fd, _, errno := syscall.Syscall(sysBPF, bpfBtfGetFdByID, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	defer syscall.Close(int(fd))
+
+	// The first call only asks for the size of BTF
+	info := bpfBtfInfo{}
+
+	err := btfInfo(int(fd), &info)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.btfSize == 0 {
+		return nil, fmt.Errorf("BTF is empty")
+	}
+
+	data := make([]byte, info.btfSize)
+	info.btf = uint64(uintptr(unsafe.Pointer(&data[0])))
+
+	err = btfInfo(int(fd), &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// btfInfo fills information about BTF from the kernel
+func btfInfo(fd int, info *bpfBtfInfo) error {
+	attr := bpfObjInfoAttr{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(unsafe.Sizeof(*info)),
+		info:    uint64(uintptr(unsafe.Pointer(info))),
+	}
+
+	_, _, errno := syscall.Syscall(sysBPF, bpfObjGetInfoByFd, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// parseBTF splits raw BTF into types by their ids, each with the trailing
+// data of its kind, and the string section that names refer to
+func parseBTF(data []byte) (map[uint32][]byte, []byte, error) {
+	header := btfHeader{}
+
+	err := binary.Read(bytes.NewReader(data), nativeEndian, &header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if header.Magic != btfMagic {
+		return nil, nil, fmt.Errorf("unexpected magic 0x%x", header.Magic)
+	}
+
+	typesStart := uint64(header.HdrLen) + uint64(header.TypeOff)
+	stringsStart := uint64(header.HdrLen) + uint64(header.StrOff)
+
+	if typesStart+uint64(header.TypeLen) > uint64(len(data)) || stringsStart+uint64(header.StrLen) > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("sections are out of %d bytes of data", len(data))
+	}
+
+	raw := data[typesStart : typesStart+uint64(header.TypeLen)]
+	types := map[uint32][]byte{}
+
+	// Type ids start with 1, the id of 0 is void
+	for id := uint32(1); len(raw) > 0; id++ {
+		if len(raw) < 12 {
+			return nil, nil, fmt.Errorf("type %d is truncated", id)
+		}
+
+		size := 12
+
+		trailer := btfTrailerSizes[btfKind(raw)]
+		size += trailer.fixed + trailer.member*btfVlen(raw)
+
+		if len(raw) < size {
+			return nil, nil, fmt.Errorf("type %d is truncated", id)
+		}
+
+		types[id] = raw[:size]
+		raw = raw[size:]
+	}
+
+	return types, data[stringsStart : stringsStart+uint64(header.StrLen)], nil
+}
+
+// btfKind returns the kind of the BTF type
+func btfKind(t []byte) uint32 {
+	return (nativeEndian.Uint32(t[4:]) >> 24) & 0x1f
+}
+
+// btfVlen returns the number of members of the BTF type
+func btfVlen(t []byte) int {
+	return int(nativeEndian.Uint32(t[4:]) & 0xffff)
+}
+
+// btfString returns the string at the offset in the string section
+func btfString(strings []byte, offset uint32) string {
+	if offset >= uint32(len(strings)) {
+		return ""
+	}
+
+	str := strings[offset:]
+	if end := bytes.IndexByte(str, 0); end != -1 {
+		str = str[:end]
+	}
+
+	return string(str)
+}
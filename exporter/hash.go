@@ -0,0 +1,22 @@
+package exporter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configHash returns a hash of the config, which is the same for the same
+// config on every node, since maps are marshaled with sorted keys
+func configHash(config config.Config) string {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[0:8])
+}
@@ -3,8 +3,11 @@ package exporter
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 
 	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type histogramWithLabels struct {
@@ -12,34 +15,337 @@ type histogramWithLabels struct {
 	buckets map[float64]uint64
 }
 
-type histogramKeyer func(bucket float64) float64
+// histogramLabels returns labels of the histogram without the bucket label
+func histogramLabels(histogram config.Histogram) []config.Label {
+	return perCPULabels(histogram.PerCPULabel, histogram.Labels[0:len(histogram.Labels)-1])
+}
 
-func histogramKeyerMaker(histogram config.Histogram) (histogramKeyer, error) {
-	multiplier := histogram.BucketMultiplier
-	if multiplier == 0 {
-		multiplier = 1
+// histogramMetricLabels returns labels of the exported histogram metric,
+// which has the bucket label if buckets are exported as separate counters
+func histogramMetricLabels(histogram config.Histogram, labels []config.Label) []config.Label {
+	if !histogram.RawBuckets {
+		return labels
+	}
+
+	return append(labels[0:len(labels):len(labels)], histogram.Labels[len(histogram.Labels)-1])
+}
+
+// histogramMetrics makes a cumulative prometheus histogram out of buckets
+// or, with raw_buckets, a counter for every bucket with its upper bound
+// in the bucket label, where each counter only has values of its bucket
+func histogramMetrics(desc *prometheus.Desc, histogramSet histogramWithLabels, histogram config.Histogram, keyer histogramKeyer) ([]prometheus.Metric, error) {
+	if !histogram.RawBuckets {
+		buckets, count, err := histogramBuckets(histogramSet.buckets, histogram, keyer)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sum is explicitly set to zero. We only take bucket values from
+		// eBPF tables, which means we lose precision and cannot calculate
+		// average values from histograms anyway, total_metric exports
+		// an estimate of the sum as a separate counter instead.
+		// Values over the top bucket are only counted in +Inf bucket with
+		// inf_bucket or overflow_bucket, otherwise eBPF programs must cap
+		// bucket values, so that they land in the top finite bucket.
+		return []prometheus.Metric{prometheus.MustNewConstHistogram(desc, count, 0, buckets, histogramSet.labels...)}, nil
+	}
+
+	metrics := []prometheus.Metric{}
+
+	// Missing buckets are backfilled the same way as for histograms
+	for _, i := range histogramSlots(histogram) {
+		bound := strconv.FormatFloat(keyer(i), 'g', -1, 64)
+		if infBucket(histogram, i) {
+			bound = "+Inf"
+		}
+
+		labels := append(histogramSet.labels[0:len(histogramSet.labels):len(histogramSet.labels)], bound)
+
+		metrics = append(metrics, prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(histogramSet.buckets[i]), labels...))
+	}
+
+	return metrics, nil
+}
+
+// aggregatedHistogramLabels returns labels kept in the aggregated histogram
+// and their positions in labels of the histogram
+func aggregatedHistogramLabels(histogram config.Histogram) ([]config.Label, []int) {
+	dropped := map[string]bool{}
+	for _, name := range histogram.Aggregated.DropLabels {
+		dropped[name] = true
+	}
+
+	labels := []config.Label{}
+	positions := []int{}
+
+	for i, label := range histogramLabels(histogram) {
+		if !dropped[label.Name] {
+			labels = append(labels, label)
+			positions = append(positions, i)
+		}
+	}
+
+	return labels, positions
+}
+
+// validateHistograms checks that raw buckets are not rebucketed, that rebucket
+// boundaries are sorted and that aggregated histograms have names and only
+// drop labels that histograms have
+func validateHistograms(program config.Program) error {
+	for _, histogram := range program.Metrics.Histograms {
+		if histogram.RawBuckets && len(histogram.RebucketBoundaries) > 0 {
+			return fmt.Errorf("histogram %q in program %q with raw_buckets cannot have rebucket_boundaries", histogram.Name, program.Name)
+		}
+
+		boundaries := histogram.RebucketBoundaries
+		for i := 1; i < len(boundaries); i++ {
+			if boundaries[i] <= boundaries[i-1] {
+				return fmt.Errorf("rebucket_boundaries of histogram %q in program %q are not sorted: %v goes after %v", histogram.Name, program.Name, boundaries[i], boundaries[i-1])
+			}
+		}
+
+		if histogram.InfBucket && histogram.OverflowBucket != nil {
+			return fmt.Errorf("histogram %q in program %q can only have one of inf_bucket and overflow_bucket", histogram.Name, program.Name)
+		}
+
+		err := validateBucketMultipliers(histogram)
+		if err != nil {
+			return fmt.Errorf("histogram %q in program %q: %s", histogram.Name, program.Name, err)
+		}
+
+		if histogram.Aggregated == nil {
+			continue
+		}
+
+		if histogram.Aggregated.Name == "" {
+			return fmt.Errorf("aggregated histogram of metric %q in program %q has no name", histogram.Name, program.Name)
+		}
+
+		if len(histogram.Aggregated.DropLabels) == 0 {
+			return fmt.Errorf("aggregated histogram %q in program %q has no labels to drop", histogram.Aggregated.Name, program.Name)
+		}
+
+		labels := map[string]bool{}
+		for _, label := range histogramLabels(histogram) {
+			labels[label.Name] = true
+		}
+
+		for _, name := range histogram.Aggregated.DropLabels {
+			if !labels[name] {
+				return fmt.Errorf("aggregated histogram %q in program %q drops label %q that metric %q does not have", histogram.Aggregated.Name, program.Name, name, histogram.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateBucketMultipliers checks that bucket multipliers are set for values
+// of a label of the histogram, which are checked against the static map
+// if the label is decoded with one, since other values are not known upfront
+func validateBucketMultipliers(histogram config.Histogram) error {
+	multipliers := histogram.BucketMultipliers
+	if multipliers == nil {
+		return nil
+	}
+
+	if len(multipliers.Values) == 0 {
+		return fmt.Errorf("bucket_multipliers have no values")
+	}
+
+	var multiplierLabel *config.Label
+
+	for _, label := range histogramLabels(histogram) {
+		if label.Name == multipliers.Label {
+			multiplierLabel = &label
+			break
+		}
+	}
+
+	if multiplierLabel == nil {
+		return fmt.Errorf("bucket_multipliers label %q is not a label of the histogram", multipliers.Label)
+	}
+
+	if histogram.Aggregated != nil {
+		for _, name := range histogram.Aggregated.DropLabels {
+			if name == multipliers.Label {
+				return fmt.Errorf("bucket_multipliers label %q cannot be dropped from aggregated histogram, buckets in different units cannot be summed", name)
+			}
+		}
+	}
+
+	for value, multiplier := range multipliers.Values {
+		if multiplier <= 0 {
+			return fmt.Errorf("bucket multiplier for label value %q is not positive", value)
+		}
+	}
+
+	decoders := multiplierLabel.Decoders
+	if len(decoders) == 0 || decoders[len(decoders)-1].Name != "static_map" {
+		return nil
+	}
+
+	known := map[string]bool{}
+	for _, value := range decoders[len(decoders)-1].StaticMap {
+		known[value] = true
+	}
+
+	for value := range multipliers.Values {
+		if !known[value] {
+			return fmt.Errorf("bucket multiplier is set for value %q, which static_map of label %q does not produce", value, multipliers.Label)
+		}
+	}
+
+	return nil
+}
+
+// aggregateHistograms sums buckets of histograms that only differ
+// in labels not present at the given positions
+func aggregateHistograms(histograms map[string]histogramWithLabels, positions []int) map[string]histogramWithLabels {
+	aggregated := map[string]histogramWithLabels{}
+
+	for _, histogram := range histograms {
+		labels := make([]string, len(positions))
+		for i, position := range positions {
+			labels[i] = histogram.labels[position]
+		}
+
+		key := fmt.Sprintf("%#v", labels)
+
+		if _, ok := aggregated[key]; !ok {
+			aggregated[key] = histogramWithLabels{
+				labels:  labels,
+				buckets: map[float64]uint64{},
+			}
+		}
+
+		for bucket, count := range histogram.buckets {
+			aggregated[key].buckets[bucket] += count
+		}
+	}
+
+	return aggregated
+}
+
+// histogramBuckets transforms raw buckets into prometheus buckets,
+// rebucketing them if target boundaries are set
+func histogramBuckets(raw map[float64]uint64, histogram config.Histogram, keyer histogramKeyer) (map[float64]uint64, uint64, error) {
+	buckets, count, err := transformHistogram(raw, histogram, keyer)
+	if err != nil {
+		return nil, 0, err
 	}
 
+	if len(histogram.RebucketBoundaries) > 0 {
+		buckets = rebucketHistogram(buckets, histogram.RebucketBoundaries)
+	}
+
+	return buckets, count, nil
+}
+
+// histogramSlots returns keys of buckets of the histogram in the order of
+// their bounds, the overflow bucket goes last wherever its key is
+func histogramSlots(histogram config.Histogram) []float64 {
+	slots := []float64{}
+
+	for i := float64(histogram.BucketMin); i <= float64(histogram.BucketMax); i++ {
+		if histogram.OverflowBucket != nil && i == float64(*histogram.OverflowBucket) {
+			continue
+		}
+
+		slots = append(slots, i)
+	}
+
+	if histogram.OverflowBucket != nil {
+		slots = append(slots, float64(*histogram.OverflowBucket))
+	}
+
+	return slots
+}
+
+// infBucket checks whether the bucket counts overflowing values, which is
+// either the overflow bucket or the top bucket with inf_bucket
+func infBucket(histogram config.Histogram, bucket float64) bool {
+	if histogram.OverflowBucket != nil {
+		return bucket == float64(*histogram.OverflowBucket)
+	}
+
+	return histogram.InfBucket && bucket == float64(histogram.BucketMax)
+}
+
+type histogramKeyer func(bucket float64) float64
+
+// histogramKeyerMaker makes a keyer for the bucket type of the histogram,
+// bucket keys are multiplied with multipliedKeyer afterwards
+func histogramKeyerMaker(histogram config.Histogram) (histogramKeyer, error) {
 	switch histogram.BucketType {
 	case config.HistogramBucketExp2:
-		return func(bucket float64) float64 {
-			return math.Exp2(bucket) * multiplier
-		}, nil
+		return math.Exp2, nil
 	case config.HistogramBucketLinear:
 		return func(bucket float64) float64 {
-			return bucket * multiplier
+			return bucket
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown histogram type: %q", histogram.BucketType)
 	}
 }
 
-func transformHistogram(buckets map[float64]uint64, histogram config.Histogram) (transformed map[float64]uint64, count uint64, err error) {
-	keyer, err := histogramKeyerMaker(histogram)
-	if err != nil {
-		return nil, 0, err
+// boundariesKeyerMaker makes a keyer that maps bucket keys to boundaries
+// read from a table, checking that they are present and sorted
+func boundariesKeyerMaker(histogram config.Histogram, boundaries map[float64]float64) (histogramKeyer, error) {
+	previous := math.NaN()
+
+	for _, i := range histogramSlots(histogram) {
+		// The overflow bucket has no boundary
+		if histogram.OverflowBucket != nil && infBucket(histogram, i) {
+			continue
+		}
+
+		if _, ok := boundaries[i]; !ok {
+			return nil, fmt.Errorf("boundary for bucket %v is missing", i)
+		}
+
+		if !math.IsNaN(previous) && boundaries[i] <= boundaries[previous] {
+			return nil, fmt.Errorf("boundaries are not sorted: bucket %v has %v, bucket %v has %v", previous, boundaries[previous], i, boundaries[i])
+		}
+
+		previous = i
+	}
+
+	return func(bucket float64) float64 {
+		return boundaries[bucket]
+	}, nil
+}
+
+// multipliedKeyer multiplies bucket keys of the keyer
+func multipliedKeyer(keyer histogramKeyer, multiplier float64) histogramKeyer {
+	return func(bucket float64) float64 {
+		return keyer(bucket) * multiplier
+	}
+}
+
+// bucketMultiplier returns the multiplier for buckets of the histogram
+// with the label values, which may be set for values of one of the labels
+func bucketMultiplier(histogram config.Histogram, labels []config.Label, values []string) float64 {
+	if histogram.BucketMultipliers != nil {
+		for i, label := range labels {
+			if label.Name != histogram.BucketMultipliers.Label {
+				continue
+			}
+
+			if multiplier, ok := histogram.BucketMultipliers.Values[values[i]]; ok {
+				return multiplier
+			}
+		}
+	}
+
+	if histogram.BucketMultiplier == 0 {
+		return 1
 	}
 
+	return histogram.BucketMultiplier
+}
+
+func transformHistogram(buckets map[float64]uint64, histogram config.Histogram, keyer histogramKeyer) (transformed map[float64]uint64, count uint64, err error) {
 	size := histogram.BucketMax - histogram.BucketMin
 	if size == 0 {
 		return nil, 0, fmt.Errorf("histogram buckets have zero size: [bucket_min .. bucket_max] = [%d .. %d]", histogram.BucketMin, histogram.BucketMax)
@@ -51,13 +357,84 @@ func transformHistogram(buckets map[float64]uint64, histogram config.Histogram)
 	// but we must provide consistent view for prometheus.
 	// This is why we build the list of possible buickets from
 	// configuration and backfill missing ones.
-	for i := float64(histogram.BucketMin); i <= float64(histogram.BucketMax); i++ {
+	for _, i := range histogramSlots(histogram) {
 		// Prometheus expects cumulative buckets with bucket being
 		// the upper limit of all values in the bucket.
 		count += buckets[i]
 
+		// Overflowing values are counted in +Inf bucket
+		if infBucket(histogram, i) {
+			transformed[math.Inf(1)] = count
+			continue
+		}
+
 		transformed[keyer(i)] = count
 	}
 
 	return
 }
+
+// rebucketHistogram turns cumulative buckets into coarser ones with the given
+// upper bounds, which are sorted on startup, each target bucket gets the count
+// of the largest source bucket not above its bound, so bounds should match
+// source bucket bounds
+func rebucketHistogram(buckets map[float64]uint64, boundaries []float64) map[float64]uint64 {
+	sources := make([]float64, 0, len(buckets))
+	for bound := range buckets {
+		sources = append(sources, bound)
+	}
+
+	sort.Float64s(sources)
+
+	rebucketed := make(map[float64]uint64, len(boundaries))
+
+	i := 0
+	count := uint64(0)
+
+	for _, boundary := range boundaries {
+		// Bounds calculated with multipliers may be off by rounding errors
+		for i < len(sources) && sources[i] <= boundary+math.Abs(boundary)*1e-9 {
+			count = buckets[sources[i]]
+			i++
+		}
+
+		rebucketed[boundary] = count
+	}
+
+	return rebucketed
+}
+
+// histogramTotal estimates the total of all values in the histogram,
+// assuming that every value is equal to the upper bound of its bucket
+func histogramTotal(buckets map[float64]uint64, histogram config.Histogram, keyer histogramKeyer) float64 {
+	total := float64(0)
+
+	for _, i := range histogramSlots(histogram) {
+		// Overflowing values have no upper bound to estimate with
+		if histogram.OverflowBucket != nil && infBucket(histogram, i) {
+			continue
+		}
+
+		total += float64(buckets[i]) * keyer(i)
+	}
+
+	return total
+}
+
+// histogramCount returns the number of events in buckets of the histogram,
+// which is the same as the count of the exported histogram
+func histogramCount(buckets map[float64]uint64, histogram config.Histogram) float64 {
+	count := uint64(0)
+
+	for _, i := range histogramSlots(histogram) {
+		count += buckets[i]
+	}
+
+	return float64(count)
+}
+
+// histogramEventsMetric returns the name of the counter of events
+// of the histogram
+func histogramEventsMetric(histogram config.Histogram) string {
+	return histogram.Name + "_events_total"
+}
@@ -0,0 +1,37 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+func TestRebucketBoundariesSorted(t *testing.T) {
+	cases := []struct {
+		boundaries []float64
+		valid      bool
+	}{
+		{boundaries: nil, valid: true},
+		{boundaries: []float64{1, 4, 16}, valid: true},
+		{boundaries: []float64{1, 16, 4}, valid: false},
+		{boundaries: []float64{1, 4, 4}, valid: false},
+	}
+
+	for _, c := range cases {
+		program := config.Program{
+			Name: "bio",
+			Metrics: config.Metrics{
+				Histograms: []config.Histogram{{Name: "bio_latency_seconds", RebucketBoundaries: c.boundaries}},
+			},
+		}
+
+		err := validateHistograms(program)
+		if c.valid && err != nil {
+			t.Errorf("Expected boundaries %v to be valid: %s", c.boundaries, err)
+		}
+
+		if !c.valid && err == nil {
+			t.Errorf("Expected boundaries %v to be rejected", c.boundaries)
+		}
+	}
+}
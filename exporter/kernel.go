@@ -0,0 +1,125 @@
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// kernelVersion is a list of numeric components of kernel release
+type kernelVersion []int
+
+// parseKernelVersion parses version like `4.14` or `5.4.0-42-generic`,
+// anything after the first non-numeric component is ignored
+func parseKernelVersion(in string) (kernelVersion, error) {
+	version := kernelVersion{}
+
+	for _, part := range strings.SplitN(in, ".", 3) {
+		end := strings.IndexFunc(part, func(r rune) bool {
+			return r < '0' || r > '9'
+		})
+
+		if end == 0 {
+			break
+		}
+
+		if end > 0 {
+			part = part[0:end]
+		}
+
+		num, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+
+		version = append(version, num)
+
+		if end > 0 {
+			break
+		}
+	}
+
+	if len(version) == 0 {
+		return nil, fmt.Errorf("no version numbers found in %q", in)
+	}
+
+	return version, nil
+}
+
+// compare compares versions up to the number of components of the other
+// version, so that `5.10.20` is considered equal to `5.10`
+func (v kernelVersion) compare(other kernelVersion) int {
+	for i := range other {
+		current := 0
+		if i < len(v) {
+			current = v[i]
+		}
+
+		if current < other[i] {
+			return -1
+		}
+
+		if current > other[i] {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// runningKernelVersion returns the version of the running kernel from uname
+func runningKernelVersion() (string, kernelVersion, error) {
+	uname := syscall.Utsname{}
+
+	err := syscall.Uname(&uname)
+	if err != nil {
+		return "", nil, err
+	}
+
+	release := make([]byte, 0, len(uname.Release))
+	for _, c := range uname.Release {
+		if c == 0 {
+			break
+		}
+
+		release = append(release, byte(c))
+	}
+
+	version, err := parseKernelVersion(string(release))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return string(release), version, nil
+}
+
+// kernelSupported checks that kernel version satisfies constraints
+// of the program, returning the reason if it does not
+func kernelSupported(kernel kernelVersion, program config.Program) (bool, string, error) {
+	if program.MinKernel != "" {
+		min, err := parseKernelVersion(program.MinKernel)
+		if err != nil {
+			return false, "", fmt.Errorf("error parsing min_kernel %q in program %q: %s", program.MinKernel, program.Name, err)
+		}
+
+		if kernel.compare(min) < 0 {
+			return false, fmt.Sprintf("kernel is older than %s", program.MinKernel), nil
+		}
+	}
+
+	if program.MaxKernel != "" {
+		max, err := parseKernelVersion(program.MaxKernel)
+		if err != nil {
+			return false, "", fmt.Errorf("error parsing max_kernel %q in program %q: %s", program.MaxKernel, program.Name, err)
+		}
+
+		if kernel.compare(max) > 0 {
+			return false, fmt.Sprintf("kernel is newer than %s", program.MaxKernel), nil
+		}
+	}
+
+	return true, "", nil
+}
@@ -0,0 +1,182 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// structKey returns whether the key type described by bcc is a struct,
+// descriptions of structs look like this, packed ones have "struct_packed":
+//
+// ["key_t",[["pid","unsigned int"],["comm","char",[16]]],"struct"]
+func structKey(keyDesc string) bool {
+	desc := []interface{}{}
+
+	err := json.Unmarshal([]byte(keyDesc), &desc)
+	if err != nil || len(desc) != 3 {
+		return false
+	}
+
+	kind, ok := desc[2].(string)
+
+	return ok && strings.HasPrefix(kind, "struct")
+}
+
+// charArrayKey returns whether the key type described by bcc is an array
+// of chars, which is a string and must not be split, for example:
+//
+// ["char",[32]]
+func charArrayKey(keyDesc string) bool {
+	desc := []interface{}{}
+
+	err := json.Unmarshal([]byte(keyDesc), &desc)
+	if err != nil || len(desc) != 2 {
+		return false
+	}
+
+	kind, ok := desc[0].(string)
+	if !ok || !strings.HasSuffix(kind, "char") {
+		return false
+	}
+
+	_, ok = desc[1].([]interface{})
+
+	return ok
+}
+
+// splitPlainKey splits key that is not a struct into elements, tolerating
+// differences in how versions of bcc render keys, which may be wrapped
+// in braces or brackets and have elements separated by commas, for example:
+//
+// { 0x1 0x2 } -> ["0x1", "0x2"]
+// [ 0x1, 0x2 ] -> ["0x1", "0x2"]
+func splitPlainKey(key string) []string {
+	return strings.FieldsFunc(key, func(c rune) bool {
+		return strings.ContainsRune("{}[], \t\n", c)
+	})
+}
+
+// splitKey splits struct key rendered by bcc into fields, keeping quoted
+// strings and nested arrays and structs as single elements, for example:
+//
+// { "kworker/0:1" 0x1 [ 0x1 0x2 ] } -> ["\"kworker/0:1\"", "0x1", "[ 0x1 0x2 ]"]
+func splitKey(key string) []string {
+	key = strings.TrimSpace(key)
+	key = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(key, "{"), "}"))
+
+	elements := []string{}
+
+	depth := 0
+	quoted := false
+	escaped := false
+	start := -1
+
+	for i, c := range key {
+		if start == -1 {
+			if c == ' ' {
+				continue
+			}
+
+			start = i
+		}
+
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		case c == ' ' && depth == 0:
+			elements = append(elements, key[start:i])
+			start = -1
+		}
+	}
+
+	if start != -1 {
+		elements = append(elements, key[start:])
+	}
+
+	return elements
+}
+
+// ignoreKeyFields removes fields at ignored positions from the key,
+// which allows keys to have fields that are not exported as labels
+func ignoreKeyFields(elements []string, ignored []int) ([]string, error) {
+	if len(ignored) == 0 {
+		return elements, nil
+	}
+
+	skip := map[int]bool{}
+
+	for _, position := range ignored {
+		if position >= len(elements) {
+			return nil, fmt.Errorf("ignored key field %d is out of %d elements", position, len(elements))
+		}
+
+		skip[position] = true
+	}
+
+	kept := []string{}
+
+	for i, element := range elements {
+		if !skip[i] {
+			kept = append(kept, element)
+		}
+	}
+
+	return kept, nil
+}
+
+// validateIgnoredKeyFields checks that ignored key fields of metrics
+// are valid distinct positions
+func validateIgnoredKeyFields(program config.Program) error {
+	check := func(metric string, ignored []int) error {
+		seen := map[int]bool{}
+
+		for _, position := range ignored {
+			if position < 0 {
+				return fmt.Errorf("ignored key field %d of metric %q in program %q is negative", position, metric, program.Name)
+			}
+
+			if seen[position] {
+				return fmt.Errorf("ignored key field %d of metric %q in program %q is repeated", position, metric, program.Name)
+			}
+
+			seen[position] = true
+		}
+
+		return nil
+	}
+
+	for _, counter := range program.Metrics.Counters {
+		err := check(counter.Name, counter.IgnoreKeyFields)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		err := check(gauge.Name, gauge.IgnoreKeyFields)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, histogram := range program.Metrics.Histograms {
+		err := check(histogram.Name, histogram.IgnoreKeyFields)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package exporter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+func TestCharArrayKey(t *testing.T) {
+	cases := map[string]bool{
+		`["char",[32]]`:          true,
+		`["unsigned char",[32]]`: true,
+		`"char"`:                 false,
+		`"unsigned int"`:         false,
+		`["unsigned int",[4]]`:   false,
+		`["key_t",[["pid","unsigned int"],["comm","char",[16]]],"struct"]`: false,
+	}
+
+	for desc, expected := range cases {
+		if charArrayKey(desc) != expected {
+			t.Errorf("Expected %v for %s, got %v", expected, desc, !expected)
+		}
+	}
+}
+
+func TestCharArrayKeysAreSingleLabels(t *testing.T) {
+	cfg := config.Config{
+		Programs: []config.Program{
+			{
+				Name: "files",
+				Metrics: config.Metrics{
+					Counters: []config.Counter{
+						{
+							Name:   "file_opens_total",
+							Help:   "File opens",
+							Table:  "opens",
+							Labels: []config.Label{{Name: "filename", Decoders: []config.Decoder{{Name: "string"}}}},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		keyDesc string
+		key     string
+		label   string
+	}{
+		// Signed char arrays are rendered as quoted strings
+		{keyDesc: `["char",[32]]`, key: `"my file.txt"`, label: "my file.txt"},
+		// Unsigned char arrays are rendered as bytes, up to the first NUL
+		{keyDesc: `["unsigned char",[32]]`, key: "[ 0x61 0x20 0x62 0x0 0x63 0x0 ]", label: "a b"},
+		// Invalid UTF-8 is replaced, since prometheus rejects it
+		{keyDesc: `["unsigned char",[32]]`, key: "[ 0x61 0xff 0x62 0x0 ]", label: "a�b"},
+	}
+
+	for _, c := range cases {
+		e := newTestExporter(t, cfg, nil)
+
+		e.tableReader = func(programName string, tableName string) ([]bcc.Entry, string, string, error) {
+			return []bcc.Entry{{Key: c.key, Value: "0x1"}}, c.keyDesc, `"unsigned long long"`, nil
+		}
+
+		values, err := e.tableValues("files", "opens", counterTableConfig(cfg.Programs[0].Metrics.Counters[0]))
+		if err != nil {
+			t.Errorf("Error reading key %s with %s: %s", c.key, c.keyDesc, err)
+			continue
+		}
+
+		if len(values) != 1 || len(values[0].labels) != 1 || values[0].labels[0] != c.label {
+			t.Errorf("Expected label %q for key %s, got %v", c.label, c.key, values)
+		}
+	}
+}
+
+func TestSplitPlainKey(t *testing.T) {
+	cases := []struct {
+		key      string
+		elements []string
+	}{
+		{key: "0x1", elements: []string{"0x1"}},
+		{key: "{ 0x1 0x2 }", elements: []string{"0x1", "0x2"}},
+		{key: "[ 0x1 0x2 ]", elements: []string{"0x1", "0x2"}},
+		{key: "[ 0x1, 0x2 ]", elements: []string{"0x1", "0x2"}},
+		{key: "{0x1,0x2}", elements: []string{"0x1", "0x2"}},
+		{key: "  {  0x1 \t 0x2  }  ", elements: []string{"0x1", "0x2"}},
+		{key: "{ 0x1,, 0x2, }", elements: []string{"0x1", "0x2"}},
+		{key: "{ }", elements: []string{}},
+	}
+
+	for _, c := range cases {
+		elements := splitPlainKey(c.key)
+		if len(elements) == 0 && len(c.elements) == 0 {
+			continue
+		}
+
+		if !reflect.DeepEqual(elements, c.elements) {
+			t.Errorf("Expected %q for %q, got %q", c.elements, c.key, elements)
+		}
+	}
+}
+
+func TestSplitKey(t *testing.T) {
+	cases := []struct {
+		key      string
+		elements []string
+	}{
+		{key: "{ 0x1 0x2 }", elements: []string{"0x1", "0x2"}},
+		{key: "{0x1 0x2}", elements: []string{"0x1", "0x2"}},
+		{key: "  {   0x1    0x2   }  ", elements: []string{"0x1", "0x2"}},
+		{key: `{ "kworker/0:1" 0x1 }`, elements: []string{`"kworker/0:1"`, "0x1"}},
+		{key: `{ "with space" 0x1 }`, elements: []string{`"with space"`, "0x1"}},
+		{key: `{ "with \" quote" 0x1 }`, elements: []string{`"with \" quote"`, "0x1"}},
+		{key: "{ 0x1 [ 0x1 0x2 ] }", elements: []string{"0x1", "[ 0x1 0x2 ]"}},
+		{key: "{ 0x1 { 0x2 [ 0x3 ] } }", elements: []string{"0x1", "{ 0x2 [ 0x3 ] }"}},
+		{key: "{ [ ] 0x1 }", elements: []string{"[ ]", "0x1"}},
+		{key: "{ }", elements: []string{}},
+	}
+
+	for _, c := range cases {
+		elements := splitKey(c.key)
+
+		if !reflect.DeepEqual(elements, c.elements) {
+			t.Errorf("Expected %q for %q, got %q", c.elements, c.key, elements)
+		}
+	}
+}
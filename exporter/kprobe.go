@@ -0,0 +1,217 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// kprobePMUPath is where the kernel describes the kprobe PMU, which allows
+// creating kprobes with perf_event_open, it is available since Linux 4.17
+const kprobePMUPath = "/sys/bus/event_source/devices/kprobe"
+
+// kprobeEvents counts kprobe events created through tracefs to name them
+var kprobeEvents uint64
+
+// kprobeLink is a kprobe or kretprobe with a function attached to it, which
+// is detached by closing its perf event, kprobes created through tracefs
+// on older kernels also have an event that has to be removed
+type kprobeLink struct {
+	fd    int
+	event string
+}
+
+// kprobeLinks are attached kprobes and kretprobes of a program
+// by kind, kernel function and target
+type kprobeLinks map[string]kprobeLink
+
+// kprobeLinkKey returns the key of the probe of the kind in links
+func kprobeLinkKey(kind string, probe config.Probe) string {
+	return kind + ":" + probe.Probe + ":" + probe.Target
+}
+
+// attachKprobes attaches targets to kernel functions as kprobes or kretprobes,
+// every target gets a perf event of its own, so that the same kernel function
+// can have several targets, attached probes are added to the links
+func attachKprobes(module *bcc.Module, probes config.Probes, kind string, links kprobeLinks) (int, error) {
+	for _, probe := range probes {
+		key := kprobeLinkKey(kind, probe)
+
+		if _, ok := links[key]; ok {
+			return 0, fmt.Errorf("%s %q has target %q more than once", kind, probe.Probe, probe.Target)
+		}
+
+		target, err := loadFunction(module, probe.Target, bpfProgTypeKprobe)
+		if err != nil {
+			return 0, fmt.Errorf("failed to load target %q: %s", probe.Target, err)
+		}
+
+		link, err := attachKprobe(probe.Probe, kind == "kretprobe", target)
+		if err != nil {
+			return 0, fmt.Errorf("failed to attach %s %q to %q: %s", kind, probe.Probe, probe.Target, err)
+		}
+
+		links[key] = link
+	}
+
+	return len(probes), nil
+}
+
+// attachKprobe creates a kprobe or kretprobe on the kernel function with
+// the kprobe PMU and attaches the loaded function to it, kernels without
+// the kprobe PMU get the kprobe created through tracefs instead
+func attachKprobe(function string, retprobe bool, target int) (kprobeLink, error) {
+	pmuType, err := readSysfsNumber(filepath.Join(kprobePMUPath, "type"))
+	if os.IsNotExist(err) {
+		return attachKprobeEvent(function, retprobe, target)
+	}
+
+	if err != nil {
+		return kprobeLink{}, fmt.Errorf("error reading kprobe PMU type: %s", err)
+	}
+
+	attr := perfEventAttr{
+		eventType:    uint32(pmuType),
+		samplePeriod: 1,
+		wakeupEvents: 1,
+	}
+
+	if retprobe {
+		bit, err := kprobeRetprobeBit()
+		if err != nil {
+			return kprobeLink{}, fmt.Errorf("error reading kretprobe config bit: %s", err)
+		}
+
+		attr.config = 1 << bit
+	}
+
+	// The function name is passed as a pointer to a string, the offset is zero
+	name := append([]byte(function), 0)
+	attr.config1 = uint64(uintptr(unsafe.Pointer(&name[0])))
+	attr.size = uint32(unsafe.Sizeof(attr))
+
+	fd, err := openKprobePerfEvent(&attr, target)
+
+	runtime.KeepAlive(name)
+
+	if err != nil {
+		return kprobeLink{}, err
+	}
+
+	return kprobeLink{fd: fd}, nil
+}
+
+// attachKprobeEvent creates a kprobe or kretprobe on the kernel function
+// through kprobe_events in tracefs and attaches the loaded function to it
+func attachKprobeEvent(function string, retprobe bool, target int) (kprobeLink, error) {
+	prefix := "p"
+	if retprobe {
+		prefix = "r"
+	}
+
+	event := fmt.Sprintf("ebpf_exporter_%d_%d", os.Getpid(), atomic.AddUint64(&kprobeEvents, 1))
+
+	err := writeKprobeEvents(fmt.Sprintf("%s:kprobes/%s %s", prefix, event, function))
+	if err != nil {
+		return kprobeLink{}, fmt.Errorf("error creating kprobe event: %s", err)
+	}
+
+	id, err := readSysfsNumber(filepath.Join(tracingEventsPath, "kprobes", event, "id"))
+	if err != nil {
+		writeKprobeEvents("-:kprobes/" + event)
+		return kprobeLink{}, fmt.Errorf("error reading kprobe event id: %s", err)
+	}
+
+	attr := perfEventAttr{
+		eventType:    perfTypeTracepoint,
+		config:       id,
+		samplePeriod: 1,
+		wakeupEvents: 1,
+	}
+
+	attr.size = uint32(unsafe.Sizeof(attr))
+
+	fd, err := openKprobePerfEvent(&attr, target)
+	if err != nil {
+		writeKprobeEvents("-:kprobes/" + event)
+		return kprobeLink{}, err
+	}
+
+	return kprobeLink{fd: fd, event: event}, nil
+}
+
+// openKprobePerfEvent opens the perf event of the kprobe and attaches
+// the loaded function to it, kprobes fire on every cpu, even if
+// the event is opened on one
+func openKprobePerfEvent(attr *perfEventAttr, target int) (int, error) {
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(attr)), ^uintptr(0), 0, ^uintptr(0), perfFlagFdCloexec, 0)
+	if errno != 0 {
+		return -1, fmt.Errorf("error opening perf event: %s", errno)
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, perfEventIocSetBPF, uintptr(target))
+	if errno != 0 {
+		syscall.Close(int(fd))
+		return -1, fmt.Errorf("error attaching program to perf event: %s", errno)
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, perfEventIocEnable, 0)
+	if errno != 0 {
+		syscall.Close(int(fd))
+		return -1, fmt.Errorf("error enabling perf event: %s", errno)
+	}
+
+	return int(fd), nil
+}
+
+// kprobeRetprobeBit returns the bit of config of the kprobe PMU
+// that makes a kretprobe, it is described like "config:0"
+func kprobeRetprobeBit() (uint64, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(kprobePMUPath, "format", "retprobe"))
+	if err != nil {
+		return 0, err
+	}
+
+	format := strings.TrimSpace(string(contents))
+	if !strings.HasPrefix(format, "config:") {
+		return 0, fmt.Errorf("unexpected format %q", format)
+	}
+
+	return strconv.ParseUint(strings.TrimPrefix(format, "config:"), 10, 6)
+}
+
+// writeKprobeEvents adds or removes a kprobe event in tracefs
+func writeKprobeEvents(command string) error {
+	file, err := os.OpenFile(filepath.Join(filepath.Dir(tracingEventsPath), "kprobe_events"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(command + "\n")
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// readSysfsNumber reads a decimal number from the file
+func readSysfsNumber(path string) (uint64, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+}
@@ -0,0 +1,182 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"unsafe"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h
+const (
+	bpfObjGetInfoByFd = 15
+	bpfProgTypeKprobe = 2
+	bpfMaxInsns       = 4096
+	bpfInsnSize       = 8
+	verifierLogLevel  = 1
+)
+
+// instructionsWarningRatio is the share of the verifier limit, after which
+// the program is considered fragile and a warning is logged
+const instructionsWarningRatio = 0.75
+
+// bpfObjInfoAttr is the part of bpf_attr used by BPF_OBJ_GET_INFO_BY_FD
+type bpfObjInfoAttr struct {
+	bpfFd   uint32
+	infoLen uint32
+	info    uint64
+}
+
+// bpfProgInfo is struct bpf_prog_info from linux/bpf.h up to run_cnt,
+// older kernels fill only the fields they know about
+type bpfProgInfo struct {
+	progType             uint32
+	id                   uint32
+	tag                  [8]byte
+	jitedProgLen         uint32
+	xlatedProgLen        uint32
+	jitedProgInsns       uint64
+	xlatedProgInsns      uint64
+	loadTime             uint64
+	createdByUID         uint32
+	nrMapIDs             uint32
+	mapIDs               uint64
+	name                 [16]byte
+	ifindex              uint32
+	gplCompatible        uint32
+	netnsDev             uint64
+	netnsIno             uint64
+	nrJitedKsyms         uint32
+	nrJitedFuncLens      uint32
+	jitedKsyms           uint64
+	jitedFuncLens        uint64
+	btfID                uint32
+	funcInfoRecSize      uint32
+	funcInfo             uint64
+	nrFuncInfo           uint32
+	nrLineInfo           uint32
+	lineInfo             uint64
+	jitedLineInfo        uint64
+	nrJitedLineInfo      uint32
+	lineInfoRecSize      uint32
+	jitedLineInfoRecSize uint32
+	nrProgTags           uint32
+	progTags             uint64
+	runTimeNs            uint64
+	runCnt               uint64
+}
+
+// loadFunction loads the function of the program, if the verifier rejects
+// the function, it is loaded again with verifier log enabled to put the log
+// into the error
+func loadFunction(module *bcc.Module, name string, progType int) (int, error) {
+	fd, err := module.Load(name, progType, 0, 0)
+	if err == nil {
+		return fd, nil
+	}
+
+	logText, logErr := verifierLog(module, name, progType)
+	if logErr != nil {
+		return -1, fmt.Errorf("%s, error getting verifier log: %s", err, logErr)
+	}
+
+	return -1, fmt.Errorf("%s, verifier log:\n%s", err, logText)
+}
+
+// programFunctions returns names of all functions the program loads
+func programFunctions(program config.Program) []string {
+	functions := []string{}
+
+	for _, progArray := range program.ProgArrays {
+		for _, entry := range progArray.Entries {
+			functions = append(functions, entry.Function)
+		}
+	}
+
+	for _, probes := range []config.Probes{program.Kprobes, program.Kretprobes, program.TracepointsGlob} {
+		for _, probe := range probes {
+			functions = append(functions, probe.Target)
+		}
+	}
+
+	for _, perfEvent := range program.PerfEvents {
+		functions = append(functions, perfEvent.Target)
+	}
+
+	for _, cgroupProgram := range program.CgroupPrograms {
+		functions = append(functions, cgroupProgram.Target)
+	}
+
+	return functions
+}
+
+// functionDescriptors returns file descriptors of all loaded functions of the program
+func functionDescriptors(module *bcc.Module, program config.Program) map[string]int {
+	fds := map[string]int{}
+
+	for _, function := range programFunctions(program) {
+		if _, ok := fds[function]; ok {
+			continue
+		}
+
+		// The function is already loaded at this point, so program type
+		// is ignored and the same file descriptor is returned
+		fd, err := module.Load(function, bpfProgTypeKprobe, 0, 0)
+		if err != nil {
+			log.Printf("Error getting function %q of program %q: %s", function, program.Name, err)
+			continue
+		}
+
+		fds[function] = fd
+	}
+
+	return fds
+}
+
+// programInstructions returns the number of instructions in every loaded
+// function of the program and how many of them are close to the verifier limit
+func programInstructions(programName string, fds map[string]int) (map[string]int, int) {
+	instructions := map[string]int{}
+	warnings := 0
+
+	for function, fd := range fds {
+		info, err := functionInfo(fd)
+		if err != nil {
+			log.Printf("Error getting instructions of function %q of program %q: %s", function, programName, err)
+			continue
+		}
+
+		// Instruction count is after the function was rewritten by the verifier
+		count := int(info.xlatedProgLen / bpfInsnSize)
+
+		instructions[function] = count
+
+		if float64(count) > bpfMaxInsns*instructionsWarningRatio {
+			log.Printf("Warning: function %q of program %q has %d instructions, which is close to the verifier limit of %d", function, programName, count, bpfMaxInsns)
+			warnings++
+		}
+	}
+
+	return instructions, warnings
+}
+
+// functionInfo returns information about the loaded function from the kernel
+func functionInfo(fd int) (bpfProgInfo, error) {
+	info := bpfProgInfo{}
+
+	attr := bpfObjInfoAttr{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(unsafe.Sizeof(info)),
+		info:    uint64(uintptr(unsafe.Pointer(&info))),
+	}
+
+	_, _, errno := syscall.Syscall(sysBPF, bpfObjGetInfoByFd, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return info, fmt.Errorf("error getting program info: %s", errno)
+	}
+
+	return info, nil
+}
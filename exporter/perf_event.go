@@ -0,0 +1,273 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h
+// and linux/perf_event.h
+const (
+	bpfProgTypePerfEvent = 7
+	perfTypeHardware     = 0
+	perfTypeSoftware     = 1
+	perfAttrFlagInherit  = 1 << 1
+	perfAttrFlagFreq     = 1 << 10
+)
+
+// allProcesses is the pid to open perf events for all processes with
+const allProcesses = -1
+
+// perfEventConfig is the type and the config of a perf event
+type perfEventConfig struct {
+	eventType uint32
+	config    uint64
+}
+
+// perfEvents are events that can be sampled, named the same way as in perf
+var perfEvents = map[string]perfEventConfig{
+	"cpu-cycles":          {perfTypeHardware, 0},
+	"instructions":        {perfTypeHardware, 1},
+	"cache-references":    {perfTypeHardware, 2},
+	"cache-misses":        {perfTypeHardware, 3},
+	"branch-instructions": {perfTypeHardware, 4},
+	"branch-misses":       {perfTypeHardware, 5},
+	"cpu-clock":           {perfTypeSoftware, 0},
+	"task-clock":          {perfTypeSoftware, 1},
+	"page-faults":         {perfTypeSoftware, 2},
+	"context-switches":    {perfTypeSoftware, 3},
+	"cpu-migrations":      {perfTypeSoftware, 4},
+}
+
+// attachPerfEvent opens the perf event on every CPU or on the listed CPUs
+// for every thread of target processes and attaches the target function
+// to it, returning the number of opened events
+func attachPerfEvent(module *bcc.Module, perfEvent config.PerfEvent) (int, error) {
+	event, ok := perfEvents[perfEvent.Event]
+	if !ok {
+		return 0, fmt.Errorf("unknown perf event %q", perfEvent.Event)
+	}
+
+	if (perfEvent.SamplePeriod == 0) == (perfEvent.SampleFrequency == 0) {
+		return 0, fmt.Errorf("perf event %q needs either sample_period or sample_frequency", perfEvent.Event)
+	}
+
+	threads, err := perfEventThreads(perfEvent)
+	if err != nil {
+		return 0, fmt.Errorf("invalid process of perf event %q: %s", perfEvent.Event, err)
+	}
+
+	cpus, err := perfEventCPUs(perfEvent.CPUs)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cpus of perf event %q: %s", perfEvent.Event, err)
+	}
+
+	// Events of processes follow them across CPUs, unless CPUs are listed
+	if threads[0] != allProcesses && len(perfEvent.CPUs) == 0 {
+		cpus = []int{-1}
+	}
+
+	target, err := loadFunction(module, perfEvent.Target, bpfProgTypePerfEvent)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load target %q: %s", perfEvent.Target, err)
+	}
+
+	attr := perfEventAttr{
+		eventType:    event.eventType,
+		config:       event.config,
+		samplePeriod: perfEvent.SamplePeriod,
+	}
+
+	if perfEvent.SampleFrequency != 0 {
+		attr.samplePeriod = perfEvent.SampleFrequency
+		attr.flags = perfAttrFlagFreq
+	}
+
+	// Threads started by target processes after attaching are sampled too
+	if threads[0] != allProcesses {
+		attr.flags |= perfAttrFlagInherit
+	}
+
+	attr.size = uint32(unsafe.Sizeof(attr))
+
+	for _, thread := range threads {
+		for _, cpu := range cpus {
+			err = attachPerfEventCPU(&attr, thread, cpu, target)
+			if err != nil {
+				return 0, fmt.Errorf("failed to attach perf event %q to %q on cpu %d for thread %d: %s", perfEvent.Event, perfEvent.Target, cpu, thread, err)
+			}
+		}
+	}
+
+	return len(threads) * len(cpus), nil
+}
+
+// perfEventThreads returns threads of processes the perf event is opened for,
+// which is allProcesses if no process is set in config
+func perfEventThreads(perfEvent config.PerfEvent) ([]int, error) {
+	set := 0
+	for _, isSet := range []bool{perfEvent.PID > 0, perfEvent.ProcessName != "", perfEvent.PIDFile != ""} {
+		if isSet {
+			set++
+		}
+	}
+
+	if set > 1 {
+		return nil, fmt.Errorf("only one of pid, process_name and pid_file can be set")
+	}
+
+	pids := []int{}
+
+	switch {
+	case perfEvent.PID > 0:
+		pids = append(pids, perfEvent.PID)
+	case perfEvent.ProcessName != "":
+		named, err := processesByName(perfEvent.ProcessName)
+		if err != nil {
+			return nil, err
+		}
+
+		pids = append(pids, named...)
+	case perfEvent.PIDFile != "":
+		pid, err := readPIDFile(perfEvent.PIDFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pids = append(pids, pid)
+	default:
+		return []int{allProcesses}, nil
+	}
+
+	threads := []int{}
+
+	for _, pid := range pids {
+		tasks, err := ioutil.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+		if err != nil {
+			return nil, fmt.Errorf("error listing threads of process %d: %s", pid, err)
+		}
+
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil {
+				continue
+			}
+
+			threads = append(threads, tid)
+		}
+	}
+
+	return threads, nil
+}
+
+// processesByName returns pids of processes with the name in /proc/<pid>/comm,
+// which is truncated by the kernel to 15 characters
+func processesByName(name string) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+		if err != nil {
+			// The process has exited since /proc was listed
+			continue
+		}
+
+		if strings.TrimSpace(string(comm)) == name {
+			pids = append(pids, pid)
+		}
+	}
+
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no processes named %q", name)
+	}
+
+	return pids, nil
+}
+
+// readPIDFile reads the pid from the pid file
+func readPIDFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("pid file %s does not have a pid", path)
+	}
+
+	return pid, nil
+}
+
+// perfEventCPUs returns the listed CPUs after checking that they exist,
+// or all CPUs if none are listed
+func perfEventCPUs(listed []int) ([]int, error) {
+	count := runtime.NumCPU()
+
+	if len(listed) == 0 {
+		cpus := make([]int, count)
+		for i := range cpus {
+			cpus[i] = i
+		}
+
+		return cpus, nil
+	}
+
+	seen := map[int]bool{}
+
+	for _, cpu := range listed {
+		if cpu < 0 || cpu >= count {
+			return nil, fmt.Errorf("cpu %d is out of %d cpus", cpu, count)
+		}
+
+		if seen[cpu] {
+			return nil, fmt.Errorf("cpu %d is listed more than once", cpu)
+		}
+
+		seen[cpu] = true
+	}
+
+	return listed, nil
+}
+
+// attachPerfEventCPU opens the perf event for the thread or for all processes
+// on the cpu, or on any cpu if it is -1, and attaches the loaded function
+// to it, the event stays open until exit
+func attachPerfEventCPU(attr *perfEventAttr, thread int, cpu int, target int) error {
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(attr)), uintptr(thread), uintptr(cpu), ^uintptr(0), perfFlagFdCloexec, 0)
+	if errno != 0 {
+		return fmt.Errorf("error opening perf event: %s", errno)
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, perfEventIocSetBPF, uintptr(target))
+	if errno != 0 {
+		syscall.Close(int(fd))
+		return fmt.Errorf("error attaching program to perf event: %s", errno)
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, perfEventIocEnable, 0)
+	if errno != 0 {
+		syscall.Close(int(fd))
+		return fmt.Errorf("error enabling perf event: %s", errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/cloudflare/ebpf_exporter/decoder"
+	"github.com/iovisor/gobpf/bcc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// perfSamplesBuffer is how many samples can wait to be bucketed
+const perfSamplesBuffer = 1024
+
+// validatePerfHistograms checks that fields of samples of perf histograms
+// have known types and that buckets are sorted
+func validatePerfHistograms(program config.Program) error {
+	for _, histogram := range program.Metrics.PerfHistograms {
+		if !sort.Float64sAreSorted(histogram.Buckets) {
+			return fmt.Errorf("buckets of perf histogram %q in program %q are not sorted", histogram.Name, program.Name)
+		}
+
+		_, err := valueSize(histogram.Value.Type)
+		if err != nil {
+			return fmt.Errorf("value of perf histogram %q in program %q: %s", histogram.Name, program.Name, err)
+		}
+
+		for _, label := range histogram.Labels {
+			if label.Field.Type == config.ValueTypeString && label.Field.Size > 0 {
+				continue
+			}
+
+			_, err = valueSize(label.Field.Type)
+			if err != nil {
+				return fmt.Errorf("label %q of perf histogram %q in program %q: %s, strings also need size", label.Name, histogram.Name, program.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// perfHistogramLabels returns names of labels of the perf histogram
+func perfHistogramLabels(histogram config.PerfHistogram) []string {
+	names := make([]string, len(histogram.Labels))
+	for i, label := range histogram.Labels {
+		names[i] = labelName(label.Label)
+	}
+
+	return names
+}
+
+// attachPerfHistograms opens perf buffers of perf histograms of the program
+// and starts bucketing samples from them in the background
+func (e *Exporter) attachPerfHistograms(module *bcc.Module, program config.Program) error {
+	e.perfHistograms[program.Name] = map[string]*prometheus.HistogramVec{}
+
+	for _, histogram := range program.Metrics.PerfHistograms {
+		table, err := moduleTable(module, histogram.Table)
+		if err != nil {
+			return err
+		}
+
+		samples := make(chan []byte, perfSamplesBuffer)
+
+		fd := table.Config()["fd"].(int)
+
+		info, err := mapInfo(fd)
+		if err != nil {
+			return fmt.Errorf("failed to get info of table %q for metric %q: %s", histogram.Table, histogram.Name, err)
+		}
+
+		var start func()
+
+		if info.mapType == bpfMapTypeRingbuf {
+			ring, err := openRingBuffer(fd, info.maxEntries)
+			if err != nil {
+				return fmt.Errorf("failed to open ring buffer %q for metric %q: %s", histogram.Table, histogram.Name, err)
+			}
+
+			programName, metricName := program.Name, histogram.Name
+
+			start = func() {
+				go ring.poll(samples, func() { e.loseSample(programName, metricName) })
+			}
+		} else {
+			perfMap, err := bcc.InitPerfMap(table, samples)
+			if err != nil {
+				return fmt.Errorf("failed to open perf buffer %q for metric %q: %s", histogram.Table, histogram.Name, err)
+			}
+
+			start = perfMap.Start
+		}
+
+		buckets := histogram.Buckets
+		if len(buckets) == 0 {
+			buckets = prometheus.DefBuckets
+		}
+
+		vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   prometheusNamespace,
+			Name:        histogram.Name,
+			Help:        histogram.Help,
+			ConstLabels: program.ConstLabels,
+			Buckets:     buckets,
+		}, perfHistogramLabels(histogram))
+
+		e.perfHistograms[program.Name][histogram.Name] = vec
+
+		// Decoders are not safe for concurrent use, so every reader gets its own
+		go e.readSamples(program.Name, histogram, samples, vec, e.decoderSet(module))
+
+		start()
+	}
+
+	return nil
+}
+
+// readSamples observes values of samples in the histogram with labels
+// decoded from samples, samples that cannot be decoded are dropped
+func (e *Exporter) readSamples(programName string, histogram config.PerfHistogram, samples <-chan []byte, vec *prometheus.HistogramVec, decoders *decoder.Set) {
+	divisor := histogram.ValueDivisor
+	if divisor == 0 {
+		divisor = 1
+	}
+
+	for sample := range samples {
+		labels, value, err := decodeSample(sample, histogram, decoders)
+		if err == decoder.ErrSkipLabelSet {
+			continue
+		}
+
+		if err != nil {
+			e.dropSample(programName, histogram.Name, err)
+			continue
+		}
+
+		vec.WithLabelValues(labels...).Observe(float64(value) / divisor)
+	}
+}
+
+// decodeSample reads the value of the sample and decodes its labels
+func decodeSample(sample []byte, histogram config.PerfHistogram, decoders *decoder.Set) ([]string, uint64, error) {
+	value, err := sampleInt(sample, histogram.Value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading value: %s", err)
+	}
+
+	labels := make([]string, len(histogram.Labels))
+
+	for i, label := range histogram.Labels {
+		field, err := sampleField(sample, label.Field)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading label %q: %s", label.Name, err)
+		}
+
+		labels[i], err = decoders.Decode(field, label.Label)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return labels, value, nil
+}
+
+// sampleInt reads an integer field of the sample in host byte order
+func sampleInt(sample []byte, field config.SampleField) (uint64, error) {
+	size, err := valueSize(field.Type)
+	if err != nil {
+		return 0, err
+	}
+
+	if field.Offset < 0 || field.Offset+size > len(sample) {
+		return 0, fmt.Errorf("%s at offset %d is out of %d bytes of sample", field.Type, field.Offset, len(sample))
+	}
+
+	return nativeUint(sample[field.Offset : field.Offset+size]), nil
+}
+
+// sampleField renders the field of the sample the way bcc renders keys,
+// integers as hex and strings in quotes, so that decoders work the same
+func sampleField(sample []byte, field config.SampleField) (string, error) {
+	if field.Type != config.ValueTypeString {
+		value, err := sampleInt(sample, field)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("0x%x", value), nil
+	}
+
+	if field.Offset < 0 || field.Offset+field.Size > len(sample) {
+		return "", fmt.Errorf("string of %d bytes at offset %d is out of %d bytes of sample", field.Size, field.Offset, len(sample))
+	}
+
+	str := sample[field.Offset : field.Offset+field.Size]
+	if end := bytes.IndexByte(str, 0); end != -1 {
+		str = str[0:end]
+	}
+
+	return `"` + string(str) + `"`, nil
+}
+
+// dropSample counts the sample that could not be decoded, only the first
+// error of each metric is logged, since samples keep coming
+func (e *Exporter) dropSample(programName, metricName string, err error) {
+	e.perfDroppedLock.Lock()
+	defer e.perfDroppedLock.Unlock()
+
+	if _, ok := e.perfDropped[programName]; !ok {
+		e.perfDropped[programName] = map[string]int{}
+	}
+
+	if e.perfDropped[programName][metricName] == 0 {
+		log.Printf("Error decoding sample for metric %q of program %q, further errors are only counted: %s", metricName, programName, err)
+	}
+
+	e.perfDropped[programName][metricName]++
+}
+
+// loseSample counts the sample from a ring buffer that did not fit
+// into the queue of samples waiting to be bucketed
+func (e *Exporter) loseSample(programName, metricName string) {
+	e.perfDroppedLock.Lock()
+	defer e.perfDroppedLock.Unlock()
+
+	if _, ok := e.perfLost[programName]; !ok {
+		e.perfLost[programName] = map[string]int{}
+	}
+
+	e.perfLost[programName][metricName]++
+}
+
+// collectPerfHistograms sends perf histograms and the number
+// of dropped and lost samples to prometheus
+func (e *Exporter) collectPerfHistograms(ch chan<- prometheus.Metric, programs []config.Program) {
+	e.perfDroppedLock.Lock()
+	dropped := copyCounts(e.perfDropped)
+	lost := copyCounts(e.perfLost)
+	e.perfDroppedLock.Unlock()
+
+	for _, program := range programs {
+		for _, histogram := range program.Metrics.PerfHistograms {
+			vec, ok := e.perfHistograms[program.Name][histogram.Name]
+			if !ok {
+				continue
+			}
+
+			vec.Collect(ch)
+
+			ch <- prometheus.MustNewConstMetric(e.perfDroppedDesc, prometheus.CounterValue, float64(dropped[program.Name][histogram.Name]), program.Name, histogram.Name)
+			ch <- prometheus.MustNewConstMetric(e.perfLostDesc, prometheus.CounterValue, float64(lost[program.Name][histogram.Name]), program.Name, histogram.Name)
+		}
+	}
+}
+
+// copyCounts copies counts of metrics of programs
+func copyCounts(counts map[string]map[string]int) map[string]map[string]int {
+	copied := map[string]map[string]int{}
+
+	for programName, metrics := range counts {
+		copied[programName] = map[string]int{}
+		for metricName, count := range metrics {
+			copied[programName][metricName] = count
+		}
+	}
+
+	return copied
+}
@@ -0,0 +1,160 @@
+package exporter
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h
+const (
+	bpfMapLookupElem              = 1
+	bpfMapGetNextKey              = 4
+	bpfObjGet                     = 7
+	bpfMapTypeArray               = 2
+	bpfMapTypePercpuHash          = 5
+	bpfMapTypePercpuArray         = 6
+	bpfMapTypeLRUPercpuHash       = 10
+	bpfMapTypePercpuCgroupStorage = 20
+)
+
+// bpfObjGetAttr is the part of bpf_attr used by BPF_OBJ_GET
+type bpfObjGetAttr struct {
+	pathname  uint64
+	bpfFd     uint32
+	fileFlags uint32
+}
+
+// bpfMapInfo is struct bpf_map_info from linux/bpf.h up to btf_value_type_id,
+// older kernels fill only the fields they know about
+type bpfMapInfo struct {
+	mapType               uint32
+	id                    uint32
+	keySize               uint32
+	valueSize             uint32
+	maxEntries            uint32
+	mapFlags              uint32
+	name                  [16]byte
+	ifindex               uint32
+	btfVmlinuxValueTypeID uint32
+	netnsDev              uint64
+	netnsIno              uint64
+	btfID                 uint32
+	btfKeyTypeID          uint32
+	btfValueTypeID        uint32
+}
+
+// mapInfo returns information about the map from the kernel
+func mapInfo(fd int) (bpfMapInfo, error) {
+	info := bpfMapInfo{}
+
+	attr := bpfObjInfoAttr{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(unsafe.Sizeof(info)),
+		info:    uint64(uintptr(unsafe.Pointer(&info))),
+	}
+
+	_, _, errno := syscall.Syscall(sysBPF, bpfObjGetInfoByFd, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return info, errno
+	}
+
+	return info, nil
+}
+
+// pinnedTableEntries reads all entries of the map pinned at the path, which
+// can be created by any program. There is no type information for pinned maps,
+// so only integer keys and values are supported and rendered like bcc does it
+func pinnedTableEntries(path string) ([]bcc.Entry, error) {
+	fd, err := pinnedMap(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer syscall.Close(fd)
+
+	info, err := mapInfo(fd)
+	if err != nil {
+		return nil, fmt.Errorf("error getting info of pinned map %s: %s", path, err)
+	}
+
+	switch info.mapType {
+	case bpfMapTypePercpuHash, bpfMapTypePercpuArray, bpfMapTypeLRUPercpuHash, bpfMapTypePercpuCgroupStorage:
+		return nil, fmt.Errorf("pinned map %s is per-CPU, which is not supported", path)
+	}
+
+	if !integerSize(info.keySize) || !integerSize(info.valueSize) {
+		return nil, fmt.Errorf("pinned map %s has %d byte keys and %d byte values, only integers are supported", path, info.keySize, info.valueSize)
+	}
+
+	key := make([]byte, info.keySize)
+	nextKey := make([]byte, info.keySize)
+	value := make([]byte, info.valueSize)
+
+	entries := []bcc.Entry{}
+
+	for first := true; ; first = false {
+		// No key means that the first key of the map is returned
+		attr := bpfMapElemAttr{
+			mapFd: uint32(fd),
+			value: uint64(uintptr(unsafe.Pointer(&nextKey[0]))),
+		}
+
+		if !first {
+			attr.key = uint64(uintptr(unsafe.Pointer(&key[0])))
+		}
+
+		_, _, errno := syscall.Syscall(sysBPF, bpfMapGetNextKey, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+		if errno == syscall.ENOENT {
+			return entries, nil
+		}
+
+		if errno != 0 {
+			return nil, fmt.Errorf("error iterating pinned map %s: %s", path, errno)
+		}
+
+		copy(key, nextKey)
+
+		attr = bpfMapElemAttr{
+			mapFd: uint32(fd),
+			key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+			value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+		}
+
+		_, _, errno = syscall.Syscall(sysBPF, bpfMapLookupElem, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+		if errno == syscall.ENOENT {
+			// The key was deleted while we were iterating
+			continue
+		}
+
+		if errno != 0 {
+			return nil, fmt.Errorf("error looking up pinned map %s: %s", path, errno)
+		}
+
+		entries = append(entries, bcc.Entry{
+			Key:   fmt.Sprintf("0x%x", nativeUint(key)),
+			Value: fmt.Sprintf("0x%x", nativeUint(value)),
+		})
+	}
+}
+
+// pinnedMap opens the map pinned at the path
+func pinnedMap(path string) (int, error) {
+	pathname := append([]byte(path), 0)
+
+	attr := bpfObjGetAttr{pathname: uint64(uintptr(unsafe.Pointer(&pathname[0])))}
+
+	fd, _, errno := syscall.Syscall(sysBPF, bpfObjGet, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return -1, fmt.Errorf("error opening pinned map %s: %s", path, errno)
+	}
+
+	return int(fd), nil
+}
+
+// integerSize returns whether the size in bytes is a size of an integer
+func integerSize(size uint32) bool {
+	return size == 1 || size == 2 || size == 4 || size == 8
+}
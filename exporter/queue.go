@@ -0,0 +1,63 @@
+package exporter
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// This is missing from syscall package, value is from linux/bpf.h
+const bpfMapLookupAndDeleteElem = 21
+
+// bpfMapElemAttr is the part of bpf_attr used by map element commands
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// drainQueue pops all values out of BPF_MAP_TYPE_QUEUE or BPF_MAP_TYPE_STACK
+// table, which means that every value is only read once
+func drainQueue(module *bcc.Module, tableName string) ([]uint64, error) {
+	table, err := moduleTable(module, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	tableConfig := table.Config()
+
+	fd := tableConfig["fd"].(int)
+	size := tableConfig["leaf_size"].(uint64)
+
+	if size != 1 && size != 2 && size != 4 && size != 8 {
+		return nil, fmt.Errorf("value size %d is not supported, expected an integer", size)
+	}
+
+	values := []uint64{}
+	value := make([]byte, size)
+
+	for {
+		// Queues and stacks have no keys
+		attr := bpfMapElemAttr{
+			mapFd: uint32(fd),
+			value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+		}
+
+		_, _, errno := syscall.Syscall(sysBPF, bpfMapLookupAndDeleteElem, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+		if errno == syscall.ENOENT {
+			break
+		}
+
+		if errno != 0 {
+			return values, fmt.Errorf("error popping value: %s", errno)
+		}
+
+		values = append(values, nativeUint(value))
+	}
+
+	return values, nil
+}
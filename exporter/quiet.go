@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// emptyTableError is returned when a table that needs entries has none,
+// which is expected until the program fills it with data
+type emptyTableError struct {
+	table string
+}
+
+// Error satisfies error interface
+func (e emptyTableError) Error() string {
+	return fmt.Sprintf("table %q is empty", e.table)
+}
+
+// QuietPeriod makes errors reading tables during the period after attach
+// logged only with debug logs, since maps may still be warming up
+func (e *Exporter) QuietPeriod(period time.Duration) {
+	e.quietPeriod = period
+}
+
+// QuietEmptyTables makes errors about empty tables logged only with debug logs
+func (e *Exporter) QuietEmptyTables() {
+	e.quietEmpty = true
+}
+
+// DebugLogs enables logging of errors that are demoted to debug level
+func (e *Exporter) DebugLogs() {
+	e.debugLogs = true
+}
+
+// quietError returns whether the error reading a table is demoted to debug
+func (e *Exporter) quietError(err error) bool {
+	if _, ok := err.(emptyTableError); ok && e.quietEmpty {
+		return true
+	}
+
+	return time.Since(e.attachAt) < e.quietPeriod
+}
+
+// collectTableError is collectError for errors reading tables, which are
+// only logged at debug level if they are expected, it is still kept
+// as the last error of the program either way
+func (e *Exporter) collectTableError(programName string, err error, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+
+	if !e.quietError(err) {
+		log.Print(message)
+	} else if e.debugLogs {
+		log.Printf("Debug: %s", message)
+	}
+
+	e.keepError(programName, message)
+}
+
+// tableWarning logs a warning about contents of a table, which is
+// demoted to debug level the same way as errors reading tables
+func (e *Exporter) tableWarning(err error, format string, args ...interface{}) {
+	if !e.quietError(err) {
+		log.Printf(format, args...)
+	} else if e.debugLogs {
+		log.Printf("Debug: "+format, args...)
+	}
+}
@@ -0,0 +1,230 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	procModules  = "/proc/modules"
+	procKallsyms = "/proc/kallsyms"
+)
+
+// WatchKernelModules polls loaded kernel modules at the interval and
+// reattaches kprobes and kretprobes of programs to functions of modules
+// that were loaded again, since unloading a module silently detaches
+// probes from its functions. It never returns, so it should run in
+// a goroutine after Attach.
+func (e *Exporter) WatchKernelModules(interval time.Duration) {
+	loaded, err := loadedKernelModules()
+	if err != nil {
+		log.Printf("Error reading loaded kernel modules, not watching them: %s", err)
+		return
+	}
+
+	for range time.Tick(interval) {
+		current, err := loadedKernelModules()
+		if err != nil {
+			log.Printf("Error reading loaded kernel modules: %s", err)
+			continue
+		}
+
+		reloaded := map[string]bool{}
+		for name, address := range current {
+			if previous, ok := loaded[name]; !ok || previous != address {
+				reloaded[name] = true
+			}
+		}
+
+		loaded = current
+
+		if len(reloaded) == 0 {
+			continue
+		}
+
+		err = e.reattachKprobes(reloaded)
+		if err != nil {
+			log.Printf("Error reattaching kprobes after kernel modules were loaded: %s", err)
+		}
+	}
+}
+
+// loadedKernelModules returns load addresses of live kernel modules, a module
+// that was unloaded and loaded again between checks usually gets a different
+// address, unless addresses are hidden from the exporter by kptr_restrict
+func loadedKernelModules() (map[string]string, error) {
+	file, err := os.Open(procModules)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	modules := map[string]string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines look like "name size refcount deps state address"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[4] != "Live" {
+			continue
+		}
+
+		modules[fields[0]] = fields[5]
+	}
+
+	return modules, scanner.Err()
+}
+
+// kernelModuleFunctions returns names of functions in the kernel modules
+func kernelModuleFunctions(modules map[string]bool) (map[string]bool, error) {
+	file, err := os.Open(procKallsyms)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	functions := map[string]bool{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Lines of module symbols look like "address type name [module]"
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !modules[strings.Trim(fields[3], "[]")] {
+			continue
+		}
+
+		functions[fields[2]] = true
+	}
+
+	return functions, scanner.Err()
+}
+
+// probesOfFunctions returns probes attached to any of the functions
+func probesOfFunctions(probes config.Probes, functions map[string]bool) config.Probes {
+	matching := config.Probes{}
+
+	for _, probe := range probes {
+		if functions[probe.Probe] {
+			matching = append(matching, probe)
+		}
+	}
+
+	return matching
+}
+
+// reattachKprobes detaches and attaches again kprobes and kretprobes
+// of attached programs on functions of the reloaded kernel modules
+func (e *Exporter) reattachKprobes(reloaded map[string]bool) error {
+	functions, err := kernelModuleFunctions(reloaded)
+	if err != nil {
+		return fmt.Errorf("error reading functions of kernel modules: %s", err)
+	}
+
+	for _, program := range e.config.Programs {
+		module, ok := e.modules[program.Name]
+		if !ok {
+			continue
+		}
+
+		kprobes := probesOfFunctions(program.Kprobes, functions)
+		kretprobes := probesOfFunctions(program.Kretprobes, functions)
+
+		if len(kprobes) == 0 && len(kretprobes) == 0 {
+			continue
+		}
+
+		log.Printf("Reattaching %d kprobes and %d kretprobes of program %q", len(kprobes), len(kretprobes), program.Name)
+
+		for kind, probes := range map[string]config.Probes{"kprobe": kprobes, "kretprobe": kretprobes} {
+			err = detachKprobes(e.kprobes[program.Name], probes, kind)
+			if err != nil {
+				log.Printf("Error detaching %ss of program %q, attaching anyway: %s", kind, program.Name, err)
+			}
+		}
+
+		_, err = attachKprobes(module, kprobes, "kprobe", e.kprobes[program.Name])
+		if err != nil {
+			return fmt.Errorf("failed to reattach kprobes in program %q: %s", program.Name, err)
+		}
+
+		_, err = attachKprobes(module, kretprobes, "kretprobe", e.kprobes[program.Name])
+		if err != nil {
+			return fmt.Errorf("failed to reattach kretprobes in program %q: %s", program.Name, err)
+		}
+
+		e.reattachLock.Lock()
+		e.reattached[program.Name]++
+		e.reattachLock.Unlock()
+	}
+
+	return nil
+}
+
+// detachKprobes detaches kprobes or kretprobes attached by attachKprobes
+// and removes them from the links. It keeps going after failures and returns
+// the first one, so that as many as possible probes can be attached again
+func detachKprobes(links kprobeLinks, probes config.Probes, kind string) error {
+	var failed error
+
+	for _, probe := range probes {
+		key := kprobeLinkKey(kind, probe)
+
+		link, ok := links[key]
+		if !ok {
+			continue
+		}
+
+		delete(links, key)
+
+		err := detachKprobe(link)
+		if err != nil && failed == nil {
+			failed = fmt.Errorf("failed to detach %s %q from %q: %s", kind, probe.Probe, probe.Target, err)
+		}
+	}
+
+	return failed
+}
+
+// detachKprobe closes the perf event of the kprobe, which detaches
+// the function, and removes the kprobe event if there is one
+func detachKprobe(link kprobeLink) error {
+	err := syscall.Close(link.fd)
+	if err != nil {
+		return fmt.Errorf("error closing perf event: %s", err)
+	}
+
+	if link.event == "" {
+		return nil
+	}
+
+	err = writeKprobeEvents("-:kprobes/" + link.event)
+	if err != nil {
+		return fmt.Errorf("error removing kprobe event: %s", err)
+	}
+
+	return nil
+}
+
+// collectReattaches sends the number of reattaches of programs to prometheus
+func (e *Exporter) collectReattaches(ch chan<- prometheus.Metric, programs []config.Program) {
+	e.reattachLock.Lock()
+	defer e.reattachLock.Unlock()
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.reattachDesc, prometheus.CounterValue, float64(e.reattached[program.Name]), program.Name)
+	}
+}
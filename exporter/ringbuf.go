@@ -0,0 +1,142 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h
+const (
+	bpfMapTypeRingbuf    = 27
+	bpfRingbufBusyBit    = 1 << 31
+	bpfRingbufDiscardBit = 1 << 30
+	bpfRingbufHeaderSize = 8
+)
+
+// ringbufDefine is defined for program code on kernels with ring buffers,
+// so that programs can prefer them and fall back to perf buffers otherwise
+const ringbufDefine = "EBPF_EXPORTER_RINGBUF"
+
+// ringbufKernel is the first kernel version with ring buffers
+var ringbufKernel = kernelVersion{5, 8}
+
+// compileFlags returns flags to compile program code with on the kernel
+func compileFlags(kernel kernelVersion) []string {
+	if kernel.compare(ringbufKernel) < 0 {
+		return []string{}
+	}
+
+	return []string{"-D" + ringbufDefine}
+}
+
+// ringBuffer reads samples from BPF_MAP_TYPE_RINGBUF map memory mapped
+// into the exporter. The consumer page is written by the exporter to tell
+// the kernel how much is read, the producer page and the data that follows
+// it are read only. Data is mapped twice in a row by the kernel, so that
+// samples wrapping around the end can be read in one piece.
+type ringBuffer struct {
+	fd       int
+	epoll    int
+	mask     uint64
+	consumer []byte
+	producer []byte
+}
+
+// openRingBuffer maps the ring buffer map with the data of the size
+func openRingBuffer(fd int, size uint32) (*ringBuffer, error) {
+	pageSize := os.Getpagesize()
+
+	consumer, err := syscall.Mmap(fd, 0, pageSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("error mapping consumer page: %s", err)
+	}
+
+	producer, err := syscall.Mmap(fd, int64(pageSize), pageSize+2*int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Munmap(consumer)
+		return nil, fmt.Errorf("error mapping producer page and data: %s", err)
+	}
+
+	epoll, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		syscall.Munmap(consumer)
+		syscall.Munmap(producer)
+		return nil, fmt.Errorf("error creating epoll: %s", err)
+	}
+
+	err = syscall.EpollCtl(epoll, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)})
+	if err != nil {
+		syscall.Munmap(consumer)
+		syscall.Munmap(producer)
+		syscall.Close(epoll)
+		return nil, fmt.Errorf("error adding ring buffer to epoll: %s", err)
+	}
+
+	return &ringBuffer{
+		fd:       fd,
+		epoll:    epoll,
+		mask:     uint64(size) - 1,
+		consumer: consumer,
+		producer: producer,
+	}, nil
+}
+
+// poll sends samples from the ring buffer to the channel as they arrive,
+// samples that do not fit into the channel are counted as lost instead
+// of holding up the kernel, which drops samples once the buffer is full
+func (r *ringBuffer) poll(samples chan<- []byte, lost func()) {
+	events := make([]syscall.EpollEvent, 1)
+
+	for {
+		r.consume(samples, lost)
+
+		_, err := syscall.EpollWait(r.epoll, events, -1)
+		if err != nil && err != syscall.EINTR {
+			log.Printf("Error waiting for ring buffer, not reading it anymore: %s", err)
+			return
+		}
+	}
+}
+
+// consume reads all samples the kernel committed to the ring buffer
+func (r *ringBuffer) consume(samples chan<- []byte, lost func()) {
+	consumerPos := (*uint64)(unsafe.Pointer(&r.consumer[0]))
+	producerPos := (*uint64)(unsafe.Pointer(&r.producer[0]))
+
+	data := r.producer[os.Getpagesize():]
+
+	position := atomic.LoadUint64(consumerPos)
+
+	for position < atomic.LoadUint64(producerPos) {
+		offset := position & r.mask
+
+		header := atomic.LoadUint32((*uint32)(unsafe.Pointer(&data[offset])))
+
+		// The sample is reserved, but not committed yet
+		if header&bpfRingbufBusyBit != 0 {
+			break
+		}
+
+		length := uint64(header &^ (bpfRingbufBusyBit | bpfRingbufDiscardBit))
+
+		if header&bpfRingbufDiscardBit == 0 {
+			sample := make([]byte, length)
+			copy(sample, data[offset+bpfRingbufHeaderSize:offset+bpfRingbufHeaderSize+length])
+
+			select {
+			case samples <- sample:
+			default:
+				lost()
+			}
+		}
+
+		// Samples are aligned to 8 bytes along with their headers
+		position += (length + bpfRingbufHeaderSize + 7) &^ 7
+
+		atomic.StoreUint64(consumerPos, position)
+	}
+}
@@ -0,0 +1,197 @@
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// pidCacheTTL is how long thread to process mappings are kept, threads
+// come and go, but looking every one of them up on every scrape is wasteful
+const pidCacheTTL = 30 * time.Second
+
+// pidCache maps thread ids to process ids from /proc
+type pidCache struct {
+	lock sync.Mutex
+	pids map[uint64]cachedPID
+}
+
+// cachedPID is a process id of a thread, empty for exited threads
+type cachedPID struct {
+	pid      string
+	resolved time.Time
+}
+
+// lookup returns the process id of the thread, which is empty if the thread
+// is gone, so that exited threads are not looked up again until expired
+func (c *pidCache) lookup(tid uint64, now time.Time) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pids == nil {
+		c.pids = map[uint64]cachedPID{}
+	}
+
+	if cached, ok := c.pids[tid]; ok && now.Sub(cached.resolved) < pidCacheTTL {
+		return cached.pid
+	}
+
+	pid := threadProcess(tid)
+
+	c.pids[tid] = cachedPID{pid: pid, resolved: now}
+
+	return pid
+}
+
+// expire removes expired mappings, so that exited threads are forgotten
+func (c *pidCache) expire(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for tid, cached := range c.pids {
+		if now.Sub(cached.resolved) >= pidCacheTTL {
+			delete(c.pids, tid)
+		}
+	}
+}
+
+// threadProcess reads the process id of the thread from its status,
+// returning an empty string if the thread does not exist anymore
+func threadProcess(tid uint64) string {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/status", tid))
+	if err != nil {
+		return ""
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "Tgid:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Tgid:"))
+		}
+	}
+
+	return ""
+}
+
+// pidLabel returns the name of the process id label of the rollup
+func pidLabel(rollup *config.ProcessRollup) string {
+	if rollup.PIDLabel == "" {
+		return "pid"
+	}
+
+	return rollup.PIDLabel
+}
+
+// rollupLabels returns labels of the rollup of the counter along with
+// positions of thread and process id labels in labels of the counter,
+// the process id position is -1 if it needs to be resolved from /proc
+func rollupLabels(counter config.Counter) ([]config.Label, int, int) {
+	labels := counterLabels(counter)
+
+	tid, pid := -1, -1
+	for i, label := range labels {
+		switch label.Name {
+		case counter.ProcessRollup.TIDLabel:
+			tid = i
+		case pidLabel(counter.ProcessRollup):
+			pid = i
+		}
+	}
+
+	rolled := []config.Label{}
+	for i, label := range labels {
+		switch {
+		case i == tid && pid == -1:
+			rolled = append(rolled, config.Label{Name: pidLabel(counter.ProcessRollup)})
+		case i != tid:
+			rolled = append(rolled, label)
+		}
+	}
+
+	return rolled, tid, pid
+}
+
+// validateRollups checks that process rollups of counters have a name
+// and that thread and process id labels are different labels
+func validateRollups(program config.Program) error {
+	for _, counter := range program.Metrics.Counters {
+		if counter.ProcessRollup == nil {
+			continue
+		}
+
+		if counter.ProcessRollup.Name == "" {
+			return fmt.Errorf("process_rollup of counter %q in program %q has no name", counter.Name, program.Name)
+		}
+
+		if counter.ProcessRollup.TIDLabel == pidLabel(counter.ProcessRollup) {
+			return fmt.Errorf("process_rollup of counter %q in program %q has the same thread and process id label", counter.Name, program.Name)
+		}
+
+		_, tid, _ := rollupLabels(counter)
+		if tid == -1 {
+			return fmt.Errorf("process_rollup of counter %q in program %q uses label %q that the counter does not have", counter.Name, program.Name, counter.ProcessRollup.TIDLabel)
+		}
+	}
+
+	return nil
+}
+
+// rollupValues sums values of threads of the same process, the process
+// is taken from the process id label if the counter has it or from /proc,
+// in which case values of exited threads are left out
+func (e *Exporter) rollupValues(values []metricValue, counter config.Counter) ([]metricValue, error) {
+	_, tid, pid := rollupLabels(counter)
+
+	now := time.Now()
+	e.pids.expire(now)
+
+	rolled := map[string]metricValue{}
+
+	for _, value := range values {
+		labels := []string{}
+		skip := false
+
+		for i, label := range value.labels {
+			switch {
+			case i == tid && pid == -1:
+				num, err := strconv.ParseUint(label, 0, 32)
+				if err != nil {
+					return nil, fmt.Errorf("thread id %q cannot be parsed: %s", label, err)
+				}
+
+				process := e.pids.lookup(num, now)
+				if process == "" {
+					skip = true
+				}
+
+				labels = append(labels, process)
+			case i != tid:
+				labels = append(labels, label)
+			}
+		}
+
+		if skip {
+			continue
+		}
+
+		key := fmt.Sprintf("%#v", labels)
+
+		rolled[key] = metricValue{labels: labels, value: rolled[key].value + value.value}
+	}
+
+	result := []metricValue{}
+	for _, value := range rolled {
+		result = append(result, value)
+	}
+
+	return result, nil
+}
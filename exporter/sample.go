@@ -0,0 +1,123 @@
+package exporter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// sampleScaleLabel is the const label with the factor to multiply values of
+// sampled metrics by to extrapolate them to all series
+const sampleScaleLabel = "sample_scale"
+
+// validateSampleRatios checks that sample ratios of metrics are between
+// zero and one and that sampled metrics do not have the scale label
+func validateSampleRatios(program config.Program) error {
+	check := func(metric string, ratio float64, labels []config.Label) error {
+		if ratio == 0 {
+			return nil
+		}
+
+		if ratio < 0 || ratio > 1 {
+			return fmt.Errorf("sample ratio %v of metric %q in program %q is not between 0 and 1", ratio, metric, program.Name)
+		}
+
+		if _, ok := program.ConstLabels[sampleScaleLabel]; ok {
+			return fmt.Errorf("const label %q collides with sample scale label of metric %q in program %q", sampleScaleLabel, metric, program.Name)
+		}
+
+		for _, label := range labels {
+			if labelName(label) == sampleScaleLabel {
+				return fmt.Errorf("label %q of metric %q in program %q collides with sample scale label", labelName(label), metric, program.Name)
+			}
+		}
+
+		return nil
+	}
+
+	for _, counter := range program.Metrics.Counters {
+		err := check(counter.Name, counter.SampleRatio, counterLabels(counter))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		err := check(gauge.Name, gauge.SampleRatio, gaugeLabels(gauge))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, histogram := range program.Metrics.Histograms {
+		err := check(histogram.Name, histogram.SampleRatio, perCPULabels(histogram.PerCPULabel, histogram.Labels))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sampleConstLabels returns const labels of the program with the scale label
+// added for sampled metrics
+func sampleConstLabels(constLabels map[string]string, ratio float64) map[string]string {
+	if ratio == 0 {
+		return constLabels
+	}
+
+	labels := map[string]string{sampleScaleLabel: strconv.FormatFloat(1/ratio, 'g', -1, 64)}
+
+	for name, value := range constLabels {
+		labels[name] = value
+	}
+
+	return labels
+}
+
+// sampled deterministically decides whether the label set is kept, so that
+// the same label sets are exported on every scrape
+func sampled(labels []string, ratio float64) bool {
+	if ratio == 0 || ratio == 1 {
+		return true
+	}
+
+	hash := fnv.New64a()
+
+	for _, label := range labels {
+		hash.Write([]byte(label))
+		hash.Write([]byte{0})
+	}
+
+	return float64(hash.Sum64()) < ratio*math.MaxUint64
+}
+
+// sampleSeries keeps values with label sets picked by sample ratio
+func sampleSeries(values []metricValue, ratio float64) []metricValue {
+	if ratio == 0 {
+		return values
+	}
+
+	kept := []metricValue{}
+
+	for _, value := range values {
+		if sampled(value.labels, ratio) {
+			kept = append(kept, value)
+		}
+	}
+
+	return kept
+}
+
+// sampleHistogramSeries removes histograms with label sets not picked
+// by sample ratio
+func sampleHistogramSeries(histograms map[string]histogramWithLabels, ratio float64) {
+	for key, histogram := range histograms {
+		if !sampled(histogram.labels, ratio) {
+			delete(histograms, key)
+		}
+	}
+}
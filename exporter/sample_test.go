@@ -0,0 +1,75 @@
+package exporter
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSampled(t *testing.T) {
+	cases := []struct {
+		ratio    float64
+		min, max int
+	}{
+		{ratio: 0, min: 10000, max: 10000},
+		{ratio: 1, min: 10000, max: 10000},
+		{ratio: 0.5, min: 4500, max: 5500},
+		{ratio: 0.1, min: 800, max: 1200},
+		{ratio: 0.001, min: 0, max: 30},
+	}
+
+	for _, c := range cases {
+		kept := 0
+
+		for i := 0; i < 10000; i++ {
+			if sampled([]string{"sda", fmt.Sprintf("%d", i)}, c.ratio) {
+				kept++
+			}
+		}
+
+		if kept < c.min || kept > c.max {
+			t.Errorf("Expected between %d and %d of 10000 label sets kept with ratio %v, got %d", c.min, c.max, c.ratio, kept)
+		}
+	}
+}
+
+func TestSampledIsDeterministic(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		labels := []string{"sda", fmt.Sprintf("%d", i)}
+
+		first := sampled(labels, 0.5)
+
+		for scrape := 0; scrape < 5; scrape++ {
+			if sampled(labels, 0.5) != first {
+				t.Fatalf("Label set %v is not sampled the same way on every scrape", labels)
+			}
+		}
+	}
+
+}
+
+func TestSampleSeries(t *testing.T) {
+	values := []metricValue{}
+	for i := 0; i < 100; i++ {
+		values = append(values, metricValue{labels: []string{fmt.Sprintf("%d", i)}, value: float64(i)})
+	}
+
+	if kept := sampleSeries(values, 0); len(kept) != len(values) {
+		t.Errorf("Expected all series without sampling, got %d", len(kept))
+	}
+
+	if kept := sampleSeries(values, 1); len(kept) != len(values) {
+		t.Errorf("Expected all series with ratio 1, got %d", len(kept))
+	}
+
+	kept := sampleSeries(values, 0.3)
+
+	for _, value := range kept {
+		if !sampled(value.labels, 0.3) {
+			t.Errorf("Series %v is kept, but not sampled", value.labels)
+		}
+	}
+
+	if again := sampleSeries(values, 0.3); len(again) != len(kept) {
+		t.Errorf("Expected the same %d series on the next scrape, got %d", len(kept), len(again))
+	}
+}
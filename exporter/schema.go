@@ -0,0 +1,51 @@
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// schemaMismatchSuffix is added to names of metrics reporting table rows
+// with keys that do not match labels of the original metric
+const schemaMismatchSuffix = "_schema_mismatch"
+
+// ExportSchemaMismatches makes rows with keys that do not match labels
+// of the metric exported with the raw key as a label instead of failing
+// the whole table, which is useful when developing programs
+func (e *Exporter) ExportSchemaMismatches() {
+	e.mismatch = true
+}
+
+// schemaMismatches returns a slice for tableValues to put mismatched rows into,
+// which is nil when mismatched rows should fail the table instead
+func (e *Exporter) schemaMismatches() *[]metricValue {
+	if !e.mismatch {
+		return nil
+	}
+
+	return &[]metricValue{}
+}
+
+// describeSchemaMismatches sends descriptions for mismatched rows of the metric
+func (e *Exporter) describeSchemaMismatches(addDescs func(string, string, string, []config.Label, map[string]string), program config.Program, name, help string) {
+	if !e.mismatch {
+		return
+	}
+
+	addDescs(program.Name, name+schemaMismatchSuffix, fmt.Sprintf("Rows with keys not matching labels of %s", help), []config.Label{{Name: "raw_key"}}, program.ConstLabels)
+}
+
+// collectSchemaMismatches sends mismatched rows of the metric to prometheus
+func (e *Exporter) collectSchemaMismatches(ch chan<- prometheus.Metric, programName, metricName string, mismatches *[]metricValue) {
+	if mismatches == nil {
+		return
+	}
+
+	desc := e.descs[programName][metricName+schemaMismatchSuffix]
+
+	for _, metricValue := range *mismatches {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, metricValue.value, metricValue.raw)
+	}
+}
@@ -0,0 +1,111 @@
+package exporter
+
+import (
+	"log"
+	"sort"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// limitSeries keeps at most maxSeries values with the highest values,
+// returning the kept values and the number of dropped ones
+func limitSeries(values []metricValue, maxSeries int) ([]metricValue, int) {
+	if maxSeries == 0 || len(values) <= maxSeries {
+		return values, 0
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].value > values[j].value
+	})
+
+	return values[0:maxSeries], len(values) - maxSeries
+}
+
+// limitHistogramSeries keeps at most maxSeries histograms with the highest
+// number of observations, returning the number of dropped histograms
+func limitHistogramSeries(histograms map[string]histogramWithLabels, maxSeries int) int {
+	if maxSeries == 0 || len(histograms) <= maxSeries {
+		return 0
+	}
+
+	keys := make([]string, 0, len(histograms))
+	counts := map[string]uint64{}
+
+	for key, histogram := range histograms {
+		keys = append(keys, key)
+
+		for _, count := range histogram.buckets {
+			counts[key] += count
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] == counts[keys[j]] {
+			return keys[i] < keys[j]
+		}
+
+		return counts[keys[i]] > counts[keys[j]]
+	})
+
+	for _, key := range keys[maxSeries:] {
+		delete(histograms, key)
+	}
+
+	return len(keys) - maxSeries
+}
+
+// dropSeries counts series of the metric dropped due to max_series
+func (e *Exporter) dropSeries(programName, metricName string, dropped int) {
+	if dropped == 0 {
+		return
+	}
+
+	log.Printf("Dropping %d series of metric %q of program %q over max_series limit", dropped, metricName, programName)
+
+	e.droppedLock.Lock()
+	defer e.droppedLock.Unlock()
+
+	if _, ok := e.dropped[programName]; !ok {
+		e.dropped[programName] = map[string]int{}
+	}
+
+	e.dropped[programName][metricName] += dropped
+}
+
+// collectDroppedSeries sends the number of dropped series for every metric
+// with max_series limit to prometheus
+func (e *Exporter) collectDroppedSeries(ch chan<- prometheus.Metric, programs []config.Program) {
+	e.droppedLock.Lock()
+	defer e.droppedLock.Unlock()
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok {
+			continue
+		}
+
+		limited := []string{}
+
+		for _, counter := range program.Metrics.Counters {
+			if counter.MaxSeries > 0 {
+				limited = append(limited, counter.Name)
+			}
+		}
+
+		for _, gauge := range program.Metrics.Gauges {
+			if gauge.MaxSeries > 0 {
+				limited = append(limited, gauge.Name)
+			}
+		}
+
+		for _, histogram := range program.Metrics.Histograms {
+			if histogram.MaxSeries > 0 {
+				limited = append(limited, histogram.Name)
+			}
+		}
+
+		for _, metric := range limited {
+			ch <- prometheus.MustNewConstMetric(e.droppedDesc, prometheus.CounterValue, float64(e.dropped[program.Name][metric]), program.Name, metric)
+		}
+	}
+}
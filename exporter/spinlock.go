@@ -0,0 +1,67 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// spinLockField returns the position of bpf_spin_lock field in the value
+// struct described by bcc or -1 if there is none, the lock is described
+// either by its name or as a nested struct, for example:
+//
+// ["val_t",[["lock",["bpf_spin_lock",[["val","unsigned int"]],"struct"]],["count","unsigned long long"]],"struct"]
+func spinLockField(leafDesc string) int {
+	desc := []interface{}{}
+
+	err := json.Unmarshal([]byte(leafDesc), &desc)
+	if err != nil || len(desc) != 3 {
+		return -1
+	}
+
+	fields, ok := desc[1].([]interface{})
+	if !ok {
+		return -1
+	}
+
+	for i, field := range fields {
+		parts, ok := field.([]interface{})
+		if !ok || len(parts) < 2 {
+			continue
+		}
+
+		switch fieldType := parts[1].(type) {
+		case string:
+			if strings.TrimPrefix(fieldType, "struct ") == "bpf_spin_lock" {
+				return i
+			}
+		case []interface{}:
+			if len(fieldType) > 0 && fieldType[0] == "bpf_spin_lock" {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// stripSpinLock removes the spin lock field from the value struct rendered
+// by bcc, leaving the only other field, like the counter the lock protects:
+//
+// { {0x0} 0x2a } -> 0x2a
+func stripSpinLock(in string, field int) (string, error) {
+	if field < 0 {
+		return in, nil
+	}
+
+	fields := splitKey(in)
+	if field >= len(fields) {
+		return "", fmt.Errorf("spin lock field %d is out of %d fields of value", field, len(fields))
+	}
+
+	if len(fields) != 2 {
+		return "", fmt.Errorf("value has %d fields besides the spin lock, but we expect one", len(fields)-1)
+	}
+
+	return fields[1-field], nil
+}
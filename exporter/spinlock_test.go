@@ -0,0 +1,107 @@
+package exporter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// lockedValueDesc is how bcc describes struct { struct bpf_spin_lock lock; u64 count; }
+const lockedValueDesc = `["val_t",[["lock",["bpf_spin_lock",[["val","unsigned int"]],"struct"]],["count","unsigned long long"]],"struct"]`
+
+func TestSpinLockField(t *testing.T) {
+	cases := map[string]int{
+		lockedValueDesc: 0,
+		`["val_t",[["count","unsigned long long"],["lock","struct bpf_spin_lock"]],"struct"]`: 1,
+		`["val_t",[["count","unsigned long long"],["total","unsigned long long"]],"struct"]`:  -1,
+		`"unsigned long long"`: -1,
+	}
+
+	for desc, expected := range cases {
+		if field := spinLockField(desc); field != expected {
+			t.Errorf("Expected field %d for %s, got %d", expected, desc, field)
+		}
+	}
+}
+
+func TestReadValueWithSpinLock(t *testing.T) {
+	cases := []struct {
+		in       string
+		spinLock int
+		values   []uint64
+	}{
+		{in: "0x2a", spinLock: -1, values: []uint64{42}},
+		{in: "{ {0x0} 0x2a }", spinLock: 0, values: []uint64{42}},
+		{in: "{ { 0x1 } 0x2a }", spinLock: 0, values: []uint64{42}},
+		{in: "{ 0x2a {0x0} }", spinLock: 1, values: []uint64{42}},
+	}
+
+	for _, c := range cases {
+		values, err := readValue(c.in, nil, c.spinLock)
+		if err != nil {
+			t.Errorf("Error reading %q with spin lock field %d: %s", c.in, c.spinLock, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("Expected %v for %q with spin lock field %d, got %v", c.values, c.in, c.spinLock, values)
+		}
+	}
+
+	if _, err := readValue("{ {0x0} 0x2a }", nil, -1); err == nil {
+		t.Errorf("Expected value with spin lock to fail without spin lock field")
+	}
+
+	if _, err := readValue("{ {0x0} 0x1 0x2a }", nil, 0); err == nil {
+		t.Errorf("Expected value with several fields besides spin lock to fail")
+	}
+}
+
+func TestTableValuesWithSpinLock(t *testing.T) {
+	counter := config.Counter{
+		Name:   "locked_events_total",
+		Help:   "Events counted under a spin lock",
+		Table:  "events",
+		Labels: []config.Label{{Name: "cpu", Decoders: []config.Decoder{{Name: "uint64"}}}},
+	}
+
+	cfg := config.Config{
+		Programs: []config.Program{{Name: "locked", Metrics: config.Metrics{Counters: []config.Counter{counter}}}},
+	}
+
+	cases := []struct {
+		leafDesc      string
+		spinLockField *int
+		value         string
+	}{
+		// The lock is found in the description of the value
+		{leafDesc: lockedValueDesc, value: "{ {0x0} 0x2a }"},
+		// The lock is set in config when the description does not name it
+		{leafDesc: `["val_t",[["pad",["opaque",[["val","unsigned int"]],"struct"]],["count","unsigned long long"]],"struct"]`, spinLockField: new(int), value: "{ {0x0} 0x2a }"},
+		// Values without a lock are read as they are
+		{leafDesc: `"unsigned long long"`, value: "0x2a"},
+	}
+
+	for _, c := range cases {
+		e := newTestExporter(t, cfg, nil)
+
+		e.tableReader = func(programName string, tableName string) ([]bcc.Entry, string, string, error) {
+			return []bcc.Entry{{Key: "0x1", Value: c.value}}, `"unsigned int"`, c.leafDesc, nil
+		}
+
+		tableConfig := counterTableConfig(counter)
+		tableConfig.spinLockField = c.spinLockField
+
+		values, err := e.tableValues("locked", "events", tableConfig)
+		if err != nil {
+			t.Errorf("Error reading value %q with %s: %s", c.value, c.leafDesc, err)
+			continue
+		}
+
+		if len(values) != 1 || values[0].value != 42 {
+			t.Errorf("Expected 42 for value %q with %s, got %v", c.value, c.leafDesc, values)
+		}
+	}
+}
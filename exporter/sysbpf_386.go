@@ -0,0 +1,4 @@
+package exporter
+
+// sysBPF is the number of bpf syscall on 386, which is missing from syscall package
+const sysBPF = 357
@@ -0,0 +1,7 @@
+//go:build mips64 || mips64le
+// +build mips64 mips64le
+
+package exporter
+
+// sysBPF is the number of bpf syscall on mips64 and mips64le, which is missing from syscall package
+const sysBPF = 5315
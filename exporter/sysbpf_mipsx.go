@@ -0,0 +1,7 @@
+//go:build mips || mipsle
+// +build mips mipsle
+
+package exporter
+
+// sysBPF is the number of bpf syscall on mips and mipsle, which is missing from syscall package
+const sysBPF = 4355
@@ -0,0 +1,7 @@
+//go:build ppc64 || ppc64le
+// +build ppc64 ppc64le
+
+package exporter
+
+// sysBPF is the number of bpf syscall on ppc64 and ppc64le, which is missing from syscall package
+const sysBPF = 361
@@ -0,0 +1,112 @@
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// moduleTable returns the table of the module with the name, bcc does not
+// fail on unknown names and hands out a table with an invalid id instead
+func moduleTable(module *bcc.Module, name string) (*bcc.Table, error) {
+	for id := uint64(0); id < module.TableSize(); id++ {
+		if module.TableDesc(id)["name"] == name {
+			return bcc.NewTable(module.TableId(name), module), nil
+		}
+	}
+
+	return nil, fmt.Errorf("table %q not found", name)
+}
+
+// programTables returns names of tables referenced by the program config
+// along with what references them
+func programTables(program config.Program) map[string]string {
+	tables := map[string]string{}
+
+	add := func(table string, what string) {
+		if table != "" {
+			tables[table] = what
+		}
+	}
+
+	addLabels := func(labels []config.Label, what string) {
+		for _, label := range labels {
+			for _, decoder := range label.Decoders {
+				add(decoder.StackTable, fmt.Sprintf("stack_table of label %q of %s", label.Name, what))
+			}
+		}
+	}
+
+	add(program.GenerationTable, "generation_table")
+
+	for _, progArray := range program.ProgArrays {
+		add(progArray.Table, "prog array")
+	}
+
+	for _, counter := range program.Metrics.Counters {
+		what := fmt.Sprintf("counter %q", counter.Name)
+
+		if counter.PinnedTable == "" {
+			add(counter.Table, what)
+		}
+
+		add(counter.TimestampTable, fmt.Sprintf("timestamp_table of %s", what))
+		addLabels(counter.Labels, what)
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		what := fmt.Sprintf("gauge %q", gauge.Name)
+
+		if gauge.PinnedTable == "" {
+			add(gauge.Table, what)
+		}
+
+		addLabels(gauge.Labels, what)
+	}
+
+	for _, histogram := range program.Metrics.Histograms {
+		what := fmt.Sprintf("histogram %q", histogram.Name)
+
+		add(histogram.Table, what)
+		add(histogram.BoundariesTable, fmt.Sprintf("boundaries_table of %s", what))
+		add(histogram.TotalTable, fmt.Sprintf("total_table of %s", what))
+		addLabels(histogram.Labels, what)
+	}
+
+	for _, queue := range program.Metrics.Queues {
+		add(queue.Table, fmt.Sprintf("queue %q", queue.Name))
+	}
+
+	for _, custom := range program.Metrics.Custom {
+		what := fmt.Sprintf("custom metric %q", custom.Name)
+
+		add(custom.Table, what)
+		addLabels(custom.Labels, what)
+	}
+
+	for _, histogram := range program.Metrics.PerfHistograms {
+		what := fmt.Sprintf("perf histogram %q", histogram.Name)
+
+		add(histogram.Table, what)
+
+		for _, label := range histogram.Labels {
+			addLabels([]config.Label{label.Label}, what)
+		}
+	}
+
+	return tables
+}
+
+// validateTables checks that tables referenced by the program config exist
+// in the compiled module, otherwise metrics would silently stay empty
+func validateTables(module *bcc.Module, program config.Program) error {
+	for table, what := range programTables(program) {
+		_, err := moduleTable(module, table)
+		if err != nil {
+			return fmt.Errorf("table %q of %s not found in program %q", table, what, program.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package exporter
+
+import (
+	"time"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// collectMetricsTimeout sends metrics of the program that has collect_timeout
+// until the timeout expires. Reading maps cannot be interrupted, so after
+// the timeout collection keeps going in the background with its metrics
+// thrown away, and the program is not collected until it finishes.
+func (e *Exporter) collectMetricsTimeout(ch chan<- prometheus.Metric, program config.Program) bool {
+	e.timeoutsLock.Lock()
+
+	if e.running[program.Name] {
+		e.timeouts[program.Name]++
+		e.timeoutsLock.Unlock()
+
+		e.collectError(program.Name, "Error collecting program %q: collection that timed out on a previous scrape is still running", program.Name)
+		return false
+	}
+
+	e.running[program.Name] = true
+	e.timeoutsLock.Unlock()
+
+	metrics := make(chan prometheus.Metric)
+	done := make(chan bool, 1)
+
+	go func() {
+		done <- e.collectMetrics(metrics, []config.Program{program})
+		close(metrics)
+
+		e.timeoutsLock.Lock()
+		delete(e.running, program.Name)
+		e.timeoutsLock.Unlock()
+	}()
+
+	timer := time.NewTimer(program.CollectTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case metric, ok := <-metrics:
+			if !ok {
+				return <-done
+			}
+
+			ch <- metric
+		case <-timer.C:
+			go func() {
+				for range metrics {
+				}
+			}()
+
+			e.timeoutsLock.Lock()
+			e.timeouts[program.Name]++
+			e.timeoutsLock.Unlock()
+
+			e.collectError(program.Name, "Error collecting program %q: collection took longer than collect_timeout of %s", program.Name, program.CollectTimeout)
+			return false
+		}
+	}
+}
+
+// collectTimeouts sends the number of timed out collections of programs
+// with collect_timeout to prometheus
+func (e *Exporter) collectTimeouts(ch chan<- prometheus.Metric, programs []config.Program) {
+	e.timeoutsLock.Lock()
+	defer e.timeoutsLock.Unlock()
+
+	for _, program := range programs {
+		if _, ok := e.skipped[program.Name]; ok || program.CollectTimeout == 0 {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(e.timeoutsDesc, prometheus.CounterValue, float64(e.timeouts[program.Name]), program.Name)
+	}
+}
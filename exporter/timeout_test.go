@@ -0,0 +1,97 @@
+package exporter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestCollectPastTimeout checks that collection that keeps decoding in the
+// background after collect_timeout does not race with other readers of the
+// same decoders, like the tables handler, it is meant to run with -race
+func TestCollectPastTimeout(t *testing.T) {
+	counter := config.Counter{
+		Name:   "netns_packets_total",
+		Help:   "Packets by network namespace",
+		Table:  "packets",
+		Labels: []config.Label{{Name: "netns", Decoders: []config.Decoder{{Name: "netns"}, {Name: "regexp", Regexps: []string{".*"}}}}},
+	}
+
+	program := config.Program{
+		Name:           "netns",
+		CollectTimeout: time.Millisecond,
+		Metrics:        config.Metrics{Counters: []config.Counter{counter}},
+	}
+
+	// Unknown namespaces are added to the cache of the decoder one by one
+	entries := func(first int) []bcc.Entry {
+		entries := []bcc.Entry{}
+		for i := first; i < first+100; i++ {
+			entries = append(entries, bcc.Entry{Key: fmt.Sprintf("0x%x", i), Value: "0x1"})
+		}
+
+		return entries
+	}
+
+	e := newTestExporter(t, config.Config{Programs: []config.Program{program}}, nil)
+
+	// Descriptions are created when the exporter is described on registration
+	describedNames(e)
+
+	e.tableReader = func(programName string, tableName string) ([]bcc.Entry, string, string, error) {
+		time.Sleep(10 * time.Millisecond)
+		return entries(1), "", "", nil
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		for range ch {
+		}
+	}()
+
+	defer close(ch)
+
+	if e.collectMetricsTimeout(ch, program) {
+		t.Fatalf("Expected collection to time out")
+	}
+
+	// Read the table the way the tables handler does while the timed out
+	// collection is decoding other keys with the same decoders
+	reader := New(config.Config{})
+	reader.decoders = e.decoders
+
+	for i := 0; i < 20; i++ {
+		first := 1000 * (i + 1)
+
+		reader.tableReader = func(programName string, tableName string) ([]bcc.Entry, string, string, error) {
+			return entries(first), "", "", nil
+		}
+
+		_, err := reader.tableValues(program.Name, counter.Table, counterTableConfig(counter))
+		if err != nil {
+			t.Fatalf("Error reading table while collection is running: %s", err)
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		e.timeoutsLock.Lock()
+		running := e.running[program.Name]
+		e.timeoutsLock.Unlock()
+
+		if !running {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out collection did not finish")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,59 @@
+package exporter
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CLOCK_MONOTONIC is missing from syscall package, this is its value on linux
+const clockMonotonic = 0x1
+
+// maxTimestampSkew is how far into the future timestamps can be
+// before they are considered implausible and ignored
+const maxTimestampSkew = time.Minute
+
+// monotonicNow returns the current value of CLOCK_MONOTONIC,
+// which is what bpf_ktime_get_ns() returns in eBPF programs
+func monotonicNow() (time.Duration, error) {
+	ts := syscall.Timespec{}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_CLOCK_GETTIME, clockMonotonic, uintptr(unsafe.Pointer(&ts)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return time.Duration(ts.Nano()), nil
+}
+
+// monotonicToWall converts nanoseconds from bpf_ktime_get_ns() to wall clock
+func monotonicToWall(ns uint64, now time.Time, monotonic time.Duration) time.Time {
+	return now.Add(time.Duration(ns) - monotonic)
+}
+
+// timestampedMetric is a metric with explicitly set timestamp
+type timestampedMetric struct {
+	prometheus.Metric
+	timestamp time.Time
+}
+
+// newMetricWithTimestamp wraps metric to have the timestamp
+func newMetricWithTimestamp(timestamp time.Time, metric prometheus.Metric) prometheus.Metric {
+	return timestampedMetric{Metric: metric, timestamp: timestamp}
+}
+
+// Write satisfies prometheus.Metric interface and adds timestamp to the metric
+func (m timestampedMetric) Write(out *dto.Metric) error {
+	err := m.Metric.Write(out)
+	if err != nil {
+		return err
+	}
+
+	ms := m.timestamp.UnixNano() / int64(time.Millisecond)
+	out.TimestampMs = &ms
+
+	return nil
+}
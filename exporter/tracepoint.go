@@ -0,0 +1,145 @@
+package exporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h
+// and linux/perf_event.h
+const (
+	bpfProgTypeTracepoint = 5
+	perfTypeTracepoint    = 2
+	perfFlagFdCloexec     = 8
+	perfEventIocEnable    = 0x2400
+	perfEventIocSetBPF    = 0x40042408
+)
+
+// tracingEventsPath is where the kernel lists available tracepoints
+const tracingEventsPath = "/sys/kernel/debug/tracing/events"
+
+// maxGlobTracepoints limits how many tracepoints one glob can attach to,
+// which protects from attaching to everything by accident
+const maxGlobTracepoints = 1024
+
+// perfEventAttr is struct perf_event_attr from linux/perf_event.h
+type perfEventAttr struct {
+	eventType        uint32
+	size             uint32
+	config           uint64
+	samplePeriod     uint64
+	sampleType       uint64
+	readFormat       uint64
+	flags            uint64
+	wakeupEvents     uint32
+	bpType           uint32
+	config1          uint64
+	config2          uint64
+	branchSampleType uint64
+	sampleRegsUser   uint64
+	sampleStackUser  uint32
+	clockID          int32
+	sampleRegsIntr   uint64
+	auxWatermark     uint32
+	sampleMaxStack   uint16
+	_                uint16
+}
+
+// attachTracepointsGlob attaches the target function to every tracepoint
+// matching the glob in <category>:<name> format, like syscalls:sys_enter_*,
+// returning the number of tracepoints it attached to
+func attachTracepointsGlob(module *bcc.Module, tracepoint config.Probe) (int, error) {
+	parts := strings.SplitN(tracepoint.Probe, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("tracepoint glob %q is not in <category>:<name> format", tracepoint.Probe)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(tracingEventsPath, parts[0], parts[1], "id"))
+	if err != nil {
+		return 0, fmt.Errorf("error expanding tracepoint glob %q: %s", tracepoint.Probe, err)
+	}
+
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("tracepoint glob %q does not match any tracepoints", tracepoint.Probe)
+	}
+
+	if len(matches) > maxGlobTracepoints {
+		return 0, fmt.Errorf("tracepoint glob %q matches %d tracepoints, which is more than the limit of %d", tracepoint.Probe, len(matches), maxGlobTracepoints)
+	}
+
+	sort.Strings(matches)
+
+	target, err := loadFunction(module, tracepoint.Target, bpfProgTypeTracepoint)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load target %q: %s", tracepoint.Target, err)
+	}
+
+	names := make([]string, len(matches))
+
+	for i, match := range matches {
+		dir := filepath.Dir(match)
+		names[i] = filepath.Base(filepath.Dir(dir)) + ":" + filepath.Base(dir)
+
+		err = attachTracepoint(match, target)
+		if err != nil {
+			return 0, fmt.Errorf("failed to attach tracepoint %q to %q: %s", names[i], tracepoint.Target, err)
+		}
+	}
+
+	log.Printf("Attached %q to %d tracepoints matching %q: %s", tracepoint.Target, len(names), tracepoint.Probe, strings.Join(names, ", "))
+
+	return len(names), nil
+}
+
+// attachTracepoint opens perf event for the tracepoint with the id file
+// and attaches the loaded function to it, the event stays open until exit
+func attachTracepoint(idFile string, target int) error {
+	contents, err := ioutil.ReadFile(idFile)
+	if err != nil {
+		return fmt.Errorf("error reading tracepoint id: %s", err)
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(string(contents)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing tracepoint id: %s", err)
+	}
+
+	attr := perfEventAttr{
+		eventType:    perfTypeTracepoint,
+		config:       id,
+		samplePeriod: 1,
+		wakeupEvents: 1,
+	}
+
+	attr.size = uint32(unsafe.Sizeof(attr))
+
+	// Tracepoint programs run on every cpu, even if the event is opened on one
+	fd, _, errno := syscall.Syscall6(syscall.SYS_PERF_EVENT_OPEN, uintptr(unsafe.Pointer(&attr)), ^uintptr(0), 0, ^uintptr(0), perfFlagFdCloexec, 0)
+	if errno != 0 {
+		return fmt.Errorf("error opening perf event: %s", errno)
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, perfEventIocSetBPF, uintptr(target))
+	if errno != 0 {
+		syscall.Close(int(fd))
+		return fmt.Errorf("error attaching program to perf event: %s", errno)
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, perfEventIocEnable, 0)
+	if errno != 0 {
+		syscall.Close(int(fd))
+		return fmt.Errorf("error enabling perf event: %s", errno)
+	}
+
+	return nil
+}
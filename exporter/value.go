@@ -0,0 +1,148 @@
+package exporter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudflare/ebpf_exporter/config"
+)
+
+// readValue parses the value as uint64 for every CPU, unless the value decoder
+// is set to read a single integer out of a byte array instead, the spin lock
+// field of value structs is skipped unless it is negative
+func readValue(in string, valueDecoder *config.ValueDecoder, spinLock int) ([]uint64, error) {
+	in, err := stripSpinLock(in, spinLock)
+	if err != nil {
+		return nil, err
+	}
+
+	if valueDecoder == nil {
+		return parseValue(in)
+	}
+
+	value, err := decodeValue(in, *valueDecoder)
+	if err != nil {
+		return nil, err
+	}
+
+	return []uint64{value}, nil
+}
+
+// decodeValue reads a little-endian integer from the value rendered
+// by bcc as a byte array, like "[ 0x1 0x0 0x0 0x0 0x2a 0x0 0x0 0x0 ]"
+func decodeValue(in string, valueDecoder config.ValueDecoder) (uint64, error) {
+	size, err := valueSize(valueDecoder.Type)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := []byte{}
+
+	for _, element := range strings.Fields(strings.Trim(in, "{[ ]}")) {
+		value, err := strconv.ParseUint(element, 0, 8)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing value byte %q: %s", element, err)
+		}
+
+		buf = append(buf, byte(value))
+	}
+
+	if valueDecoder.Offset < 0 || valueDecoder.Offset+size > len(buf) {
+		return 0, fmt.Errorf("%s at offset %d is out of %d bytes of value", valueDecoder.Type, valueDecoder.Offset, len(buf))
+	}
+
+	field := make([]byte, 8)
+	copy(field, buf[valueDecoder.Offset:valueDecoder.Offset+size])
+
+	return binary.LittleEndian.Uint64(field), nil
+}
+
+// valueSize returns the size in bytes of integers of the value type
+func valueSize(valueType string) (int, error) {
+	switch valueType {
+	case config.ValueTypeU8:
+		return 1, nil
+	case config.ValueTypeU16:
+		return 2, nil
+	case config.ValueTypeU32:
+		return 4, nil
+	case config.ValueTypeU64:
+		return 8, nil
+	default:
+		return 0, fmt.Errorf("unknown value type %q", valueType)
+	}
+}
+
+// packedHalf is one half of packed values with its label value
+type packedHalf struct {
+	label  string
+	values []uint64
+}
+
+// packedHalves splits every u64 value into lower and upper u32 halves,
+// returning the values as they are if they are not packed
+func packedHalves(values []uint64, packed *config.PackedU32) []packedHalf {
+	if packed == nil {
+		return []packedHalf{{values: values}}
+	}
+
+	low := packedHalf{label: packed.Low, values: make([]uint64, len(values))}
+	high := packedHalf{label: packed.High, values: make([]uint64, len(values))}
+
+	for i, value := range values {
+		low.values[i] = value & 0xffffffff
+		high.values[i] = value >> 32
+	}
+
+	return []packedHalf{low, high}
+}
+
+// validatePackedValues checks that packed values of metrics have the label
+// and distinct label values for both halves
+func validatePackedValues(program config.Program) error {
+	check := func(metric string, packed *config.PackedU32) error {
+		if packed == nil {
+			return nil
+		}
+
+		if packed.Label == "" {
+			return fmt.Errorf("packed_u32 of metric %q in program %q has no label", metric, program.Name)
+		}
+
+		if packed.Low == "" || packed.High == "" || packed.Low == packed.High {
+			return fmt.Errorf("packed_u32 of metric %q in program %q needs distinct low and high label values", metric, program.Name)
+		}
+
+		return nil
+	}
+
+	for _, counter := range program.Metrics.Counters {
+		err := check(counter.Name, counter.PackedU32)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, gauge := range program.Metrics.Gauges {
+		err := check(gauge.Name, gauge.PackedU32)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateKernelRates checks that gauges with rates computed in the kernel
+// do not turn them into flags or states, which are not rates anymore
+func validateKernelRates(program config.Program) error {
+	for _, gauge := range program.Metrics.Gauges {
+		if gauge.KernelRate && (gauge.Boolean || gauge.StateSet != nil) {
+			return fmt.Errorf("gauge %q in program %q with kernel_rate cannot be boolean or have state_set", gauge.Name, program.Name)
+		}
+	}
+
+	return nil
+}
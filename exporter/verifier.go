@@ -0,0 +1,109 @@
+package exporter
+
+/*
+#cgo CFLAGS: -I/usr/include/bcc/compat
+#cgo LDFLAGS: -lbcc
+#include <stdlib.h>
+#include <bcc/bpf_common.h>
+*/
+import "C"
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"syscall"
+	"unsafe"
+
+	"github.com/iovisor/gobpf/bcc"
+)
+
+// These are missing from syscall package, values are from linux/bpf.h
+const (
+	bpfProgLoad = 5
+)
+
+const (
+	// verifierLogMinSize is the size of the first buffer for verifier log,
+	// which is doubled for as long as the log does not fit
+	verifierLogMinSize = 64 * 1024
+	// verifierLogMaxSize is the largest log buffer older kernels accept
+	verifierLogMaxSize = 16*1024*1024 - 1
+)
+
+// bpfProgLoadAttr is the part of bpf_attr used by BPF_PROG_LOAD
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+}
+
+// verifierLog loads the compiled function of the module once more with
+// verifier log enabled and returns the log, gobpf asks bcc for the log,
+// but drops it, so the function is loaded directly with the instructions
+// that bcc compiled for it, which are the same ones that were rejected
+func verifierLog(module *bcc.Module, name string, progType int) (string, error) {
+	// The pointer to the compiled module is not exported by gobpf
+	field := reflect.ValueOf(module).Elem().FieldByName("p")
+	if field.Kind() != reflect.UnsafePointer {
+		return "", fmt.Errorf("module of gobpf has no pointer to compiled module")
+	}
+
+	program := unsafe.Pointer(field.Pointer())
+	if program == nil {
+		return "", fmt.Errorf("module is not compiled")
+	}
+
+	nameCS := C.CString(name)
+	defer C.free(unsafe.Pointer(nameCS))
+
+	start := C.bpf_function_start(program, nameCS)
+	if start == nil {
+		return "", fmt.Errorf("function %q is not found in module", name)
+	}
+
+	attr := bpfProgLoadAttr{
+		progType:    uint32(progType),
+		insnCnt:     uint32(C.bpf_function_size(program, nameCS) / bpfInsnSize),
+		insns:       uint64(uintptr(start)),
+		license:     uint64(uintptr(unsafe.Pointer(C.bpf_module_license(program)))),
+		logLevel:    verifierLogLevel,
+		kernVersion: uint32(C.bpf_module_kern_version(program)),
+	}
+
+	for size := verifierLogMinSize; ; size *= 2 {
+		if size > verifierLogMaxSize {
+			size = verifierLogMaxSize
+		}
+
+		buf := make([]byte, size)
+
+		attr.logSize = uint32(len(buf))
+		attr.logBuf = uint64(uintptr(unsafe.Pointer(&buf[0])))
+
+		fd, _, errno := syscall.Syscall(sysBPF, bpfProgLoad, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+		if errno == 0 {
+			syscall.Close(int(fd))
+		}
+
+		// Truncated log is still returned if it does not fit the largest buffer
+		if errno == syscall.ENOSPC && size < verifierLogMaxSize {
+			continue
+		}
+
+		if end := bytes.IndexByte(buf, 0); end != -1 {
+			buf = buf[:end]
+		}
+
+		if len(buf) == 0 {
+			return "", fmt.Errorf("verifier log is empty: %v", errno)
+		}
+
+		return string(bytes.TrimSpace(buf)), nil
+	}
+}
@@ -0,0 +1,117 @@
+package push
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// flatten turns metric families into samples with dotted names, histograms
+// and summaries become samples for buckets or quantiles, count and sum
+func flatten(families []*dto.MetricFamily, prefix string) []sample {
+	samples := []sample{}
+
+	for _, family := range families {
+		name := family.GetName()
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		for _, metric := range family.Metric {
+			labels := metric.Label
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, sample{name: name, tags: labels, value: metric.Counter.GetValue()})
+			case dto.MetricType_GAUGE:
+				samples = append(samples, sample{name: name, tags: labels, value: metric.Gauge.GetValue()})
+			case dto.MetricType_UNTYPED:
+				samples = append(samples, sample{name: name, tags: labels, value: metric.Untyped.GetValue()})
+			case dto.MetricType_HISTOGRAM:
+				for _, bucket := range metric.Histogram.Bucket {
+					tags := withTag(labels, "le", formatValue(bucket.GetUpperBound()))
+					samples = append(samples, sample{name: name + ".bucket", tags: tags, value: float64(bucket.GetCumulativeCount())})
+				}
+
+				samples = append(samples, sample{name: name + ".count", tags: labels, value: float64(metric.Histogram.GetSampleCount())})
+				samples = append(samples, sample{name: name + ".sum", tags: labels, value: metric.Histogram.GetSampleSum()})
+			case dto.MetricType_SUMMARY:
+				for _, quantile := range metric.Summary.Quantile {
+					tags := withTag(labels, "quantile", formatValue(quantile.GetQuantile()))
+					samples = append(samples, sample{name: name, tags: tags, value: quantile.GetValue()})
+				}
+
+				samples = append(samples, sample{name: name + ".count", tags: labels, value: float64(metric.Summary.GetSampleCount())})
+				samples = append(samples, sample{name: name + ".sum", tags: labels, value: metric.Summary.GetSampleSum()})
+			}
+		}
+	}
+
+	return samples
+}
+
+// withTag returns a copy of labels with one more label added
+func withTag(labels []*dto.LabelPair, name, value string) []*dto.LabelPair {
+	tags := append([]*dto.LabelPair{}, labels...)
+	return append(tags, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+}
+
+// formatValue formats the value the same way prometheus text format does
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// graphiteLine formats the sample as "name;tag=value value timestamp"
+func graphiteLine(sample sample, timestamp int64) string {
+	line := sanitize(sample.name, " ;")
+
+	for _, tag := range sample.tags {
+		// Graphite does not accept tags with empty values
+		if tag.GetValue() == "" {
+			continue
+		}
+
+		line += fmt.Sprintf(";%s=%s", sanitize(tag.GetName(), " ;!^=~"), sanitize(tag.GetValue(), " ;~"))
+	}
+
+	return fmt.Sprintf("%s %s %d\n", line, formatValue(sample.value), timestamp)
+}
+
+// statsdLine formats the sample as a gauge "name:value|g|#tag:value",
+// counters are sent as gauges too, since they are cumulative
+func statsdLine(sample sample) string {
+	line := fmt.Sprintf("%s:%s|g", sanitize(sample.name, " :|@#"), formatValue(sample.value))
+
+	tags := []string{}
+	for _, tag := range sample.tags {
+		tags = append(tags, fmt.Sprintf("%s:%s", sanitize(tag.GetName(), " :|@#,"), sanitize(tag.GetValue(), " |@#,")))
+	}
+
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+
+	return line
+}
+
+// sanitize replaces characters that have meaning in the protocol with "_"
+func sanitize(in string, special string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(special, r) {
+			return '_'
+		}
+
+		return r
+	}, in)
+}
@@ -0,0 +1,67 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Gateway replaces metrics of the job and the instance in prometheus
+// pushgateway at the url with metrics gathered from the gatherer
+func Gateway(gatherer prometheus.Gatherer, gatewayURL, job, instance string) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("error gathering metrics: %s", err)
+	}
+
+	buf := bytes.Buffer{}
+	encoder := expfmt.NewEncoder(&buf, expfmt.FmtText)
+
+	for _, family := range families {
+		// Pushgateway rejects pushes with timestamps, which counters
+		// with timestamp_table carry, prometheus sets them on scrape
+		for _, metric := range family.GetMetric() {
+			metric.TimestampMs = nil
+		}
+
+		err = encoder.Encode(family)
+		if err != nil {
+			return fmt.Errorf("error encoding metric %q: %s", family.GetName(), err)
+		}
+	}
+
+	path := fmt.Sprintf("%s/metrics/job/%s", strings.TrimRight(gatewayURL, "/"), url.PathEscape(job))
+	if instance != "" {
+		path += "/instance/" + url.PathEscape(instance)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, path, &buf)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+
+	client := http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s from pushgateway: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package push
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// FormatGraphite is graphite plaintext protocol with tags over tcp
+	FormatGraphite = "graphite"
+	// FormatStatsd is statsd protocol with dogstatsd tags over udp
+	FormatStatsd = "statsd"
+)
+
+// Pusher periodically gathers metrics and pushes them to graphite or statsd
+// alongside regular prometheus scraping
+type Pusher struct {
+	gatherer prometheus.Gatherer
+	format   string
+	address  string
+	prefix   string
+}
+
+// New creates a pusher of metrics from the gatherer to the address
+// in the format, with metric names prefixed by the prefix if it is set
+func New(gatherer prometheus.Gatherer, format, address, prefix string) (*Pusher, error) {
+	switch format {
+	case FormatGraphite, FormatStatsd:
+	default:
+		return nil, fmt.Errorf("unknown push format %q", format)
+	}
+
+	return &Pusher{
+		gatherer: gatherer,
+		format:   format,
+		address:  address,
+		prefix:   prefix,
+	}, nil
+}
+
+// Run pushes metrics every interval forever, starting after the ready time
+// to skip metrics of maps that are not filled with data yet
+func (p *Pusher) Run(ready time.Time, interval time.Duration) {
+	time.Sleep(time.Until(ready))
+
+	for {
+		err := p.Push()
+		if err != nil {
+			log.Printf("Error pushing metrics to %s: %s", p.address, err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// Push gathers metrics and pushes them once
+func (p *Pusher) Push() error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("error gathering metrics: %s", err)
+	}
+
+	samples := flatten(families, p.prefix)
+
+	switch p.format {
+	case FormatGraphite:
+		return p.pushGraphite(samples)
+	default:
+		return p.pushStatsd(samples)
+	}
+}
+
+// pushGraphite sends all samples over one tcp connection
+func (p *Pusher) pushGraphite(samples []sample) error {
+	conn, err := net.DialTimeout("tcp", p.address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	now := time.Now().Unix()
+
+	buf := bytes.Buffer{}
+	for _, sample := range samples {
+		buf.WriteString(graphiteLine(sample, now))
+	}
+
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// pushStatsd sends every sample in its own udp datagram, since they
+// are not reassembled and large datagrams would be dropped
+func (p *Pusher) pushStatsd(samples []sample) error {
+	conn, err := net.Dial("udp", p.address)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	for _, sample := range samples {
+		_, err = conn.Write([]byte(statsdLine(sample)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sample is a single value of a metric with its tags
+type sample struct {
+	name  string
+	tags  []*dto.LabelPair
+	value float64
+}